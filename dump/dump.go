@@ -0,0 +1,323 @@
+// Package dump dissects the SRT traffic of a pcap or pcapng capture and
+// prints a timeline of each connection: handshakes, ACKs and NAKs,
+// retransmissions, sequence gaps and drops, followed by a summary.
+package dump
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+	"time"
+
+	"coresrt/packets"
+	"coresrt/pcap"
+	"coresrt/seqno"
+)
+
+type Options struct {
+	Port    uint16 // only datagrams from or to this UDP port are dissected, all if zero
+	Verbose bool   // print every packet in full, including data and keep-alives
+}
+
+// connection is the traffic between two UDP endpoints, the caller being the
+// one that sent first.
+type connection struct {
+	caller, listener netip.AddrPort
+	first, last      time.Time
+	lines            []string
+	sides            [2]side // sent by the caller, by the listener
+	streamID         string
+	rejection        packets.RejectReason
+}
+
+// side counts what one endpoint of a connection sent.
+type side struct {
+	data, bytes   int
+	retransmitted int
+	gaps, missing int // sequence number jumps, and the packets they skipped
+	highest       uint32
+	started       bool
+	acks, naks    int
+	ackACKs       int
+	nakLost       int // packets reported lost by this side
+	dropRequests  int
+	keepAlives    int
+	control       int
+}
+
+// Dump reads a capture from r and writes the timeline of each SRT
+// connection found in it to w.
+func Dump(w io.Writer, r io.Reader, opts Options) error {
+	pr, err := pcap.NewReader(r)
+	if err != nil {
+		return err
+	}
+
+	conns := make(map[[2]netip.AddrPort]*connection)
+	var order []*connection
+	var start time.Time
+	skipped, unparsed := 0, 0
+	for {
+		frame, err := pr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		dg, err := pcap.UDP(frame)
+		if err != nil {
+			skipped++
+			continue
+		}
+		if opts.Port != 0 && dg.Src.Port() != opts.Port && dg.Dst.Port() != opts.Port {
+			skipped++
+			continue
+		}
+		pkt, err := packets.ParsePacket(dg.Payload)
+		if err != nil {
+			unparsed++
+			continue
+		}
+		if start.IsZero() {
+			start = frame.Time
+		}
+
+		key := pairKey(dg.Src, dg.Dst)
+		c, ok := conns[key]
+		if !ok {
+			c = &connection{caller: dg.Src, listener: dg.Dst, first: frame.Time}
+			conns[key] = c
+			order = append(order, c)
+		}
+		c.last = frame.Time
+		c.add(frame.Time.Sub(start), dg.Src == c.caller, pkt, opts.Verbose)
+	}
+
+	for i, c := range order {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		c.write(w, i+1)
+	}
+	if len(order) == 0 {
+		fmt.Fprintln(w, "no SRT packets found")
+	}
+	if skipped > 0 || unparsed > 0 {
+		fmt.Fprintf(w, "\n%d frames skipped as not SRT over UDP, %d datagrams not parsed as SRT\n", skipped, unparsed)
+	}
+	return nil
+}
+
+// pairKey identifies the connection of a datagram, whichever way it goes.
+func pairKey(a, b netip.AddrPort) [2]netip.AddrPort {
+	if b.Compare(a) < 0 {
+		a, b = b, a
+	}
+	return [2]netip.AddrPort{a, b}
+}
+
+// add accounts for a packet, and adds it to the timeline if noteworthy.
+func (c *connection) add(at time.Duration, fromCaller bool, pkt interface{}, verbose bool) {
+	s := &c.sides[1]
+	dir := "<"
+	if fromCaller {
+		s = &c.sides[0]
+		dir = ">"
+	}
+	prefix := fmt.Sprintf("%12.6f %s ", at.Seconds(), dir)
+
+	var events []string
+	switch p := pkt.(type) {
+	case *packets.Data:
+		events = s.addData(p)
+	case *packets.Control:
+		s.control++
+		events = c.addControl(s, p)
+	}
+
+	if verbose {
+		lines := strings.Split(strings.TrimSuffix(packets.Format(pkt), "\n"), "\n")
+		c.lines = append(c.lines, prefix+lines[0])
+		for _, l := range lines[1:] {
+			c.lines = append(c.lines, strings.Repeat(" ", len(prefix))+l)
+		}
+		// the gaps found in the data, as the packet itself is shown
+		for _, e := range events {
+			if strings.HasPrefix(e, "gap") {
+				c.lines = append(c.lines, prefix+e)
+			}
+		}
+		return
+	}
+	for _, e := range events {
+		c.lines = append(c.lines, prefix+e)
+	}
+}
+
+func (s *side) addData(p *packets.Data) []string {
+	s.data++
+	s.bytes += len(p.Data)
+
+	var events []string
+	seq := p.PacketSequenceNumber
+	if !s.started {
+		s.started = true
+		s.highest = seq
+		events = append(events, fmt.Sprintf("first data packet: seq %d, msg %d", seq, p.MessageNumber))
+	} else if d := seqno.Diff(seq, s.highest); d > 0 {
+		if d > 1 {
+			s.gaps++
+			s.missing += int(d - 1)
+			_, list := lossList([]packets.LossRange{{From: seqno.Add(s.highest, 1), To: seqno.Add(seq, -1)}})
+			events = append(events, fmt.Sprintf("gap: %d missing, seq %s", d-1, list))
+		}
+		s.highest = seq
+	}
+	if p.RetransmittedPacketFlag != 0 {
+		s.retransmitted++
+		events = append(events, fmt.Sprintf("retransmitted: seq %d, msg %d", seq, p.MessageNumber))
+	}
+	return events
+}
+
+func (c *connection) addControl(s *side, p *packets.Control) []string {
+	switch p.ControlType {
+	case packets.HANDSHAKE:
+		return []string{c.handshake(p)}
+	case packets.KEEPALIVE:
+		s.keepAlives++
+		return nil
+	case packets.ACK:
+		s.acks++
+		ack, err := packets.ParseAcknowledgementControlPacket(p)
+		if err != nil {
+			return []string{fmt.Sprintf("ACK: %v", err)}
+		}
+		if !ack.IsFull() {
+			return []string{fmt.Sprintf("light ACK: up to seq %d", ack.LastAcknowledgedPacketSequenceNumber)}
+		}
+		return []string{fmt.Sprintf("ACK %d: up to seq %d, rtt %s, buffer %d packets",
+			ack.AcknowledgementNumber, ack.LastAcknowledgedPacketSequenceNumber,
+			time.Duration(ack.RTT)*time.Microsecond, ack.AvailableBufferSize)}
+	case packets.NAK:
+		s.naks++
+		nak, err := packets.ParseNegativeAcknowledgmentControlPacket(p)
+		if err != nil {
+			return []string{fmt.Sprintf("NAK: %v", err)}
+		}
+		ranges, err := nak.LossRanges()
+		if err != nil {
+			return []string{fmt.Sprintf("NAK: %v", err)}
+		}
+		n, list := lossList(ranges)
+		s.nakLost += n
+		return []string{fmt.Sprintf("NAK: %d lost, seq %s", n, list)}
+	case packets.ACKACK:
+		s.ackACKs++
+		return nil
+	case packets.DROPREQ:
+		s.dropRequests++
+		cif := p.ControlInformationField
+		if len(cif) < 8 {
+			return []string{fmt.Sprintf("DROPREQ: message %d", p.TypeSpecificInfo)}
+		}
+		return []string{fmt.Sprintf("DROPREQ: message %d, seq %d-%d",
+			p.TypeSpecificInfo, binary.BigEndian.Uint32(cif[0:4]), binary.BigEndian.Uint32(cif[4:8]))}
+	case packets.SHUTDOWN:
+		return []string{"SHUTDOWN"}
+	case packets.PEERERROR:
+		return []string{fmt.Sprintf("PEERERROR: code %d", p.TypeSpecificInfo)}
+	}
+	return []string{p.ControlType.String()}
+}
+
+// handshake summarizes a handshake on one line, remembering the stream ID
+// and any rejection.
+func (c *connection) handshake(p *packets.Control) string {
+	cif := p.ControlInformationField
+	hs, err := packets.ParseHandshakeControl(cif)
+	if err != nil {
+		return fmt.Sprintf("HANDSHAKE: %v", err)
+	}
+	if reason, ok := hs.HandshakeType.RejectReason(); ok {
+		c.rejection = reason
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "HANDSHAKE %s v%d socket %08x", hs.HandshakeType, hs.Version, hs.SRTSocketID)
+	if hs.SYNCookie != 0 {
+		fmt.Fprintf(&b, " cookie %08x", hs.SYNCookie)
+	}
+	if hs.HandshakeType == packets.Induction || hs.Version < 5 {
+		return b.String()
+	}
+	fmt.Fprintf(&b, " isn %d mtu %d window %d", hs.InitialPacketSequenceNumber, hs.MaximumTransmissionUnitSize, hs.MaximumFlowWindowSize)
+
+	for _, t := range []packets.ExtensionType{packets.HSREQ, packets.HSRSP} {
+		if data, ok := hs.Extension(t); ok {
+			if m, err := packets.ParseHandshakeExtensionMessage(data); err == nil {
+				fmt.Fprintf(&b, ", %s latency %dms", t, max(m.ReceiverTSBPDDelay, m.SenderTSBPDDelay))
+			}
+		}
+	}
+	if data, ok := hs.Extension(packets.SID); ok {
+		if sid, err := packets.ParseStreamIdExtensionMessage(data); err == nil {
+			c.streamID = sid.StreamID
+			fmt.Fprintf(&b, ", stream id %q", sid.StreamID)
+		}
+	}
+	if data, ok := hs.Extension(packets.Filter); ok {
+		if f, err := packets.ParseFilterExtensionMessage(data); err == nil {
+			fmt.Fprintf(&b, ", filter %q", f.Config)
+		}
+	}
+	if data, ok := hs.Extension(packets.Group); ok {
+		if g, err := packets.ParseGroupMembershipExtension(data); err == nil {
+			fmt.Fprintf(&b, ", %s group %08x", g.Type, g.GroupID)
+		}
+	}
+	if _, ok := hs.Extension(packets.KMREQ); ok {
+		b.WriteString(", encrypted")
+	}
+	return b.String()
+}
+
+func (c *connection) write(w io.Writer, n int) {
+	fmt.Fprintf(w, "connection %d: %s > %s", n, c.caller, c.listener)
+	if c.streamID != "" {
+		fmt.Fprintf(w, ", stream id %q", c.streamID)
+	}
+	fmt.Fprintf(w, ", %s\n", c.last.Sub(c.first).Round(time.Millisecond))
+	for _, l := range c.lines {
+		fmt.Fprintln(w, l)
+	}
+
+	fmt.Fprintln(w, "summary:")
+	if c.rejection != 0 {
+		fmt.Fprintf(w, "  %s\n", c.rejection.Error())
+	}
+	for i, s := range c.sides {
+		from := [...]string{"> caller", "< listener"}[i]
+		fmt.Fprintf(w, "  %s: %d data packets, %d bytes, %d retransmitted, %d gaps of %d packets\n",
+			from, s.data, s.bytes, s.retransmitted, s.gaps, s.missing)
+		fmt.Fprintf(w, "  %s  %d control packets: %d ACK, %d ACKACK, %d NAK reporting %d lost, %d drop requests, %d keep-alives\n",
+			strings.Repeat(" ", len(from)), s.control, s.acks, s.ackACKs, s.naks, s.nakLost, s.dropRequests, s.keepAlives)
+	}
+}
+
+func lossList(ranges []packets.LossRange) (int, string) {
+	total := 0
+	var parts []string
+	for _, r := range ranges {
+		total += r.Len()
+		if r.From == r.To {
+			parts = append(parts, fmt.Sprint(r.From))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", r.From, r.To))
+		}
+	}
+	return total, strings.Join(parts, ", ")
+}
@@ -0,0 +1,191 @@
+package dump_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"coresrt/dump"
+	"coresrt/packets"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+var (
+	caller   = netip.MustParseAddrPort("10.0.0.1:5000")
+	listener = netip.MustParseAddrPort("10.0.0.2:6000")
+	rejected = netip.MustParseAddrPort("10.0.0.3:7000")
+)
+
+// capture builds a pcap capture of Ethernet frames.
+type capture struct {
+	b   bytes.Buffer
+	now time.Time
+}
+
+func newCapture() *capture {
+	c := &capture{now: time.Unix(1700000000, 0)}
+	hdr := binary.LittleEndian.AppendUint32(nil, 0xA1B2C3D4)
+	hdr = binary.LittleEndian.AppendUint16(hdr, 2)
+	hdr = binary.LittleEndian.AppendUint16(hdr, 4)
+	hdr = append(hdr, make([]byte, 8)...)
+	hdr = binary.LittleEndian.AppendUint32(hdr, 65535)
+	hdr = binary.LittleEndian.AppendUint32(hdr, 1) // Ethernet
+	c.b.Write(hdr)
+	return c
+}
+
+// frame adds a frame after d.
+func (c *capture) frame(d time.Duration, data []byte) {
+	c.now = c.now.Add(d)
+	rec := binary.LittleEndian.AppendUint32(nil, uint32(c.now.Unix()))
+	rec = binary.LittleEndian.AppendUint32(rec, uint32(c.now.Nanosecond()/1000))
+	rec = binary.LittleEndian.AppendUint32(rec, uint32(len(data)))
+	rec = binary.LittleEndian.AppendUint32(rec, uint32(len(data)))
+	c.b.Write(rec)
+	c.b.Write(data)
+}
+
+// ip adds an IPv4 packet of protocol proto from src to dst.
+func (c *capture) ip(d time.Duration, proto byte, src, dst netip.AddrPort, body []byte) {
+	b := make([]byte, 34, 34+len(body))
+	binary.BigEndian.PutUint16(b[12:14], 0x0800)
+	ip := b[14:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(20+len(body)))
+	ip[8] = 64
+	ip[9] = proto
+	s, t := src.Addr().As4(), dst.Addr().As4()
+	copy(ip[12:16], s[:])
+	copy(ip[16:20], t[:])
+	c.frame(d, append(b, body...))
+}
+
+// udp adds a UDP datagram from src to dst.
+func (c *capture) udp(d time.Duration, src, dst netip.AddrPort, payload []byte) {
+	b := binary.BigEndian.AppendUint16(nil, src.Port())
+	b = binary.BigEndian.AppendUint16(b, dst.Port())
+	b = binary.BigEndian.AppendUint16(b, uint16(8+len(payload)))
+	b = append(b, 0, 0)
+	c.ip(d, 17, src, dst, append(b, payload...))
+}
+
+func control(typ packets.ControlPacketType, info uint32, cif []byte) []byte {
+	c := packets.Control{ControlType: typ, TypeSpecificInfo: info, ControlInformationField: cif}
+	return c.Marshal()
+}
+
+func handshake(hs packets.HandshakeControl) []byte {
+	return control(packets.HANDSHAKE, 0, hs.Marshal())
+}
+
+func data(seq, msg uint32, retransmitted bool, size int) []byte {
+	d := packets.Data{
+		PacketSequenceNumber: seq,
+		PacketPositionFlag:   0b11,
+		MessageNumber:        msg,
+		Data:                 make([]byte, size),
+	}
+	if retransmitted {
+		d.RetransmittedPacketFlag = 1
+	}
+	return d.Marshal()
+}
+
+// session returns a capture of a connection with losses, ACKs, NAKs and a
+// retransmission, a rejected connection, and frames that are not SRT.
+func session() []byte {
+	c := newCapture()
+	ms := time.Millisecond
+
+	c.udp(0, caller, listener, handshake(packets.HandshakeControl{
+		Version: 4, ExtensionField: 2, HandshakeType: packets.Induction, SRTSocketID: 0x1111,
+	}))
+	c.udp(ms, listener, caller, handshake(packets.HandshakeControl{
+		Version: 5, ExtensionField: 0x4A17, HandshakeType: packets.Induction, SRTSocketID: 0x1111, SYNCookie: 0xC0FFEE,
+	}))
+	hsreq := packets.HandshakeExtensionMessage{SRTVersion: 0x010500, SRTFlags: packets.TSBPDSND, SenderTSBPDDelay: 120}
+	sid := packets.StreamIdExtensionMessage{StreamID: "live/test"}
+	conclusion := packets.HandshakeControl{
+		Version: 5, ExtensionField: 5, InitialPacketSequenceNumber: 100, MaximumTransmissionUnitSize: 1500,
+		MaximumFlowWindowSize: 8192, HandshakeType: packets.Conclusion, SRTSocketID: 0x1111, SYNCookie: 0xC0FFEE,
+	}
+	conclusion.AddExtension(packets.HSREQ, hsreq.Marshal())
+	conclusion.AddExtension(packets.SID, sid.Marshal())
+	c.udp(ms, caller, listener, handshake(conclusion))
+	hsrsp := packets.HandshakeExtensionMessage{SRTVersion: 0x010500, SRTFlags: packets.TSBPDRCV, ReceiverTSBPDDelay: 120}
+	response := packets.HandshakeControl{
+		Version: 5, ExtensionField: 1, InitialPacketSequenceNumber: 100, MaximumTransmissionUnitSize: 1500,
+		MaximumFlowWindowSize: 8192, HandshakeType: packets.Conclusion, SRTSocketID: 0x2222,
+	}
+	response.AddExtension(packets.HSRSP, hsrsp.Marshal())
+	c.udp(ms, listener, caller, handshake(response))
+
+	c.udp(10*ms, caller, listener, data(100, 1, false, 1316))
+	c.udp(ms, caller, listener, data(101, 2, false, 1316))
+	c.udp(ms, caller, listener, data(104, 5, false, 100)) // 102 and 103 lost
+	nak := packets.NegativeAcknowledgmentControlPacket{ControlInformationField: packets.EncodeLossList([]packets.LossRange{{From: 102, To: 103}})}
+	c.udp(ms, listener, caller, nak.Marshal())
+	c.udp(5*ms, caller, listener, data(102, 3, true, 1316))
+	c.udp(ms, caller, listener, data(103, 4, true, 1316))
+	ack := packets.AcknowledgementControlPacket{AcknowledgementNumber: 1, LastAcknowledgedPacketSequenceNumber: 105, RTT: 12000, AvailableBufferSize: 8000}
+	c.udp(2*ms, listener, caller, ack.Marshal())
+	c.udp(ms, caller, listener, control(packets.ACKACK, 1, nil))
+	light := packets.AcknowledgementControlPacket{LastAcknowledgedPacketSequenceNumber: 105}
+	c.udp(ms, listener, caller, light.Marshal())
+	c.udp(ms, caller, listener, control(packets.DROPREQ, 6, binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 105), 106)))
+	c.udp(ms, caller, listener, data(107, 7, false, 10))
+	c.udp(100*ms, listener, caller, control(packets.KEEPALIVE, 0, nil))
+
+	// frames dump does not dissect
+	c.ip(ms, 6, caller, listener, make([]byte, 20))                      // TCP
+	c.udp(ms, caller, netip.MustParseAddrPort("10.0.0.2:53"), []byte{1}) // not SRT
+
+	c.udp(ms, rejected, listener, handshake(packets.HandshakeControl{
+		Version: 5, ExtensionField: 5, InitialPacketSequenceNumber: 7, MaximumTransmissionUnitSize: 1500,
+		MaximumFlowWindowSize: 8192, HandshakeType: packets.Conclusion, SRTSocketID: 0x3333, SYNCookie: 0xBEEF,
+	}))
+	c.udp(ms, listener, rejected, handshake(packets.HandshakeControl{
+		Version: 5, HandshakeType: packets.HandshakeType(packets.RejectRogue), SRTSocketID: 0x3333, SYNCookie: 0xBEEF,
+	}))
+
+	c.udp(ms, caller, listener, control(packets.SHUTDOWN, 0, make([]byte, 4)))
+	return c.b.Bytes()
+}
+
+func TestDump(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   dump.Options
+		golden string
+	}{
+		{"timeline", dump.Options{}, "timeline.golden"},
+		{"port", dump.Options{Port: 7000}, "port.golden"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := dump.Dump(&out, bytes.NewReader(session()), tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join("testdata", tt.golden)
+			if *update {
+				if err := os.WriteFile(path, out.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), want) {
+				t.Errorf("output differs from %s, run with -update to rewrite it:\n%s", path, out.Bytes())
+			}
+		})
+	}
+}
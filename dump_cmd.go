@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"coresrt/dump"
+)
+
+// runDump implements the dump command, which prints the SRT connections
+// found in capture files.
+func runDump(args []string) {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: coresrt dump [-port n] [-v] capture.pcap...")
+		fs.PrintDefaults()
+	}
+	port := fs.Uint("port", 0, "only dissect datagrams from or to this UDP port")
+	verbose := fs.Bool("v", false, "print every packet in full")
+	fs.Parse(args)
+	if fs.NArg() == 0 || *port > 0xFFFF {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	opts := dump.Options{Port: uint16(*port), Verbose: *verbose}
+	for i, name := range fs.Args() {
+		if fs.NArg() > 1 {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("== %s\n", name)
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		err = dump.Dump(os.Stdout, f, opts)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			os.Exit(1)
+		}
+	}
+}
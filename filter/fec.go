@@ -0,0 +1,436 @@
+package filter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"coresrt/packets"
+	"coresrt/seqno"
+)
+
+// The built-in "xorfec" filter is a SMPTE 2022-1 style forward error
+// correction. Packets are laid out in a matrix of cols packets per row
+// and rows rows, counting from the initial sequence number and on past
+// the wrap of sequence numbers:
+//
+//	+-----+-----+-----+-----+
+//	|  0  |  1  |  2  |  3  | -> row FEC
+//	+-----+-----+-----+-----+
+//	|  4  |  5  |  6  |  7  | -> row FEC
+//	+-----+-----+-----+-----+
+//	   |     |     |     |
+//	   v     v     v     v
+//	      column FEC packets
+//
+// Each FEC packet holds the XOR of the packets of its row or column, so
+// any single loss in a row or column can be rebuilt. Losses the rows
+// cannot repair, such as bursts, may still be repaired by the columns,
+// and the other way round. With rows:1 only row FEC is sent.
+//
+// A FEC packet carries the sequence number of the data packet it follows,
+// the XOR of the timestamps in its timestamp field, and a payload of:
+//
+//	 0                   1                   2                   3
+//	 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|  Group Index  |   Flag Clip   |          Length Clip          |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|P P|O|  0  |                 Message Number Clip               |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|                         Payload Clip                          |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//
+// where the group index is 0xFF for a row and the column number for a
+// column, and the clips are the XOR of the encryption flags, payload
+// lengths, message positions, order flags and numbers, and zero padded
+// payloads, so that a rebuilt packet is the one that was lost.
+//
+// The message number clip makes these packets differ from those of the
+// "fec" filter of libsrt, whose header is 4 bytes and whose default layout
+// is the staircase, so the filter has a name of its own: a libsrt peer
+// rejects it in the handshake rather than misreading its packets.
+//
+// Parameters:
+//
+//	cols    packets per row, required
+//	rows    rows per matrix, 1 if not set
+//	arq     always, onreq or never, onreq if not set
+//	layout  even, the only layout supported
+
+const (
+	fecHeaderSize = 8
+	rowGroupIndex = 0xFF
+
+	// after an outage, FEC groups are only set up for this many rows back
+	maxRowBacklog = 1024
+)
+
+func init() {
+	Register("xorfec", newFEC)
+}
+
+type fec struct {
+	isn  uint32
+	cols uint32
+	rows uint32
+	arq  ARQ
+
+	// sender
+	txLast   uint64 // highest index sent
+	txRow    *fecGroup
+	txCols   []*fecGroup
+	txMatrix uint64
+
+	// receiver
+	rxStarted    bool
+	rxHighest    uint64               // highest index received
+	rxRows       map[uint64]*fecGroup // key: row number
+	rxCols       map[uint64]*fecGroup // key: index of the column's first packet
+	rxNextRow    uint64               // first row not set up yet
+	rxNextMatrix uint64               // first matrix not set up yet
+}
+
+func newFEC(cfg Config, isn uint32) (Filter, error) {
+	f := &fec{
+		isn:    isn,
+		rows:   1,
+		arq:    ARQOnRequest,
+		rxRows: make(map[uint64]*fecGroup),
+		rxCols: make(map[uint64]*fecGroup),
+	}
+	for k, v := range cfg.Params {
+		switch k {
+		case "cols", "rows":
+			n, err := strconv.Atoi(v)
+			// column numbers must stay clear of the row group index
+			if err != nil || n < 1 || n >= rowGroupIndex {
+				return nil, fmt.Errorf("xorfec: invalid %s %q", k, v)
+			}
+			if k == "cols" {
+				f.cols = uint32(n)
+			} else {
+				f.rows = uint32(n)
+			}
+		case "arq":
+			switch v {
+			case "always":
+				f.arq = ARQAlways
+			case "onreq":
+				f.arq = ARQOnRequest
+			case "never":
+				f.arq = ARQNever
+			default:
+				return nil, fmt.Errorf("xorfec: invalid arq %q", v)
+			}
+		case "layout":
+			if v != "even" {
+				return nil, fmt.Errorf("xorfec: unsupported layout %q", v)
+			}
+		default:
+			return nil, fmt.Errorf("xorfec: unknown parameter %q", k)
+		}
+	}
+	if f.cols == 0 {
+		return nil, fmt.Errorf("xorfec: cols is required")
+	}
+	return f, nil
+}
+
+func (f *fec) ARQ() ARQ { return f.arq }
+
+// Overhead is the FEC header in front of the XOR of the payloads.
+func (f *fec) Overhead() int { return fecHeaderSize }
+
+// index returns the position of seq counting from the initial sequence
+// number and on past the wrap of sequence numbers: of the positions seq
+// may have, the nearest to ref, a recent one. It reports false for a
+// sequence number before the initial one.
+func (f *fec) index(seq uint32, ref uint64) (uint64, bool) {
+	d := int64(seqno.Diff((seq-f.isn)&seqno.Max, uint32(ref)&seqno.Max))
+	if d < 0 && uint64(-d) > ref {
+		return 0, false
+	}
+	return uint64(int64(ref) + d), true
+}
+
+// seq returns the sequence number at index i.
+func (f *fec) seq(i uint64) uint32 {
+	return (f.isn + uint32(i)) & seqno.Max
+}
+
+func (f *fec) matrixSize() uint64 { return uint64(f.cols) * uint64(f.rows) }
+
+func (f *fec) Send(p *packets.Data) []*packets.Data {
+	i, ok := f.index(p.PacketSequenceNumber, f.txLast)
+	if !ok {
+		return nil
+	}
+	f.txLast = max(f.txLast, i)
+	cols := uint64(f.cols)
+	var out []*packets.Data
+
+	row := i / cols
+	if f.txRow == nil || f.txRow.base != row*cols {
+		f.txRow = newFECGroup(row*cols, 1, f.cols)
+	}
+	if f.txRow.add(i, p) && f.txRow.complete() {
+		out = append(out, f.txRow.packet(rowGroupIndex, p.PacketSequenceNumber))
+	}
+
+	if f.rows > 1 {
+		matrix := i / f.matrixSize()
+		if f.txCols == nil || f.txMatrix != matrix {
+			f.txMatrix = matrix
+			f.txCols = make([]*fecGroup, f.cols)
+			for c := range f.txCols {
+				f.txCols[c] = newFECGroup(matrix*f.matrixSize()+uint64(c), f.cols, f.rows)
+			}
+		}
+		col := i % cols
+		g := f.txCols[col]
+		if g.add(i, p) && g.complete() {
+			out = append(out, g.packet(byte(col), p.PacketSequenceNumber))
+		}
+	}
+	return out
+}
+
+func (f *fec) Receive(p *packets.Data) Result {
+	i, ok := f.index(p.PacketSequenceNumber, f.rxHighest)
+	if !ok {
+		return Result{Pass: !IsFilterPacket(p)}
+	}
+	var res Result
+	if !f.rxStarted {
+		f.rxStarted = true
+		f.rxHighest = i
+		f.rxNextRow = i / uint64(f.cols)
+		f.rxNextMatrix = i / f.matrixSize()
+	}
+	if i >= f.rxHighest {
+		f.setUp(i)
+	}
+
+	if !IsFilterPacket(p) {
+		res.Pass = true
+		res.Rebuilt = f.store(i, p)
+	} else if len(p.Data) >= fecHeaderSize {
+		var g *fecGroup
+		if p.Data[0] == rowGroupIndex {
+			g = f.rxRows[i/uint64(f.cols)]
+		} else if f.rows > 1 && uint32(p.Data[0]) < f.cols {
+			g = f.rxCols[i/f.matrixSize()*f.matrixSize()+uint64(p.Data[0])]
+		}
+		if g != nil && !g.fec {
+			g.fec = true
+			g.xor(p.Data[1], binary.BigEndian.Uint16(p.Data[2:4]), binary.BigEndian.Uint32(p.Data[4:8]), p.Timestamp, p.Data[fecHeaderSize:])
+			if j, rebuilt := f.recover(g); rebuilt != nil {
+				res.Rebuilt = append([]*packets.Data{rebuilt}, f.store(j, rebuilt)...)
+			}
+		}
+	}
+
+	res.Lost = f.dismiss()
+	return res
+}
+
+// setUp creates the groups up to the one holding index i, so that groups
+// lost entirely are accounted for.
+func (f *fec) setUp(i uint64) {
+	f.rxHighest = i
+
+	row := i / uint64(f.cols)
+	if row >= f.rxNextRow && row-f.rxNextRow > maxRowBacklog {
+		f.rxNextRow = row - maxRowBacklog
+	}
+	for ; f.rxNextRow <= row; f.rxNextRow++ {
+		f.rxRows[f.rxNextRow] = newFECGroup(f.rxNextRow*uint64(f.cols), 1, f.cols)
+	}
+
+	if f.rows == 1 {
+		return
+	}
+	matrix := i / f.matrixSize()
+	if matrix >= f.rxNextMatrix && (matrix-f.rxNextMatrix)*uint64(f.rows) > maxRowBacklog {
+		f.rxNextMatrix = matrix - maxRowBacklog/uint64(f.rows)
+	}
+	for ; f.rxNextMatrix <= matrix; f.rxNextMatrix++ {
+		for c := range uint64(f.cols) {
+			base := f.rxNextMatrix*f.matrixSize() + c
+			f.rxCols[base] = newFECGroup(base, f.cols, f.rows)
+		}
+	}
+}
+
+// store adds a data packet to its groups, and then every packet this
+// allows to rebuild, which are returned.
+func (f *fec) store(i uint64, p *packets.Data) []*packets.Data {
+	type pending struct {
+		i uint64
+		p *packets.Data
+	}
+	var rebuilt []*packets.Data
+	queue := []pending{{i, p}}
+	queued := map[uint64]bool{i: true}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+
+		groups := []*fecGroup{f.rxRows[next.i/uint64(f.cols)]}
+		if f.rows > 1 {
+			groups = append(groups, f.rxCols[next.i/f.matrixSize()*f.matrixSize()+next.i%uint64(f.cols)])
+		}
+		for _, g := range groups {
+			if g == nil || !g.add(next.i, next.p) {
+				continue
+			}
+			if j, p := f.recover(g); p != nil && !queued[j] {
+				queued[j] = true
+				rebuilt = append(rebuilt, p)
+				queue = append(queue, pending{j, p})
+			}
+		}
+	}
+	return rebuilt
+}
+
+// recover rebuilds the packet missing from g if it is the only one.
+func (f *fec) recover(g *fecGroup) (uint64, *packets.Data) {
+	if !g.fec || g.seen != len(g.received)-1 {
+		return 0, nil
+	}
+	slot := 0
+	for g.received[slot] {
+		slot++
+	}
+	j := g.base + uint64(slot)*g.step
+
+	length := min(int(g.length), len(g.payload))
+	return j, &packets.Data{
+		PacketSequenceNumber:   f.seq(j),
+		PacketPositionFlag:     byte(g.message >> 30),
+		OrderFlag:              byte(g.message>>29) & 0b1,
+		KeyBasedEncryptionFlag: g.flags & 0b11,
+		MessageNumber:          g.message & seqno.MaxMessage,
+		Timestamp:              g.timestamp,
+		Data:                   append([]byte(nil), g.payload[:length]...),
+	}
+}
+
+// dismiss forgets the groups whose FEC packet should have arrived by now
+// and returns the losses that can no longer be recovered.
+func (f *fec) dismiss() []packets.LossRange {
+	cols := uint64(f.cols)
+	var lost []uint64
+	for row, g := range f.rxRows {
+		// with columns, rows are kept as long as the columns of their
+		// matrix, as each may help the other
+		end := (row + 1) * cols
+		if f.rows > 1 {
+			end = (row/uint64(f.rows) + 1) * f.matrixSize()
+		}
+		if f.rxHighest >= end+cols {
+			if f.rows == 1 {
+				lost = append(lost, g.missing()...)
+			}
+			delete(f.rxRows, row)
+		}
+	}
+	for base, g := range f.rxCols {
+		end := (base/f.matrixSize() + 1) * f.matrixSize()
+		if f.rxHighest >= end+cols {
+			lost = append(lost, g.missing()...)
+			delete(f.rxCols, base)
+		}
+	}
+	if len(lost) == 0 {
+		return nil
+	}
+
+	sort.Slice(lost, func(a, b int) bool { return lost[a] < lost[b] })
+	seqs := make([]uint32, len(lost))
+	for k, j := range lost {
+		seqs[k] = f.seq(j)
+	}
+	return seqno.Ranges(seqs)
+}
+
+// fecGroup is a row or a column, with the XOR of the packets seen so far.
+type fecGroup struct {
+	base     uint64 // index of the first packet
+	step     uint64 // index distance between packets: 1 in a row, cols in a column
+	received []bool
+	seen     int
+	fec      bool // receiver: the FEC packet arrived
+
+	flags     uint8
+	length    uint16
+	message   uint32 // position, order flag and message number
+	timestamp uint32
+	payload   []byte
+}
+
+func newFECGroup(base uint64, step, count uint32) *fecGroup {
+	return &fecGroup{base: base, step: uint64(step), received: make([]bool, count)}
+}
+
+// add XORs in the packet at index i and reports whether it was new.
+func (g *fecGroup) add(i uint64, p *packets.Data) bool {
+	slot := (i - g.base) / g.step
+	if slot >= uint64(len(g.received)) || g.received[slot] {
+		return false
+	}
+	g.received[slot] = true
+	g.seen++
+	message := uint32(p.PacketPositionFlag&0b11)<<30 | uint32(p.OrderFlag&0b1)<<29 | p.MessageNumber&seqno.MaxMessage
+	g.xor(p.KeyBasedEncryptionFlag, uint16(len(p.Data)), message, p.Timestamp, p.Data)
+	return true
+}
+
+func (g *fecGroup) xor(flags uint8, length uint16, message, timestamp uint32, payload []byte) {
+	g.flags ^= flags
+	g.length ^= length
+	g.message ^= message
+	g.timestamp ^= timestamp
+	if len(payload) > len(g.payload) {
+		g.payload = append(g.payload, make([]byte, len(payload)-len(g.payload))...)
+	}
+	for k, b := range payload {
+		g.payload[k] ^= b
+	}
+}
+
+func (g *fecGroup) complete() bool {
+	return g.seen == len(g.received)
+}
+
+// missing returns the indexes of the packets neither received nor rebuilt.
+func (g *fecGroup) missing() []uint64 {
+	var lost []uint64
+	for slot, ok := range g.received {
+		if !ok {
+			lost = append(lost, g.base+uint64(slot)*g.step)
+		}
+	}
+	return lost
+}
+
+// packet builds the FEC packet of a complete group, sent after the data
+// packet seq.
+func (g *fecGroup) packet(index byte, seq uint32) *packets.Data {
+	payload := make([]byte, fecHeaderSize+len(g.payload))
+	payload[0] = index
+	payload[1] = g.flags
+	binary.BigEndian.PutUint16(payload[2:4], g.length)
+	binary.BigEndian.PutUint32(payload[4:8], g.message)
+	copy(payload[fecHeaderSize:], g.payload)
+
+	return &packets.Data{
+		PacketSequenceNumber: seq,
+		PacketPositionFlag:   0b11,
+		Timestamp:            g.timestamp,
+		Data:                 payload,
+	}
+}
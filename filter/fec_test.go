@@ -0,0 +1,181 @@
+package filter_test
+
+import (
+	"bytes"
+	"testing"
+
+	"coresrt/filter"
+	"coresrt/packets"
+	"coresrt/seqno"
+)
+
+// stream returns n data packets from isn, in messages of three packets
+// with payloads of varied lengths.
+func stream(isn uint32, n int) []*packets.Data {
+	var pkts []*packets.Data
+	for i := range n {
+		pos := byte(0b00)
+		switch i % 3 {
+		case 0:
+			pos = 0b10
+		case 2:
+			pos = 0b01
+		}
+		pkts = append(pkts, &packets.Data{
+			PacketSequenceNumber: seqno.Add(isn, int32(i)),
+			PacketPositionFlag:   pos,
+			OrderFlag:            1,
+			MessageNumber:        uint32(i/3 + 1),
+			Timestamp:            uint32(1000 * i),
+			Data:                 bytes.Repeat([]byte{byte(i)}, 10+i%7),
+		})
+	}
+	return pkts
+}
+
+func TestFECRecovery(t *testing.T) {
+	const (
+		config = "xorfec,cols:4,rows:3"
+		isn    = seqno.Max - 5 // across the wrap
+		n      = 24            // two matrices
+	)
+	tests := []struct {
+		name string
+		lost []int // indexes of the data packets lost
+	}{
+		{"single loss", []int{5}},
+		{"row burst", []int{4, 5, 6, 7}},
+		{"column losses", []int{1, 5, 9}},
+		{"one in each matrix", []int{2, 14}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx, err := filter.New(config, isn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rx, err := filter.New(config, isn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lost := make(map[int]bool)
+			for _, i := range tt.lost {
+				lost[i] = true
+			}
+
+			sent := stream(isn, n)
+			got := make(map[uint32]*packets.Data)
+			for i, p := range sent {
+				out := tx.Send(p)
+				if !lost[i] {
+					out = append([]*packets.Data{p}, out...)
+				}
+				for _, q := range out {
+					res := rx.Receive(q)
+					if res.Pass != !filter.IsFilterPacket(q) {
+						t.Errorf("packet %d: Pass %v for a filter packet %v", q.PacketSequenceNumber, res.Pass, filter.IsFilterPacket(q))
+					}
+					if len(res.Lost) > 0 {
+						t.Errorf("losses given up on: %v", res.Lost)
+					}
+					for _, r := range res.Rebuilt {
+						if got[r.PacketSequenceNumber] != nil {
+							t.Errorf("packet %d rebuilt twice", r.PacketSequenceNumber)
+						}
+						got[r.PacketSequenceNumber] = r
+					}
+				}
+			}
+
+			for _, i := range tt.lost {
+				want := sent[i]
+				r := got[want.PacketSequenceNumber]
+				if r == nil {
+					t.Errorf("packet %d not rebuilt", want.PacketSequenceNumber)
+					continue
+				}
+				if filter.IsFilterPacket(r) {
+					t.Errorf("packet %d rebuilt as a filter packet", want.PacketSequenceNumber)
+				}
+				if !bytes.Equal(r.Marshal(), want.Marshal()) {
+					t.Errorf("packet %d rebuilt as %+v, want %+v", want.PacketSequenceNumber, r, want)
+				}
+				delete(got, want.PacketSequenceNumber)
+			}
+			for seq := range got {
+				t.Errorf("packet %d rebuilt but not lost", seq)
+			}
+		})
+	}
+}
+
+// TestFECIndexWrap runs a stream across the wrap of the positions that
+// lay packets out in matrices, 2^31 packets after the initial sequence
+// number, with a number of columns that does not divide it so that a row
+// straddles the wrap.
+func TestFECIndexWrap(t *testing.T) {
+	const (
+		config = "xorfec,cols:3,rows:2"
+		isn    = 1000
+		n      = 48 // eight matrices
+	)
+	tx, err := filter.New(config, isn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rx, err := filter.New(config, isn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(i uint64) uint32 { return seqno.Add(isn, int32(uint32(i))) }
+
+	// reach the wrap by jumps of less than half the sequence space
+	for _, i := range []uint64{1 << 29, 1 << 30, 3 << 29} {
+		p := &packets.Data{PacketSequenceNumber: at(i), MessageNumber: 1, Data: []byte{1}}
+		tx.Send(p)
+		rx.Receive(p)
+	}
+
+	// from the first matrix starting at least 30 packets before the wrap
+	start := (uint64(1<<31-30) + 5) / 6 * 6
+	wrap := int(1<<31 - start)
+	// the packet at the wrap ends a row that straddles it
+	lost := map[int]bool{wrap - 5: true, wrap: true, wrap + 4: true}
+	sent := stream(at(start), n)
+	got := make(map[uint32]bool)
+	for i, p := range sent {
+		out := tx.Send(p)
+		if !lost[i] {
+			out = append([]*packets.Data{p}, out...)
+		}
+		for _, q := range out {
+			res := rx.Receive(q)
+			for _, r := range res.Lost {
+				for _, p := range sent {
+					if r.Contains(p.PacketSequenceNumber) {
+						t.Errorf("packet %d given up on", p.PacketSequenceNumber)
+					}
+				}
+			}
+			for _, r := range res.Rebuilt {
+				got[r.PacketSequenceNumber] = true
+			}
+		}
+	}
+	for i := range lost {
+		if !got[sent[i].PacketSequenceNumber] {
+			t.Errorf("packet %d, %d after the wrap, not rebuilt", sent[i].PacketSequenceNumber, i-wrap)
+		}
+	}
+}
+
+// TestFECName checks that the configuration of the libsrt fec filter,
+// whose packets differ, is refused rather than taken for xorfec.
+func TestFECName(t *testing.T) {
+	if _, err := filter.New("fec,cols:4,rows:3", 1); err == nil {
+		t.Error("libsrt fec configuration accepted")
+	}
+	if _, err := filter.New("xorfec,cols:4,rows:3", 1); err != nil {
+		t.Errorf("xorfec configuration refused: %v", err)
+	}
+}
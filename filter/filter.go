@@ -0,0 +1,183 @@
+// Package filter implements SRT packet filters, which see every data
+// packet on its way out of the sender and into the receiver, and may add
+// their own packets to the stream and rebuild lost ones.
+//
+// A filter is selected by a configuration string such as
+// "xorfec,cols:10,rows:5,arq:onreq": the filter type followed by comma
+// separated key:value parameters. Both peers propose a configuration in
+// the SRT_CMD_FILTER handshake extension and must agree on it.
+//
+// Filter packets travel as data packets with message number 0, which SRT
+// never uses for data.
+package filter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"coresrt/packets"
+)
+
+// ARQ tells when a receiver using a filter requests lost packets again.
+type ARQ int
+
+const (
+	ARQAlways    ARQ = iota // as soon as a loss is detected, as without a filter
+	ARQOnRequest            // only for losses the filter could not recover
+	ARQNever                // never, the filter is the only way to recover losses
+)
+
+// Filter is a packet filter for one direction of a connection. It is not
+// safe for concurrent use.
+type Filter interface {
+	// Send is given each new data packet before it is sent, in sequence
+	// order, and returns the filter packets to send after it.
+	Send(p *packets.Data) []*packets.Data
+
+	// Receive is given each data packet received, filter packets
+	// included.
+	Receive(p *packets.Data) Result
+
+	// ARQ tells when lost packets are requested again.
+	ARQ() ARQ
+}
+
+// Overheader is implemented by filters whose packets are larger than the
+// data packets they protect, so that the sender keeps its payloads small
+// enough for the filter packets to fit in the MTU.
+type Overheader interface {
+	// Overhead is how many bytes the filter packets add to the largest
+	// payload.
+	Overhead() int
+}
+
+// Overhead returns the bytes f adds to the largest payload, 0 if f is nil
+// or does not say.
+func Overhead(f Filter) int {
+	if o, ok := f.(Overheader); ok {
+		return o.Overhead()
+	}
+	return 0
+}
+
+// Result is what a receiving filter made of a packet.
+type Result struct {
+	Pass    bool                // p is a data packet, not a filter packet
+	Rebuilt []*packets.Data     // lost packets recovered thanks to p
+	Lost    []packets.LossRange // losses given up on, to request with ARQOnRequest
+}
+
+// IsFilterPacket reports whether p was added to the stream by a filter.
+func IsFilterPacket(p *packets.Data) bool {
+	return p.MessageNumber == 0
+}
+
+// Factory creates a filter for a connection whose first data packet has
+// the sequence number isn.
+type Factory func(cfg Config, isn uint32) (Filter, error)
+
+var (
+	mu        sync.Mutex
+	factories = make(map[string]Factory)
+)
+
+// Register makes a filter type available to New. The built-in "xorfec"
+// filter is always registered.
+func Register(name string, f Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	factories[name] = f
+}
+
+// New creates the filter described by a configuration string.
+func New(config string, isn uint32) (Filter, error) {
+	cfg, err := ParseConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	mu.Lock()
+	f, ok := factories[cfg.Type]
+	mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown packet filter %q", cfg.Type)
+	}
+	return f(cfg, isn)
+}
+
+// Config is a parsed filter configuration string.
+type Config struct {
+	Type   string
+	Params map[string]string
+}
+
+// ParseConfig parses a configuration string of the form
+// "type,key:value,key:value".
+func ParseConfig(s string) (Config, error) {
+	fields := strings.Split(s, ",")
+	cfg := Config{Type: strings.TrimSpace(fields[0]), Params: make(map[string]string)}
+	if cfg.Type == "" {
+		return Config{}, fmt.Errorf("filter config %q: missing filter type", s)
+	}
+	for _, f := range fields[1:] {
+		k, v, ok := strings.Cut(f, ":")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || k == "" {
+			return Config{}, fmt.Errorf("filter config %q: malformed parameter %q", s, f)
+		}
+		cfg.Params[k] = v
+	}
+	return cfg, nil
+}
+
+// String formats the configuration with its parameters sorted, so that
+// equal configurations give equal strings.
+func (c Config) String() string {
+	keys := make([]string, 0, len(c.Params))
+	for k := range c.Params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(c.Type)
+	for _, k := range keys {
+		fmt.Fprintf(&b, ",%s:%s", k, c.Params[k])
+	}
+	return b.String()
+}
+
+// Negotiate merges the configurations proposed by both peers, either of
+// which may be empty. Parameters set by only one peer are taken as they
+// are, while those set by both must agree.
+func Negotiate(local, peer string) (string, error) {
+	switch {
+	case local == "" && peer == "":
+		return "", nil
+	case local == "":
+		local, peer = peer, local
+	}
+
+	cfg, err := ParseConfig(local)
+	if err != nil {
+		return "", err
+	}
+	if peer != "" {
+		peerCfg, err := ParseConfig(peer)
+		if err != nil {
+			return "", err
+		}
+		if peerCfg.Type != cfg.Type {
+			return "", fmt.Errorf("packet filter %q does not match peer's %q", cfg.Type, peerCfg.Type)
+		}
+		for k, v := range peerCfg.Params {
+			if mine, ok := cfg.Params[k]; ok && mine != v {
+				return "", fmt.Errorf("packet filter parameter %s:%s does not match peer's %s:%s", k, mine, k, v)
+			}
+			cfg.Params[k] = v
+		}
+	}
+	return cfg.String(), nil
+}
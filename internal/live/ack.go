@@ -0,0 +1,55 @@
+package live
+
+import "time"
+
+// ackHistoryTimeout is how long an ACK waits for its ACKACK before it is
+// forgotten.
+const ackHistoryTimeout = 10 * time.Second
+
+// ACKs numbers the full ACKs of a receiving connection, tells when one
+// would bring the peer news, and measures the RTT from the ACKACKs
+// answering them. The zero value is ready to use.
+type ACKs struct {
+	number   uint32               // of the last full ACK, the first is 1
+	lastSeq  uint32               // sequence number it acknowledged
+	lastFree int                  // free receive buffer space it reported
+	history  map[uint32]time.Time // full ACKs awaiting an ACKACK
+}
+
+// Next returns the number of a full ACK of seq reporting free packets of
+// room in the receive buffer, to send at now, unless it would tell the
+// peer nothing new: neither new data, nor more room for a peer stopped by
+// a full buffer.
+func (a *ACKs) Next(seq uint32, free int, now time.Time) (uint32, bool) {
+	if a.number != 0 && seq == a.lastSeq && free <= a.lastFree {
+		return 0, false
+	}
+	if a.history == nil {
+		a.history = make(map[uint32]time.Time)
+	}
+	for n, sent := range a.history {
+		if now.Sub(sent) > ackHistoryTimeout {
+			delete(a.history, n)
+		}
+	}
+	a.number++
+	a.lastSeq, a.lastFree = seq, free
+	a.history[a.number] = now
+	return a.number, true
+}
+
+// Answered returns the RTT measured by the ACKACK of ACK number n arriving
+// at now, and forgets the ACKs up to n. It returns false for an ACK it
+// does not know.
+func (a *ACKs) Answered(n uint32, now time.Time) (time.Duration, bool) {
+	sent, ok := a.history[n]
+	if !ok {
+		return 0, false
+	}
+	for m := range a.history {
+		if m <= n {
+			delete(a.history, m)
+		}
+	}
+	return now.Sub(sent), true
+}
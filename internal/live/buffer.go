@@ -0,0 +1,239 @@
+package live
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"coresrt/packets"
+	"coresrt/seqno"
+	"coresrt/stats"
+)
+
+const deliveryInterval = time.Millisecond
+
+type bufferedPacket struct {
+	payload   []byte
+	deliverAt time.Time
+}
+
+// RecvBuffer reorders packets by key (sequence or message number) and
+// writes them out once their TSBPD delivery time has come, skipping any
+// that did not arrive in time. Duplicates, such as the copies received
+// over the other links of a group, are discarded.
+//
+// The buffer holds up to size packets. As a slow writer holds up delivery,
+// it fills up and the free space advertised in ACKs shrinks, which stops
+// the sender.
+type RecvBuffer struct {
+	mu        sync.Mutex
+	packets   map[uint32]bufferedPacket
+	size      int
+	keyDiff   func(a, b uint32) int32 // a - b in the wrapping key space
+	keyNext   func(uint32) uint32     // the key following another
+	next      uint32                  // key of the next packet to deliver
+	started   bool                    // whether next has been set by a first packet
+	delivered bool                    // whether anything has been delivered yet
+	dropped   *atomic.Uint64          // count of packets skipped as too late, if not nil
+	out       io.Writer
+	onError   func(error) // of out
+	stop      chan struct{}
+}
+
+// NewRecvBuffer returns a buffer of size packets keyed by sequence
+// number, or by message number if messages is set, delivering to out. The
+// errors writing to out are given to onError.
+func NewRecvBuffer(out io.Writer, size int, messages bool, dropped *atomic.Uint64, onError func(error)) *RecvBuffer {
+	b := &RecvBuffer{
+		packets: make(map[uint32]bufferedPacket),
+		size:    size,
+		keyDiff: seqno.Diff,
+		keyNext: seqno.Next,
+		dropped: dropped,
+		out:     out,
+		onError: onError,
+		stop:    make(chan struct{}),
+	}
+	if messages {
+		b.keyDiff, b.keyNext = seqno.MessageDiff, seqno.NextMessage
+	}
+	go b.run()
+	return b
+}
+
+// Push stores a packet and reports whether it was new.
+func (b *RecvBuffer) Push(key uint32, payload []byte, deliverAt time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.started {
+		b.next = key
+		b.started = true
+	}
+	if b.keyDiff(key, b.next) < 0 {
+		if b.delivered {
+			return false
+		}
+		// nothing delivered yet, so an earlier first packet is still useful
+		b.next = key
+	}
+	if _, ok := b.packets[key]; ok {
+		return false
+	}
+
+	b.packets[key] = bufferedPacket{payload: payload, deliverAt: deliverAt}
+	return true
+}
+
+// Missing returns the parts of [from, to] that are neither buffered nor
+// already delivered, so that a group member does not report packets that
+// another link brought in. The buffer must be keyed by sequence number.
+func (b *RecvBuffer) Missing(from, to uint32) []packets.LossRange {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.delivered && b.keyDiff(from, b.next) < 0 {
+		from = b.next
+	}
+	if b.keyDiff(to, from) < 0 {
+		return nil
+	}
+
+	var ranges []packets.LossRange
+	if int(b.keyDiff(to, from)) < len(b.packets) {
+		inRange := false
+		for key := from; ; key = b.keyNext(key) {
+			if _, ok := b.packets[key]; ok {
+				inRange = false
+			} else if inRange {
+				ranges[len(ranges)-1].To = key
+			} else {
+				ranges = append(ranges, packets.LossRange{From: key, To: key})
+				inRange = true
+			}
+			if key == to {
+				break
+			}
+		}
+		return ranges
+	}
+
+	// a forged or far-ahead packet makes a gap too long to walk: go
+	// through the buffered packets instead
+	var held []uint32
+	for key := range b.packets {
+		if b.keyDiff(key, from) >= 0 && b.keyDiff(to, key) >= 0 {
+			held = append(held, key)
+		}
+	}
+	sort.Slice(held, func(i, j int) bool { return b.keyDiff(held[i], held[j]) < 0 })
+	next := from
+	for _, key := range held {
+		if key != next {
+			ranges = append(ranges, packets.LossRange{From: next, To: seqno.Prev(key)})
+		}
+		next = b.keyNext(key)
+	}
+	if b.keyDiff(to, next) >= 0 {
+		ranges = append(ranges, packets.LossRange{From: next, To: to})
+	}
+	return ranges
+}
+
+func (b *RecvBuffer) run() {
+	ticker := time.NewTicker(deliveryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case now := <-ticker.C:
+			for _, payload := range b.ready(now) {
+				if _, err := b.out.Write(payload); err != nil {
+					b.onError(err)
+				}
+			}
+		}
+	}
+}
+
+// ready removes and returns the payloads due for delivery at now.
+func (b *RecvBuffer) ready(now time.Time) [][]byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var out [][]byte
+	for len(b.packets) > 0 {
+		p, ok := b.packets[b.next]
+		if !ok {
+			// the next packet is missing: skip to the earliest buffered
+			// one if that is already due, dropping the gap
+			key, found := b.earliest()
+			if !found || now.Before(b.packets[key].deliverAt) {
+				break
+			}
+			if b.dropped != nil {
+				b.dropped.Add(uint64(b.keyDiff(key, b.next)))
+			}
+			b.next = key
+			continue
+		}
+		if now.Before(p.deliverAt) {
+			break
+		}
+
+		out = append(out, p.payload)
+		delete(b.packets, b.next)
+		b.next = b.keyNext(b.next)
+		b.delivered = true
+	}
+	return out
+}
+
+func (b *RecvBuffer) earliest() (uint32, bool) {
+	var best uint32
+	found := false
+	for key := range b.packets {
+		if !found || b.keyDiff(key, best) < 0 {
+			best = key
+			found = true
+		}
+	}
+	return best, found
+}
+
+// Free returns how many more packets the buffer can take.
+func (b *RecvBuffer) Free() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return max(b.size-len(b.packets), 0)
+}
+
+// Occupancy returns how much is waiting for delivery.
+func (b *RecvBuffer) Occupancy() stats.Buffer {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var o stats.Buffer
+	var first, last time.Time
+	for _, p := range b.packets {
+		o.Packets++
+		o.Bytes += len(p.payload)
+		if first.IsZero() || p.deliverAt.Before(first) {
+			first = p.deliverAt
+		}
+		if p.deliverAt.After(last) {
+			last = p.deliverAt
+		}
+	}
+	o.Span = last.Sub(first)
+	return o
+}
+
+// Close stops the delivery.
+func (b *RecvBuffer) Close() {
+	close(b.stop)
+}
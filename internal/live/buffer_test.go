@@ -0,0 +1,57 @@
+package live_test
+
+import (
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"coresrt/internal/live"
+	"coresrt/packets"
+	"coresrt/seqno"
+)
+
+func TestMissing(t *testing.T) {
+	// buffered around the wrap of the sequence numbers
+	held := []uint32{seqno.Max - 1, 1, 2, 5, 1 << 20}
+	tests := []struct {
+		name     string
+		from, to uint32
+		want     []packets.LossRange
+	}{
+		{"nothing buffered in between", 10, 12, []packets.LossRange{{From: 10, To: 12}}},
+		{"all buffered", 1, 2, nil},
+		{"short gap", seqno.Max - 2, 6, []packets.LossRange{
+			{From: seqno.Max - 2, To: seqno.Max - 2},
+			{From: seqno.Max, To: 0},
+			{From: 3, To: 4},
+			{From: 6, To: 6},
+		}},
+		{"gap too long to walk", seqno.Max - 2, 1 << 29, []packets.LossRange{
+			{From: seqno.Max - 2, To: seqno.Max - 2},
+			{From: seqno.Max, To: 0},
+			{From: 3, To: 4},
+			{From: 6, To: 1<<20 - 1},
+			{From: 1<<20 + 1, To: 1 << 29},
+		}},
+		{"long gap ending on a buffered packet", 3, 1 << 20, []packets.LossRange{
+			{From: 3, To: 4},
+			{From: 6, To: 1<<20 - 1},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := live.NewRecvBuffer(io.Discard, 100, false, nil, func(error) {})
+			defer b.Close()
+			// far in the future, so that nothing is delivered
+			deliverAt := time.Now().Add(time.Hour)
+			for _, key := range held {
+				b.Push(key, []byte{0}, deliverAt)
+			}
+
+			if got := b.Missing(tt.from, tt.to); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Missing(%d, %d) = %v, want %v", tt.from, tt.to, got, tt.want)
+			}
+		})
+	}
+}
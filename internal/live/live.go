@@ -0,0 +1,58 @@
+// Package live holds the send and receive queues of an SRT connection in
+// live mode, shared by the listener and caller sides since a connection
+// carries data both ways (section 4.9 of the SRT draft).
+//
+// The send queue keeps what was sent until the peer acknowledges it,
+// holds back what exceeds the flow window of the peer, pairs probing
+// packets and picks what to retransmit or drop as too late. The receive
+// side tracks the sequence numbers received and the losses to report,
+// numbers the ACKs, and buffers the packets until their TSBPD delivery
+// time.
+//
+// The queues do no I/O: their methods return the packets or loss ranges to
+// send, which the connection marshals once it released the mutex guarding
+// them. Only RecvBuffer, which runs a delivery goroutine, locks itself.
+package live
+
+import (
+	"fmt"
+	"time"
+
+	"coresrt/packets"
+)
+
+// minNAKInterval is the shortest period of NAK reports, for links with a
+// very low RTT.
+const minNAKInterval = 20 * time.Millisecond
+
+// NAKInterval is the period of NAK reports for a link: half the RTT plus
+// four times its variance, at least 20ms.
+func NAKInterval(rtt, rttVar time.Duration) time.Duration {
+	return max((rtt+4*rttVar)/2, minNAKInterval)
+}
+
+// MaxNAKRanges is how many loss ranges fit in a NAK within the MTU.
+func MaxNAKRanges(mtu int) int {
+	return packets.MaxPayloadSize(mtu) / 8
+}
+
+// Packetize splits a message into data packets of at most size bytes of
+// payload with the packet position flags set. Sequence numbers are left
+// for the caller to assign. It panics if size is not positive.
+func Packetize(p []byte, size int, msg uint32, timestamp uint32) []*packets.Data {
+	if size <= 0 {
+		panic(fmt.Sprintf("live: payload size %d", size))
+	}
+	var pkts []*packets.Data
+	for off := 0; off < len(p) || off == 0; off += size {
+		end := min(off+size, len(p))
+		pkts = append(pkts, &packets.Data{
+			MessageNumber: msg,
+			Timestamp:     timestamp,
+			Data:          p[off:end],
+		})
+	}
+	pkts[0].PacketPositionFlag |= 0b10
+	pkts[len(pkts)-1].PacketPositionFlag |= 0b01
+	return pkts
+}
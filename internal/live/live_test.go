@@ -0,0 +1,48 @@
+package live_test
+
+import (
+	"testing"
+
+	"coresrt/internal/live"
+)
+
+func TestPacketize(t *testing.T) {
+	tests := []struct {
+		name  string
+		len   int
+		sizes []int
+		flags []byte
+	}{
+		{"empty", 0, []int{0}, []byte{0b11}},
+		{"single", 3, []int{3}, []byte{0b11}},
+		{"exact", 8, []int{4, 4}, []byte{0b10, 0b01}},
+		{"three", 10, []int{4, 4, 2}, []byte{0b10, 0b00, 0b01}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkts := live.Packetize(make([]byte, tt.len), 4, 7, 100)
+			if len(pkts) != len(tt.sizes) {
+				t.Fatalf("got %d packets, want %d", len(pkts), len(tt.sizes))
+			}
+			for i, p := range pkts {
+				if len(p.Data) != tt.sizes[i] || p.PacketPositionFlag != tt.flags[i] || p.MessageNumber != 7 {
+					t.Errorf("packet %d: %d bytes, flags %02b, msg %d, want %d bytes, flags %02b, msg 7",
+						i, len(p.Data), p.PacketPositionFlag, p.MessageNumber, tt.sizes[i], tt.flags[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPacketizeBadSize(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("size %d: no panic", size)
+				}
+			}()
+			live.Packetize([]byte("data"), size, 1, 0)
+		}()
+	}
+}
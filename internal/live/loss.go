@@ -0,0 +1,167 @@
+package live
+
+import (
+	"time"
+
+	"coresrt/packets"
+	"coresrt/seqno"
+)
+
+// Loss is a range of missing sequence numbers.
+type Loss struct {
+	packets.LossRange
+	Detected time.Time
+	NAKAt    time.Time // when a NAK last reported it, zero until one did
+}
+
+// LossList holds the ranges of missing sequence numbers in order.
+type LossList []Loss
+
+func (l *LossList) add(from, to uint32, now time.Time) {
+	*l = append(*l, Loss{LossRange: packets.LossRange{From: from, To: to}, Detected: now})
+}
+
+// remove takes seq out of the list, splitting a range if needed, and
+// reports whether it was there.
+func (l *LossList) remove(seq uint32) bool {
+	for i, r := range *l {
+		if !r.Contains(seq) {
+			continue
+		}
+
+		switch {
+		case r.From == r.To:
+			*l = append((*l)[:i], (*l)[i+1:]...)
+		case seq == r.From:
+			(*l)[i].From = seqno.Next(seq)
+		case seq == r.To:
+			(*l)[i].To = seqno.Prev(seq)
+		default:
+			tail := r
+			tail.From = seqno.Next(seq)
+			(*l)[i].To = seqno.Prev(seq)
+			*l = append((*l)[:i+1], append(LossList{tail}, (*l)[i+1:]...)...)
+		}
+		return true
+	}
+	return false
+}
+
+// expire drops ranges detected before deadline, since their packets can no
+// longer be delivered in time, and returns how many packets were dropped.
+func (l *LossList) expire(deadline time.Time) int {
+	dropped := 0
+	for len(*l) > 0 && (*l)[0].Detected.Before(deadline) {
+		dropped += (*l)[0].Len()
+		*l = (*l)[1:]
+	}
+	return dropped
+}
+
+// Report marks the ranges overlapping r as reported by a NAK at now.
+func (l LossList) Report(r packets.LossRange, now time.Time) {
+	for i := range l {
+		if !seqno.Less(l[i].To, r.From) && !seqno.Less(r.To, l[i].From) {
+			l[i].NAKAt = now
+		}
+	}
+}
+
+// Due returns the ranges to report again in a periodic NAK at now, in case
+// the NAK or the retransmission was lost, and marks them reported: those a
+// NAK reported at least NAKInterval(rtt, rttVar) ago, as many as fit in a
+// NAK within the MTU.
+func (l LossList) Due(now time.Time, rtt, rttVar time.Duration, mtu int) []packets.LossRange {
+	interval, limit := NAKInterval(rtt, rttVar), MaxNAKRanges(mtu)
+	var ranges []packets.LossRange
+	for i := range l {
+		if len(ranges) == limit {
+			break
+		}
+		if !l[i].NAKAt.IsZero() && now.Sub(l[i].NAKAt) >= interval {
+			l[i].NAKAt = now
+			ranges = append(ranges, l[i].LossRange)
+		}
+	}
+	return ranges
+}
+
+// Intersect returns the parts of r that are in the list.
+func (l LossList) Intersect(r packets.LossRange) []packets.LossRange {
+	var ranges []packets.LossRange
+	for _, lr := range l {
+		from, to := lr.From, lr.To
+		if seqno.Less(from, r.From) {
+			from = r.From
+		}
+		if seqno.Less(r.To, to) {
+			to = r.To
+		}
+		if !seqno.Less(to, from) {
+			ranges = append(ranges, packets.LossRange{From: from, To: to})
+		}
+	}
+	return ranges
+}
+
+// SeqTracker follows the sequence numbers received on a link, or across
+// all the links of a balancing group, and keeps the list of missing ones.
+type SeqTracker struct {
+	Losses LossList
+
+	maxSeq     uint32 // highest sequence number received
+	highestSeq uint32 // highest contiguous sequence number received
+}
+
+// NewSeqTracker returns the tracker of a link whose peer starts sending
+// at isn, as both directions start at the initial sequence number of the
+// handshake.
+func NewSeqTracker(isn uint32) SeqTracker {
+	return SeqTracker{maxSeq: seqno.Prev(isn), highestSeq: seqno.Prev(isn)}
+}
+
+// Receive records seq. It returns the gap seq opened after the highest
+// sequence number so far, for the caller to add to the loss list, and
+// whether seq was new rather than a duplicate or a packet given up on.
+func (t *SeqTracker) Receive(seq uint32) (gap *packets.LossRange, isNew bool) {
+	switch d := seqno.Diff(seq, t.maxSeq); {
+	case d == 1:
+		t.maxSeq = seq
+	case d > 1:
+		gap = &packets.LossRange{From: seqno.Next(t.maxSeq), To: seqno.Prev(seq)}
+		t.maxSeq = seq
+	default:
+		if !t.Losses.remove(seq) {
+			return nil, false
+		}
+	}
+	t.update()
+	return gap, true
+}
+
+// AddLoss adds r, detected at now, to the loss list.
+func (t *SeqTracker) AddLoss(r packets.LossRange, now time.Time) {
+	t.Losses.add(r.From, r.To, now)
+	t.update()
+}
+
+// Expire gives up on losses detected before deadline and returns how many
+// packets that was.
+func (t *SeqTracker) Expire(deadline time.Time) int {
+	dropped := t.Losses.expire(deadline)
+	t.update()
+	return dropped
+}
+
+// ACKSeq is the sequence number to acknowledge: the first one missing.
+func (t *SeqTracker) ACKSeq() uint32 {
+	return seqno.Next(t.highestSeq)
+}
+
+func (t *SeqTracker) update() {
+	if len(t.Losses) > 0 {
+		t.highestSeq = seqno.Prev(t.Losses[0].From)
+		return
+	}
+	t.highestSeq = t.maxSeq
+}
@@ -0,0 +1,95 @@
+package live_test
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"coresrt/internal/live"
+	"coresrt/packets"
+)
+
+func TestPeriodicNAK(t *testing.T) {
+	tests := []struct {
+		name         string
+		rtt, rttVar  time.Duration
+		wantInterval time.Duration
+	}{
+		{"RTT-based", 100 * time.Millisecond, 50 * time.Millisecond, 150 * time.Millisecond},
+		{"at least 20ms", 10 * time.Millisecond, 2 * time.Millisecond, 20 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := live.NAKInterval(tt.rtt, tt.rttVar); got != tt.wantInterval {
+				t.Fatalf("NAKInterval(%v, %v) = %v, want %v", tt.rtt, tt.rttVar, got, tt.wantInterval)
+			}
+
+			start := time.Now()
+			seqs := live.NewSeqTracker(0)
+			gap, _ := seqs.Receive(5)
+			if gap == nil {
+				t.Fatal("no gap before 5")
+			}
+			seqs.AddLoss(*gap, start)
+			seqs.Losses.Report(*gap, start)
+			want := []packets.LossRange{{From: 0, To: 4}}
+
+			// re-reported once unanswered for the interval, then again
+			// an interval later
+			for _, at := range []time.Time{start.Add(tt.wantInterval), start.Add(2 * tt.wantInterval)} {
+				if got := seqs.Losses.Due(at.Add(-time.Microsecond), tt.rtt, tt.rttVar, 1500); got != nil {
+					t.Errorf("Due() %v early = %v", time.Microsecond, got)
+				}
+				if got := seqs.Losses.Due(at, tt.rtt, tt.rttVar, 1500); !slices.Equal(got, want) {
+					t.Errorf("Due() after %v = %v, want %v", at.Sub(start), got, want)
+				}
+			}
+
+			// answered
+			for s := range gap.All() {
+				seqs.Receive(s)
+			}
+			if got := seqs.Losses.Due(start.Add(time.Hour), tt.rtt, tt.rttVar, 1500); got != nil {
+				t.Errorf("Due() once received = %v", got)
+			}
+		})
+	}
+}
+
+func TestPeriodicNAKUnreported(t *testing.T) {
+	// a loss no NAK reported yet is left to the NAK reporting it
+	start := time.Now()
+	seqs := live.NewSeqTracker(0)
+	gap, _ := seqs.Receive(5)
+	seqs.AddLoss(*gap, start)
+	if got := seqs.Losses.Due(start.Add(time.Hour), 0, 0, 1500); got != nil {
+		t.Errorf("Due() = %v, want nothing", got)
+	}
+}
+
+func TestPeriodicNAKLimit(t *testing.T) {
+	const mtu = 200
+	limit := live.MaxNAKRanges(mtu)
+	if limit != packets.MaxPayloadSize(mtu)/8 {
+		t.Fatalf("MaxNAKRanges(%d) = %d", mtu, limit)
+	}
+
+	// every other packet lost
+	start := time.Now()
+	seqs := live.NewSeqTracker(0)
+	for s := uint32(1); s <= uint32(2*limit+10); s += 2 {
+		gap, _ := seqs.Receive(s)
+		seqs.AddLoss(*gap, start)
+		seqs.Losses.Report(*gap, start)
+	}
+	at := start.Add(time.Second)
+	first := seqs.Losses.Due(at, 0, 0, mtu)
+	if len(first) != limit || first[0].From != 0 {
+		t.Fatalf("Due() = %d ranges from %v, want %d from 0", len(first), first, limit)
+	}
+	// the rest waits for the next tick, not for an interval
+	rest := seqs.Losses.Due(at, 0, 0, mtu)
+	if len(rest) != 5 || rest[0].From != uint32(2*limit) {
+		t.Errorf("Due() next = %v, want the 5 ranges from %d", rest, 2*limit)
+	}
+}
@@ -0,0 +1,353 @@
+package live
+
+import (
+	"sort"
+	"time"
+
+	"coresrt/filter"
+	"coresrt/packets"
+	"coresrt/seqno"
+	"coresrt/stats"
+)
+
+const (
+	// minDropThreshold is the shortest time a packet is kept for
+	// retransmission, whatever the latency.
+	minDropThreshold = time.Second
+
+	// MaxFlowWindow caps the flow window a peer advertises, far beyond
+	// any real receive buffer, so that a bogus one does not leave the
+	// queue unbounded.
+	MaxFlowWindow = 1 << 20
+
+	// MaxPending is how many packets the flow window holds back before
+	// the queue is full, as many as libsrt buffers for sending by
+	// default.
+	MaxPending = 8192
+)
+
+type sentPacket struct {
+	pkt      *packets.Data
+	sentAt   time.Time // or written, while held back by the flow window
+	lastSent time.Time // last transmission, retransmissions included
+}
+
+// SendQueue holds the data packets a connection sends, from when they are
+// written until the peer acknowledges them or they are too late to be
+// delivered. It is not safe for concurrent use: the connection guards it
+// with its mutex.
+type SendQueue struct {
+	// Negotiated in the handshake, before anything is sent
+	Filter      filter.Filter // packet filter whose packets follow the data packets, if any
+	PeriodicNAK bool          // whether the peer reports its losses again itself
+
+	peer       uint32          // destination socket ID
+	counters   *stats.Counters // of the connection
+	buf        map[uint32]*sentPacket
+	pending    []*sentPacket   // written but held back by the flow window
+	room       chan struct{}   // signalled when pending shrinks
+	flowWindow int             // packets the peer is ready to take
+	probe      *packets.Data   // first packet of a probing pair, held back for the second
+	probeExtra []*packets.Data // its filter packets
+	probeHeld  time.Time       // when probe was held back
+	busySince  time.Time       // when buf last became non-empty
+}
+
+// NewSendQueue returns the queue of a connection to socket peer, which
+// takes up to flowWindow packets unacknowledged, at most MaxFlowWindow.
+// The packets sent, retransmitted and dropped are counted in counters.
+func NewSendQueue(peer uint32, flowWindow int, counters *stats.Counters) *SendQueue {
+	return &SendQueue{
+		peer:       peer,
+		counters:   counters,
+		buf:        make(map[uint32]*sentPacket),
+		room:       make(chan struct{}, 1),
+		flowWindow: min(flowWindow, MaxFlowWindow),
+	}
+}
+
+// Push queues a packet written at now and returns the packets to send:
+// none while the flow window holds it back, or the packet followed by its
+// filter packets. A packet already in the queue, as a group resends over
+// another link, is sent again as is. A packet the flow window would hold
+// back while the queue is full is dropped: writers wait for Room first.
+func (q *SendQueue) Push(pkt *packets.Data, now time.Time) []*packets.Data {
+	p := *pkt
+	p.DestinationSocketID = q.peer
+
+	var extra []*packets.Data
+	if _, ok := q.buf[p.PacketSequenceNumber]; !ok {
+		sp := &sentPacket{pkt: &p, sentAt: now}
+		if len(q.pending) > 0 || len(q.buf) >= q.flowWindow {
+			if q.Full() {
+				q.counters.PacketsDropped++
+				q.counters.BytesDropped += uint64(len(p.Data))
+				return nil
+			}
+			q.pending = append(q.pending, sp)
+			return nil
+		}
+		extra = q.store(sp, now)
+	}
+	return q.transmit(&p, extra, now)
+}
+
+// Ready returns the packets held back that now fit in the flow window,
+// followed by their filter packets.
+func (q *SendQueue) Ready(now time.Time) []*packets.Data {
+	var out []*packets.Data
+	for len(q.pending) > 0 && len(q.buf) < q.flowWindow {
+		sp := q.pending[0]
+		q.pending = q.pending[1:]
+		out = append(out, q.transmit(sp.pkt, q.store(sp, now), now)...)
+	}
+	if len(out) > 0 {
+		q.signalRoom()
+	}
+	return out
+}
+
+// Full reports whether the flow window holds back MaxPending packets, so
+// that writers wait for Room rather than have their packets dropped.
+func (q *SendQueue) Full() bool {
+	return len(q.pending) >= MaxPending
+}
+
+// Room returns a channel that receives once packets held back left the
+// queue, sent or dropped as too late, for a writer waiting for a full
+// queue to check Full again.
+func (q *SendQueue) Room() <-chan struct{} {
+	return q.room
+}
+
+func (q *SendQueue) signalRoom() {
+	select {
+	case q.room <- struct{}{}:
+	default:
+	}
+}
+
+// store puts a packet in the send buffer and returns its filter packets.
+func (q *SendQueue) store(sp *sentPacket, now time.Time) []*packets.Data {
+	sp.lastSent = now
+	if len(q.buf) == 0 {
+		q.busySince = now
+	}
+	q.buf[sp.pkt.PacketSequenceNumber] = sp
+	if q.Filter == nil {
+		return nil
+	}
+	extra := q.Filter.Send(sp.pkt)
+	for _, fp := range extra {
+		fp.DestinationSocketID = q.peer
+	}
+	return extra
+}
+
+// transmit counts a packet and its filter packets as sent and returns
+// them to send. The first packet of a probing pair is held back for the
+// next one, so that both leave back to back and the peer measures the
+// link capacity from their spacing.
+func (q *SendQueue) transmit(p *packets.Data, extra []*packets.Data, now time.Time) []*packets.Data {
+	q.counters.PacketsSent++
+	q.counters.BytesSent += uint64(len(p.Data))
+	for _, fp := range extra {
+		q.counters.PacketsSent++
+		q.counters.BytesSent += uint64(len(fp.Data))
+	}
+	probe, probeExtra := q.probe, q.probeExtra
+	q.probe, q.probeExtra = nil, nil
+	if probe == nil && stats.IsProbe(p.PacketSequenceNumber) {
+		q.probe, q.probeExtra, q.probeHeld = p, extra, now
+		return nil
+	}
+
+	// filter packets go after the pair, not between
+	var out []*packets.Data
+	if probe != nil {
+		out = append(out, probe)
+	}
+	out = append(out, p)
+	out = append(out, probeExtra...)
+	return append(out, extra...)
+}
+
+// FlushProbe returns the first packet of a probing pair, and its filter
+// packets, to send on their own once it waited at least wait for the
+// second.
+func (q *SendQueue) FlushProbe(now time.Time, wait time.Duration) []*packets.Data {
+	if q.probe == nil || now.Sub(q.probeHeld) < wait {
+		return nil
+	}
+	out := append([]*packets.Data{q.probe}, q.probeExtra...)
+	q.probe, q.probeExtra = nil, nil
+	return out
+}
+
+// Ack frees the packets before seq, which the peer received.
+func (q *SendQueue) Ack(seq uint32) {
+	for s := range q.buf {
+		if seqno.Less(s, seq) {
+			delete(q.buf, s)
+		}
+	}
+}
+
+// SetFlowWindow sets how many packets the peer takes unacknowledged, as
+// its full ACKs report, at most MaxFlowWindow.
+func (q *SendQueue) SetFlowWindow(n int) {
+	q.flowWindow = min(n, MaxFlowWindow)
+}
+
+// FlowWindow returns how many packets the peer takes unacknowledged.
+func (q *SendQueue) FlowWindow() int {
+	return q.flowWindow
+}
+
+// Lost returns the retransmissions of the packets of ranges still in the
+// queue, in order.
+func (q *SendQueue) Lost(ranges []packets.LossRange, now time.Time) []*packets.Data {
+	var resend []*packets.Data
+	for _, r := range ranges {
+		for _, s := range q.buffered(r) {
+			resend = append(resend, q.Retransmit(q.buf[s].pkt, now))
+		}
+	}
+	return resend
+}
+
+// buffered returns the sequence numbers of r that are in the queue, in
+// order.
+func (q *SendQueue) buffered(r packets.LossRange) []uint32 {
+	var seqs []uint32
+	if r.Len() <= len(q.buf) {
+		for s := range r.All() {
+			if _, ok := q.buf[s]; ok {
+				seqs = append(seqs, s)
+			}
+		}
+		return seqs
+	}
+
+	for s := range q.buf {
+		if r.Contains(s) {
+			seqs = append(seqs, s)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqno.Less(seqs[i], seqs[j]) })
+	return seqs
+}
+
+// Retransmit counts pkt as sent again at now and returns the copy to send,
+// with the retransmitted flag set. The packet may come from the queue of
+// another link of a group.
+func (q *SendQueue) Retransmit(pkt *packets.Data, now time.Time) *packets.Data {
+	p := *pkt
+	p.DestinationSocketID = q.peer
+	p.RetransmittedPacketFlag = 1
+
+	if sp, ok := q.buf[p.PacketSequenceNumber]; ok {
+		sp.lastSent = now
+	}
+	q.counters.PacketsSent++
+	q.counters.BytesSent += uint64(len(p.Data))
+	q.counters.PacketsRetransmitted++
+	q.counters.BytesRetransmitted += uint64(len(p.Data))
+	return &p
+}
+
+// Unacknowledged returns the retransmission of the first packet the peer
+// has not acknowledged once it went unacknowledged for RTT+4·RTTVar plus
+// tick, the period of the caller's timer, since it was last sent: the NAK
+// reporting it, or the retransmission it asked for, may have been lost. A
+// peer sending periodic NAKs reports such losses again itself, so nothing
+// is returned for it.
+func (q *SendQueue) Unacknowledged(now time.Time, rtt, rttVar, tick time.Duration) *packets.Data {
+	if q.PeriodicNAK || len(q.buf) == 0 {
+		return nil
+	}
+	var first *sentPacket
+	for s, sp := range q.buf {
+		if first == nil || seqno.Less(s, first.pkt.PacketSequenceNumber) {
+			first = sp
+		}
+	}
+	if now.Sub(first.lastSent) < rtt+4*rttVar+tick {
+		return nil
+	}
+	return q.Retransmit(first.pkt, now)
+}
+
+// DropTooLate forgets the packets sent or held back that can no longer be
+// delivered in time with the latency of the peer, so they are neither
+// retransmitted nor sent.
+func (q *SendQueue) DropTooLate(now time.Time, latency time.Duration) {
+	threshold := DropThreshold(latency)
+	for s, sp := range q.buf {
+		if now.Sub(sp.sentAt) > threshold {
+			delete(q.buf, s)
+			q.counters.PacketsDropped++
+			q.counters.BytesDropped += uint64(len(sp.pkt.Data))
+		}
+	}
+	held := len(q.pending)
+	for len(q.pending) > 0 && now.Sub(q.pending[0].sentAt) > threshold {
+		q.counters.PacketsDropped++
+		q.counters.BytesDropped += uint64(len(q.pending[0].pkt.Data))
+		q.pending = q.pending[1:]
+	}
+	if len(q.pending) < held {
+		q.signalRoom()
+	}
+}
+
+// DropThreshold is how long a packet is kept for retransmission with the
+// latency of the peer.
+func DropThreshold(latency time.Duration) time.Duration {
+	return max(latency*5/4, minDropThreshold)
+}
+
+// InFlight returns the packets sent but not yet acknowledged, in order.
+func (q *SendQueue) InFlight() []*packets.Data {
+	pkts := make([]*packets.Data, 0, len(q.buf))
+	for _, sp := range q.buf {
+		pkts = append(pkts, sp.pkt)
+	}
+	sort.Slice(pkts, func(i, j int) bool {
+		return seqno.Less(pkts[i].PacketSequenceNumber, pkts[j].PacketSequenceNumber)
+	})
+	return pkts
+}
+
+// BusySince returns since when packets have been waiting for an ACK, or
+// the zero time if none is.
+func (q *SendQueue) BusySince() time.Time {
+	if len(q.buf) == 0 {
+		return time.Time{}
+	}
+	return q.busySince
+}
+
+// Occupancy returns how much was written but not acknowledged.
+func (q *SendQueue) Occupancy() stats.Buffer {
+	var o stats.Buffer
+	var first, last time.Time
+	add := func(sp *sentPacket) {
+		o.Packets++
+		o.Bytes += len(sp.pkt.Data)
+		if first.IsZero() || sp.sentAt.Before(first) {
+			first = sp.sentAt
+		}
+		if sp.sentAt.After(last) {
+			last = sp.sentAt
+		}
+	}
+	for _, sp := range q.buf {
+		add(sp)
+	}
+	for _, sp := range q.pending {
+		add(sp)
+	}
+	o.Span = last.Sub(first)
+	return o
+}
@@ -0,0 +1,137 @@
+package live_test
+
+import (
+	"testing"
+	"time"
+
+	"coresrt/internal/live"
+	"coresrt/packets"
+	"coresrt/stats"
+)
+
+func TestUnacknowledged(t *testing.T) {
+	const (
+		rtt    = 100 * time.Millisecond
+		rttVar = 50 * time.Millisecond
+		tick   = 10 * time.Millisecond
+		rto    = rtt + 4*rttVar + tick
+	)
+	tests := []struct {
+		name        string
+		periodicNAK bool
+		retransmit  bool
+	}{
+		{"peer without periodic NAKs", false, true},
+		{"peer with periodic NAKs", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var counters stats.Counters
+			q := live.NewSendQueue(7, 100, &counters)
+			q.PeriodicNAK = tt.periodicNAK
+
+			start := time.Now()
+			for seq := uint32(1); seq <= 3; seq++ {
+				if out := q.Push(&packets.Data{PacketSequenceNumber: seq, Data: []byte("x")}, start); len(out) != 1 {
+					t.Fatalf("Push(%d) = %d packets", seq, len(out))
+				}
+			}
+			q.Ack(2)
+
+			if p := q.Unacknowledged(start.Add(rto-time.Microsecond), rtt, rttVar, tick); p != nil {
+				t.Fatalf("retransmitted %d early", p.PacketSequenceNumber)
+			}
+			p := q.Unacknowledged(start.Add(rto), rtt, rttVar, tick)
+			if !tt.retransmit {
+				if p != nil {
+					t.Fatalf("retransmitted %d", p.PacketSequenceNumber)
+				}
+				return
+			}
+			if p == nil {
+				t.Fatal("not retransmitted")
+			}
+			if p.PacketSequenceNumber != 2 || p.RetransmittedPacketFlag != 1 || p.DestinationSocketID != 7 {
+				t.Errorf("retransmitted %+v, want packet 2 flagged to socket 7", p)
+			}
+			if counters.PacketsRetransmitted != 1 {
+				t.Errorf("PacketsRetransmitted = %d", counters.PacketsRetransmitted)
+			}
+
+			// the timeout starts again from the retransmission
+			if p := q.Unacknowledged(start.Add(2*rto-time.Microsecond), rtt, rttVar, tick); p != nil {
+				t.Errorf("retransmitted %d again early", p.PacketSequenceNumber)
+			}
+			if p := q.Unacknowledged(start.Add(2*rto), rtt, rttVar, tick); p == nil || p.PacketSequenceNumber != 2 {
+				t.Errorf("retransmitted %v again, want packet 2", p)
+			}
+
+			q.Ack(4)
+			if p := q.Unacknowledged(start.Add(time.Hour), rtt, rttVar, tick); p != nil {
+				t.Errorf("retransmitted %d once acknowledged", p.PacketSequenceNumber)
+			}
+		})
+	}
+}
+
+func TestFlowWindowCap(t *testing.T) {
+	var counters stats.Counters
+	q := live.NewSendQueue(7, 1<<31-1, &counters)
+	if got := q.FlowWindow(); got != live.MaxFlowWindow {
+		t.Errorf("flow window %d from the handshake, want %d", got, live.MaxFlowWindow)
+	}
+	q.SetFlowWindow(1<<32 - 1)
+	if got := q.FlowWindow(); got != live.MaxFlowWindow {
+		t.Errorf("flow window %d from an ACK, want %d", got, live.MaxFlowWindow)
+	}
+	q.SetFlowWindow(0)
+	if got := q.FlowWindow(); got != 0 {
+		t.Errorf("flow window %d from an ACK of a full buffer, want 0", got)
+	}
+}
+
+func TestPendingCap(t *testing.T) {
+	var counters stats.Counters
+	q := live.NewSendQueue(7, 1, &counters)
+	now := time.Now()
+	push := func(seq uint32) []*packets.Data {
+		return q.Push(&packets.Data{PacketSequenceNumber: seq, Data: []byte{1}}, now)
+	}
+
+	// sequence numbers clear of the probing pairs, which are held back
+	if out := push(1); len(out) != 1 {
+		t.Fatalf("first packet: %d sent, want 1", len(out))
+	}
+	for i := range live.MaxPending {
+		if q.Full() {
+			t.Fatalf("full after %d packets held back", i)
+		}
+		push(uint32(2 + 16*i))
+	}
+	if !q.Full() {
+		t.Fatalf("not full with %d packets held back", live.MaxPending)
+	}
+	push(1 << 20)
+	if counters.PacketsDropped != 1 || q.Occupancy().Packets != 1+live.MaxPending {
+		t.Errorf("%d dropped and %d queued pushing to a full queue, want 1 and %d",
+			counters.PacketsDropped, q.Occupancy().Packets, 1+live.MaxPending)
+	}
+	select {
+	case <-q.Room():
+		t.Error("room signalled before anything left")
+	default:
+	}
+
+	q.Ack(2)
+	if out := q.Ready(now); len(out) != 1 {
+		t.Fatalf("%d sent after an ACK, want 1", len(out))
+	}
+	select {
+	case <-q.Room():
+	default:
+		t.Error("room not signalled")
+	}
+	if q.Full() {
+		t.Error("still full once a packet left")
+	}
+}
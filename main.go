@@ -2,20 +2,122 @@ package main
 
 import (
 	"flag"
-	"log"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
 
+	"coresrt/packets"
 	"coresrt/receiver"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "dump":
+			runDump(os.Args[2:])
+			return
+		case "replay":
+			runReplay(os.Args[2:])
+			return
+		}
+	}
+	os.Exit(runReceiver())
+}
+
+// runReceiver serves SRT callers as the flags say and returns the exit
+// status, once the deferred closes of the output files ran.
+func runReceiver() int {
 	port := flag.Int("port", 9999, "UDP port to listen on")
 	addr := flag.String("addr", "0.0.0.0", "IP address to bind to")
+	latency := flag.Duration("latency", 120*time.Millisecond, "receiver TSBPD latency")
+	out := flag.String("out", "", "file to write received payloads to, - for stdout")
+	packetFilter := flag.String("filter", "", "packet filter configuration, e.g. xorfec,cols:10,rows:5")
+	metricsAddr := flag.String("metrics", "", "address of the HTTP endpoint exporting Prometheus metrics, e.g. :9100")
+	logLevel := flag.String("loglevel", "info", "log level: trace, debug, info, warn or error")
+	dumpSample := flag.Int("dumpsample", 0, "log a hex dump of one datagram in this many at debug level")
+	maxConns := flag.Int("maxconns", 0, "reject callers beyond this many connections, no limit if 0")
+	recordFile := flag.String("record", "", "file to record the received datagrams to, for the replay command")
+	minVersion := flag.String("minversion", "", "reject callers of an older SRT version, e.g. 1.4.0")
+	mtu := flag.Int("mtu", 1500, "largest IP packet exchanged with callers, e.g. 9000 on jumbo frame links")
+	rcvBuf := flag.Int("rcvbuf", 8192, "packets each connection holds until delivery, the flow window of callers")
 	flag.Parse()
 
-	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
-	log.Printf("starting SRT receiver on %s:%d", *addr, *port)
+	level, err := parseLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.LevelKey && a.Value.Any().(slog.Level) == receiver.LevelTrace {
+				a.Value = slog.StringValue("TRACE")
+			}
+			return a
+		},
+	}))
+	var minPeerVersion packets.Version
+	if *minVersion != "" {
+		if minPeerVersion, err = packets.ParseVersion(*minVersion); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	slog.SetDefault(logger)
+	logger.Info("starting SRT receiver", "addr", *addr, "port", *port)
+
+	opts := receiver.Options{
+		Latency:        *latency,
+		PacketFilter:   *packetFilter,
+		MetricsAddr:    *metricsAddr,
+		Logger:         logger,
+		DumpSample:     *dumpSample,
+		MaxConnections: *maxConns,
+		MinPeerVersion: minPeerVersion,
+		MTU:            *mtu,
+		ReceiveBuffer:  *rcvBuf,
+	}
 
-	opts := receiver.Options{}
+	switch *out {
+	case "":
+	case "-":
+		opts.Output = os.Stdout
+	default:
+		f, err := os.Create(*out)
+		if err != nil {
+			logger.Error("error creating output file", "err", err)
+			return 1
+		}
+		defer f.Close()
+		opts.Output = f
+	}
+
+	if *recordFile != "" {
+		f, err := os.Create(*recordFile)
+		if err != nil {
+			logger.Error("error creating record file", "err", err)
+			return 1
+		}
+		defer f.Close()
+		opts.Record = f
+	}
+
+	if err := receiver.Start(*port, *addr, opts); err != nil {
+		logger.Error("error serving SRT", "err", err)
+		return 1
+	}
+	return 0
+}
 
-	receiver.Start(*port, *addr, opts)
+func parseLevel(s string) (slog.Level, error) {
+	if strings.EqualFold(s, "trace") {
+		return receiver.LevelTrace, nil
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q", s)
+	}
+	return level, nil
 }
@@ -0,0 +1,253 @@
+// Package mux shares one UDP socket between many SRT sockets.
+//
+// As per section 4.1 of the specification, every SRT packet carries the
+// Destination Socket ID of the socket it is meant for, so the datagrams
+// arriving on a UDP port are dispatched on that field rather than on the
+// remote address. A connection request, whose destination is not known
+// yet, carries 0 and goes to the listener, if any.
+//
+// The socket may be any transport.PacketConn rather than a UDP socket.
+package mux
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"coresrt/packets"
+	"coresrt/transport"
+)
+
+const (
+	// maxDatagramSize is the largest UDP payload, so that datagrams are
+	// never truncated: each socket drops what exceeds the MTU it
+	// negotiated.
+	maxDatagramSize = 65535
+
+	// readRetry is the wait after a read error, doubled on each error in a
+	// row, so that a failing socket does not spin the read loop.
+	readRetry = time.Millisecond
+
+	// maxReadErrors is how many read errors in a row close the
+	// multiplexer, as the socket is unlikely to recover.
+	maxReadErrors = 10
+
+	// GroupIDMask is the bit that distinguishes group IDs from socket IDs.
+	GroupIDMask = 0x40000000
+)
+
+// ErrClosed is returned when using a closed multiplexer.
+var ErrClosed = errors.New("multiplexer closed")
+
+// Handler is given each datagram addressed to a socket, which it may
+// keep. Handlers run on the read loop of the multiplexer, one at a time,
+// and must not block.
+type Handler func(data []byte, addr *net.UDPAddr)
+
+// Mux dispatches the datagrams received on a UDP socket by destination
+// socket ID, and sends the datagrams of all its sockets.
+type Mux struct {
+	conn transport.PacketConn
+	log  *slog.Logger
+
+	mu       sync.Mutex
+	sockets  map[uint32]Handler // key: socket ID
+	listener Handler            // destination socket ID 0
+	tap      Handler            // every datagram, before routing
+	closed   bool
+	done     chan struct{}
+}
+
+// Listen opens a UDP socket on addr, or on any free port if addr is nil,
+// and starts multiplexing it.
+func Listen(addr *net.UDPAddr, logger *slog.Logger) (*Mux, error) {
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return New(conn, logger), nil
+}
+
+// New starts multiplexing conn, which is closed with the multiplexer.
+// Errors reading conn are logged to logger, slog.Default() if nil, and
+// retried after a growing wait; the multiplexer closes itself after
+// maxReadErrors in a row.
+func New(conn transport.PacketConn, logger *slog.Logger) *Mux {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	m := &Mux{
+		conn:    conn,
+		log:     logger,
+		sockets: make(map[uint32]Handler),
+		done:    make(chan struct{}),
+	}
+	go m.readLoop()
+	return m
+}
+
+// Listen sets the handler of the datagrams with destination socket ID 0,
+// which are connection requests. There can only be one listener.
+func (m *Mux) Listen(h Handler) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case m.closed:
+		return ErrClosed
+	case m.listener != nil:
+		return errors.New("multiplexer already has a listener")
+	}
+	m.listener = h
+	return nil
+}
+
+// Tap sets a handler given every datagram read, before it is routed, so
+// that what is dropped as too short or for an unknown socket is seen too,
+// such as to record the traffic. Unlike the other handlers, it must not
+// keep the datagram.
+func (m *Mux) Tap(h Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tap = h
+}
+
+// Register allocates a socket ID that is not in use and routes the
+// datagrams sent to it to h.
+func (m *Mux) Register(h Handler) (uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return 0, ErrClosed
+	}
+	for {
+		id := newSocketID()
+		if _, ok := m.sockets[id]; !ok {
+			m.sockets[id] = h
+			return id, nil
+		}
+	}
+}
+
+// Unregister releases a socket ID.
+func (m *Mux) Unregister(id uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sockets, id)
+}
+
+// WriteTo sends a datagram.
+func (m *Mux) WriteTo(b []byte, addr *net.UDPAddr) error {
+	_, err := m.conn.WriteTo(b, addr)
+	return err
+}
+
+// LocalAddr returns the address of the UDP socket, nil if the transport
+// has no UDP address.
+func (m *Mux) LocalAddr() *net.UDPAddr {
+	addr, err := transport.UDPAddr(m.conn.LocalAddr())
+	if err != nil {
+		return nil
+	}
+	return addr
+}
+
+// Done is closed when the multiplexer is closed.
+func (m *Mux) Done() <-chan struct{} {
+	return m.done
+}
+
+// Close closes the UDP socket. Sockets still registered stop receiving.
+func (m *Mux) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	close(m.done)
+	m.mu.Unlock()
+	return m.conn.Close()
+}
+
+func (m *Mux) readLoop() {
+	buf := make([]byte, maxDatagramSize)
+	failures := 0
+	for {
+		n, from, err := m.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-m.done:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				m.Close()
+				return
+			}
+			if failures++; failures == maxReadErrors {
+				m.log.Error("closing after repeated read errors", "count", failures, "err", err)
+				m.Close()
+				return
+			}
+			wait := readRetry << (failures - 1)
+			m.log.Error("error reading datagram", "err", err, "retry_in", wait)
+			select {
+			case <-m.done:
+				return
+			case <-time.After(wait):
+			}
+			continue
+		}
+		failures = 0
+		addr, err := transport.UDPAddr(from)
+		if err != nil {
+			m.log.Debug("datagram from an unsupported address", "peer", from, "err", err)
+			continue
+		}
+
+		m.mu.Lock()
+		tap := m.tap
+		m.mu.Unlock()
+		if tap != nil {
+			tap(buf[:n], addr)
+		}
+		if n < packets.MinPacketSize {
+			continue
+		}
+
+		dst := binary.BigEndian.Uint32(buf[12:16])
+		m.mu.Lock()
+		h := m.listener
+		if dst != 0 {
+			h = m.sockets[dst]
+		}
+		m.mu.Unlock()
+		if h == nil {
+			continue
+		}
+
+		// copy packet so the handler may keep it
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		h(data, addr)
+	}
+}
+
+// NewGroupID returns a random ID for a socket group. Group IDs are not
+// registered: the packets of a group go to the sockets of its members.
+func NewGroupID() uint32 {
+	return newSocketID() | GroupIDMask
+}
+
+func newSocketID() uint32 {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	// keep clear of the group ID bit and of the reserved value 0
+	return binary.BigEndian.Uint32(b[:])&^(1<<31|GroupIDMask) | 1
+}
@@ -0,0 +1,220 @@
+package mux_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"coresrt/mux"
+	"coresrt/transport"
+)
+
+var discard = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+type datagram struct {
+	dst  uint32
+	from *net.UDPAddr
+}
+
+// packet returns a minimal datagram for socket dst.
+func packet(dst uint32) []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint32(b[12:16], dst)
+	return b
+}
+
+// handler returns a Handler recording the datagrams it is given.
+func handler() (mux.Handler, <-chan datagram) {
+	ch := make(chan datagram, 16)
+	return func(data []byte, addr *net.UDPAddr) {
+		ch <- datagram{binary.BigEndian.Uint32(data[12:16]), addr}
+	}, ch
+}
+
+func expect(t *testing.T, ch <-chan datagram, dst uint32, from net.Addr) {
+	t.Helper()
+	select {
+	case d := <-ch:
+		if d.dst != dst || d.from.String() != from.String() {
+			t.Errorf("datagram for %08x from %s, want %08x from %s", d.dst, d.from, dst, from)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no datagram for %08x", dst)
+	}
+}
+
+func expectNone(t *testing.T, ch <-chan datagram) {
+	t.Helper()
+	select {
+	case d := <-ch:
+		t.Errorf("unexpected datagram for %08x", d.dst)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDispatchOverPipe(t *testing.T) {
+	a, b := transport.Pipe()
+	ma, mb := mux.New(a, nil), mux.New(b, nil)
+	defer ma.Close()
+	defer mb.Close()
+
+	if got := ma.LocalAddr(); got == nil || got.String() != a.LocalAddr().String() {
+		t.Fatalf("LocalAddr %v, want %s", got, a.LocalAddr())
+	}
+
+	listen, requests := handler()
+	if err := ma.Listen(listen); err != nil {
+		t.Fatal(err)
+	}
+	if err := ma.Listen(listen); err == nil {
+		t.Error("second listener accepted")
+	}
+	h1, sock1 := handler()
+	id1, err := ma.Register(h1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, sock2 := handler()
+	id2, err := ma.Register(h2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id1 == id2 || id1 == 0 || id1&mux.GroupIDMask != 0 {
+		t.Fatalf("socket IDs %08x and %08x", id1, id2)
+	}
+
+	for _, dst := range []uint32{0, id1, id2} {
+		if err := mb.WriteTo(packet(dst), ma.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect(t, requests, 0, b.LocalAddr())
+	expect(t, sock1, id1, b.LocalAddr())
+	expect(t, sock2, id2, b.LocalAddr())
+
+	// unknown sockets and runt datagrams are dropped
+	ma.Unregister(id2)
+	mb.WriteTo(packet(id2), ma.LocalAddr())
+	mb.WriteTo(packet(id1)[:15], ma.LocalAddr())
+	expectNone(t, sock1)
+	expectNone(t, sock2)
+
+	// and the read loop goes on
+	mb.WriteTo(packet(id1), ma.LocalAddr())
+	expect(t, sock1, id1, b.LocalAddr())
+}
+
+func TestTap(t *testing.T) {
+	a, b := transport.Pipe()
+	ma, mb := mux.New(a, nil), mux.New(b, nil)
+	defer ma.Close()
+	defer mb.Close()
+
+	lengths := make(chan int, 16)
+	ma.Tap(func(data []byte, addr *net.UDPAddr) {
+		if addr.String() != b.LocalAddr().String() {
+			t.Errorf("tapped datagram from %s, want %s", addr, b.LocalAddr())
+		}
+		lengths <- len(data)
+	})
+	h, sock := handler()
+	id, err := ma.Register(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the tap sees what is routed and what is dropped alike
+	mb.WriteTo(packet(id), ma.LocalAddr())
+	mb.WriteTo(packet(id^1), ma.LocalAddr())
+	mb.WriteTo(packet(id)[:4], ma.LocalAddr())
+	for _, want := range []int{16, 16, 4} {
+		select {
+		case n := <-lengths:
+			if n != want {
+				t.Errorf("tapped %d bytes, want %d", n, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no tapped datagram of %d bytes", want)
+		}
+	}
+	expect(t, sock, id, b.LocalAddr())
+	expectNone(t, sock)
+}
+
+func TestClosedTransport(t *testing.T) {
+	a, b := transport.Pipe()
+	defer b.Close()
+	m := mux.New(a, nil)
+
+	// the read loop closes the multiplexer once the transport is closed
+	a.Close()
+	select {
+	case <-m.Done():
+	case <-time.After(time.Second):
+		t.Fatal("multiplexer still open after its transport closed")
+	}
+	h, _ := handler()
+	if _, err := m.Register(h); err != mux.ErrClosed {
+		t.Errorf("Register: %v, want ErrClosed", err)
+	}
+	if err := m.Listen(h); err != mux.ErrClosed {
+		t.Errorf("Listen: %v, want ErrClosed", err)
+	}
+}
+
+// failingConn is a transport whose reads fail, the first fail of them
+// or all if fail is negative, and then wait for Close.
+type failingConn struct {
+	transport.PacketConn
+	fail   int32
+	reads  atomic.Int32
+	closed chan struct{}
+}
+
+func (c *failingConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	if n := c.reads.Add(1); c.fail < 0 || n <= c.fail {
+		return 0, nil, errors.New("transient failure")
+	}
+	<-c.closed
+	return 0, nil, net.ErrClosed
+}
+
+func (c *failingConn) Close() error {
+	close(c.closed)
+	return c.PacketConn.Close()
+}
+
+func TestReadErrors(t *testing.T) {
+	// a few errors are retried
+	a, _ := transport.Pipe()
+	conn := &failingConn{PacketConn: a, fail: 3, closed: make(chan struct{})}
+	m := mux.New(conn, discard)
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-m.Done():
+		t.Fatal("multiplexer closed after a few read errors")
+	default:
+	}
+	if n := conn.reads.Load(); n != 4 {
+		t.Errorf("%d reads, want 4", n)
+	}
+	m.Close()
+
+	// while errors in a row close the multiplexer rather than spin
+	a, _ = transport.Pipe()
+	conn = &failingConn{PacketConn: a, fail: -1, closed: make(chan struct{})}
+	m = mux.New(conn, discard)
+	select {
+	case <-m.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("multiplexer still open after repeated read errors")
+	}
+	if n := conn.reads.Load(); n != 10 {
+		t.Errorf("%d reads before closing, want 10", n)
+	}
+}
@@ -0,0 +1,266 @@
+// Package netsim impairs the datagrams sent over a net.PacketConn, the way
+// a bad network would: loss, random or in bursts, delay, jitter,
+// reordering, duplication and a bandwidth cap.
+//
+// All random decisions come from a generator seeded by Config.Seed, so the
+// same datagrams sent in the same order meet the same fate on every run,
+// which makes loss recovery and TSBPD testable on CI.
+package netsim
+
+import (
+	"container/heap"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultQueueDelay is how long datagrams may wait for a capped link
+// before being dropped, when Config.QueueDelay is zero.
+const defaultQueueDelay = 100 * time.Millisecond
+
+// Config describes the impairments of the datagrams sent.
+type Config struct {
+	Seed uint64 // of the random generator
+
+	Loss  float64         // probability of losing each datagram independently
+	Burst *GilbertElliott // bursty loss, instead of Loss, if set
+
+	Delay  time.Duration // added to every datagram
+	Jitter time.Duration // random extra delay up to this, keeping the order of the datagrams
+
+	Reorder      float64       // probability of holding a datagram back so that later ones overtake it
+	ReorderDelay time.Duration // how long a reordered datagram is held back, Delay+Jitter if zero
+
+	Duplicate float64 // probability of sending a datagram twice
+
+	Bandwidth  int           // link rate in bits per second, unlimited if zero
+	QueueDelay time.Duration // datagrams that would wait longer for the link are dropped, 100ms if zero
+}
+
+// GilbertElliott is the two-state Markov model of bursty loss: the link
+// is either good or bad, with a loss probability of its own in each
+// state, and may change state before each datagram.
+type GilbertElliott struct {
+	GoodToBad float64 // probability of going from good to bad
+	BadToGood float64 // probability of going from bad to good
+	LossGood  float64 // loss probability in the good state, usually 0
+	LossBad   float64 // loss probability in the bad state, usually 1
+}
+
+// Stats counts the fates of the datagrams sent.
+type Stats struct {
+	Sent       int // datagrams written to the conn
+	Lost       int // by the loss model
+	Dropped    int // as the link queue was full
+	Duplicated int
+	Reordered  int
+	Delivered  int // datagrams sent over the underlying conn, duplicates included
+}
+
+// Conn is a net.PacketConn that impairs the datagrams it sends before
+// passing them to the underlying conn. Reads are not impaired: impair
+// both ends of a link for both directions.
+type Conn struct {
+	net.PacketConn
+	cfg Config
+
+	mu       sync.Mutex
+	rng      *rand.Rand
+	bad      bool      // state of the Gilbert-Elliott model
+	linkFree time.Time // when the capped link is done sending what is queued
+	last     time.Time // delivery time of the latest datagram not reordered
+	queue    deliveryQueue
+	seq      uint64 // order of the datagrams with the same delivery time
+	stats    Stats
+	closed   bool
+	wake     chan struct{}
+	done     chan struct{}
+}
+
+// New impairs the datagrams sent over conn, which is closed with the
+// returned Conn.
+func New(conn net.PacketConn, cfg Config) *Conn {
+	if cfg.QueueDelay == 0 {
+		cfg.QueueDelay = defaultQueueDelay
+	}
+	if cfg.ReorderDelay == 0 {
+		cfg.ReorderDelay = cfg.Delay + cfg.Jitter
+	}
+	c := &Conn{
+		PacketConn: conn,
+		cfg:        cfg,
+		rng:        rand.New(rand.NewPCG(cfg.Seed, cfg.Seed^0x9E3779B97F4A7C15)),
+		wake:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	go c.deliverLoop()
+	return c
+}
+
+// WriteTo impairs a datagram and schedules its delivery. A datagram lost
+// or dropped is reported as written, as it would be on a real network.
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	c.stats.Sent++
+
+	if c.lose() {
+		c.stats.Lost++
+		return len(b), nil
+	}
+
+	now := time.Now()
+	at := now
+	if c.cfg.Bandwidth > 0 {
+		if c.linkFree.Before(now) {
+			c.linkFree = now
+		}
+		if c.linkFree.Sub(now) > c.cfg.QueueDelay {
+			c.stats.Dropped++
+			return len(b), nil
+		}
+		c.linkFree = c.linkFree.Add(time.Duration(len(b)) * 8 * time.Second / time.Duration(c.cfg.Bandwidth))
+		at = c.linkFree
+	}
+	at = at.Add(c.cfg.Delay)
+
+	data := append([]byte(nil), b...)
+	c.schedule(c.delay(at), data, addr)
+	if c.chance(c.cfg.Duplicate) {
+		c.stats.Duplicated++
+		c.schedule(c.delay(at), data, addr)
+	}
+	return len(b), nil
+}
+
+// lose runs the loss model for one datagram.
+func (c *Conn) lose() bool {
+	ge := c.cfg.Burst
+	if ge == nil {
+		return c.chance(c.cfg.Loss)
+	}
+	if c.bad {
+		c.bad = !c.chance(ge.BadToGood)
+	} else {
+		c.bad = c.chance(ge.GoodToBad)
+	}
+	if c.bad {
+		return c.chance(ge.LossBad)
+	}
+	return c.chance(ge.LossGood)
+}
+
+// delay adds jitter and reordering to the delivery time at.
+func (c *Conn) delay(at time.Time) time.Time {
+	if c.cfg.Jitter > 0 {
+		at = at.Add(time.Duration(c.rng.Int64N(int64(c.cfg.Jitter))))
+	}
+	if c.chance(c.cfg.Reorder) {
+		c.stats.Reordered++
+		return at.Add(c.cfg.ReorderDelay)
+	}
+	// jitter alone does not reorder
+	if at.Before(c.last) {
+		at = c.last
+	}
+	c.last = at
+	return at
+}
+
+// chance returns true with probability p.
+func (c *Conn) chance(p float64) bool {
+	return p > 0 && c.rng.Float64() < p
+}
+
+func (c *Conn) schedule(at time.Time, data []byte, addr net.Addr) {
+	c.seq++
+	heap.Push(&c.queue, delivery{at: at, seq: c.seq, data: data, addr: addr})
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Stats returns what became of the datagrams sent so far.
+func (c *Conn) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// Close discards the datagrams not delivered yet and closes the
+// underlying conn.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	c.mu.Unlock()
+	return c.PacketConn.Close()
+}
+
+func (c *Conn) deliverLoop() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		c.mu.Lock()
+		var due []delivery
+		now := time.Now()
+		for len(c.queue) > 0 && !c.queue[0].at.After(now) {
+			due = append(due, heap.Pop(&c.queue).(delivery))
+		}
+		wait := time.Hour
+		if len(c.queue) > 0 {
+			wait = c.queue[0].at.Sub(now)
+		}
+		c.stats.Delivered += len(due)
+		c.mu.Unlock()
+
+		for _, d := range due {
+			// errors are those of a network losing the datagram
+			c.PacketConn.WriteTo(d.data, d.addr)
+		}
+
+		timer.Reset(wait)
+		select {
+		case <-c.done:
+			return
+		case <-c.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+type delivery struct {
+	at   time.Time
+	seq  uint64
+	data []byte
+	addr net.Addr
+}
+
+// deliveryQueue is a heap of datagrams by delivery time.
+type deliveryQueue []delivery
+
+func (q deliveryQueue) Len() int { return len(q) }
+func (q deliveryQueue) Less(i, j int) bool {
+	if q[i].at.Equal(q[j].at) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].at.Before(q[j].at)
+}
+func (q deliveryQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *deliveryQueue) Push(x any)   { *q = append(*q, x.(delivery)) }
+func (q *deliveryQueue) Pop() any {
+	old := *q
+	d := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return d
+}
@@ -0,0 +1,666 @@
+package netsim_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"coresrt/mux"
+	"coresrt/netsim"
+	"coresrt/packets"
+	"coresrt/receiver"
+	"coresrt/sender"
+	"coresrt/state"
+	"coresrt/stats"
+	"coresrt/transport"
+)
+
+// discard is the logger of the connections under test.
+var discard = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// link impairs the datagrams sent from one end of a pipe to the other.
+func link(t *testing.T, cfg netsim.Config) (*netsim.Conn, net.PacketConn) {
+	t.Helper()
+	a, b := transport.Pipe()
+	c := netsim.New(a, cfg)
+	t.Cleanup(func() {
+		c.Close()
+		b.Close()
+	})
+	return c, b
+}
+
+// send writes n datagrams numbered from 0, pausing now and then for the
+// reader to keep the pipe from overflowing.
+func send(t *testing.T, c *netsim.Conn, to net.PacketConn, n int) {
+	t.Helper()
+	for i := range n {
+		if i%500 == 499 {
+			time.Sleep(5 * time.Millisecond)
+		}
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(i))
+		if _, err := c.WriteTo(b[:], to.LocalAddr()); err != nil {
+			t.Fatalf("WriteTo: %v", err)
+		}
+	}
+}
+
+// receive returns the numbers of the datagrams arriving at conn until none
+// came for quiet.
+func receive(conn net.PacketConn, quiet time.Duration) []uint32 {
+	var got []uint32
+	b := make([]byte, 64)
+	for {
+		conn.(interface{ SetReadDeadline(time.Time) error }).SetReadDeadline(time.Now().Add(quiet))
+		n, _, err := conn.ReadFrom(b)
+		if err != nil {
+			return got
+		}
+		got = append(got, binary.BigEndian.Uint32(b[:n]))
+	}
+}
+
+func TestDeterminism(t *testing.T) {
+	cfg := netsim.Config{
+		Seed:         42,
+		Loss:         0.1,
+		Reorder:      0.1,
+		ReorderDelay: 100 * time.Millisecond, // far beyond the time taken to send
+		Duplicate:    0.05,
+	}
+	run := func() ([]uint32, netsim.Stats) {
+		c, to := link(t, cfg)
+		var got []uint32
+		done := make(chan struct{})
+		go func() {
+			got = receive(to, 300*time.Millisecond)
+			close(done)
+		}()
+		send(t, c, to, 500)
+		<-done
+		return got, c.Stats()
+	}
+
+	got1, stats1 := run()
+	got2, stats2 := run()
+	if stats1 != stats2 {
+		t.Errorf("stats differ for the same seed: %+v and %+v", stats1, stats2)
+	}
+	if !equal(got1, got2) {
+		t.Errorf("delivery order differs for the same seed:\n%v\n%v", got1, got2)
+	}
+	if stats1.Lost == 0 || stats1.Reordered == 0 || stats1.Duplicated == 0 {
+		t.Errorf("impairments not applied: %+v", stats1)
+	}
+}
+
+func equal(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestGilbertElliott(t *testing.T) {
+	const n = 10000
+	c, to := link(t, netsim.Config{
+		Seed:  7,
+		Burst: &netsim.GilbertElliott{GoodToBad: 0.05, BadToGood: 0.25, LossBad: 1},
+	})
+	var got []uint32
+	done := make(chan struct{})
+	go func() {
+		got = receive(to, 200*time.Millisecond)
+		close(done)
+	}()
+	send(t, c, to, n)
+	<-done
+
+	stats := c.Stats()
+	if stats.Lost != n-len(got) {
+		t.Fatalf("%d lost, %d of %d received", stats.Lost, len(got), n)
+	}
+	// a sixth of the time in the bad state, four datagrams in a row there
+	bursts := 0
+	next := uint32(0)
+	for _, seq := range got {
+		if seq != next {
+			bursts++
+		}
+		next = seq + 1
+	}
+	if next != n {
+		bursts++
+	}
+	rate := float64(stats.Lost) / n
+	meanBurst := float64(stats.Lost) / float64(bursts)
+	if rate < 0.12 || rate > 0.22 {
+		t.Errorf("loss rate %.3f, want about 0.167", rate)
+	}
+	if meanBurst < 3 || meanBurst > 5 {
+		t.Errorf("mean burst of %.2f datagrams, want about 4", meanBurst)
+	}
+}
+
+func TestBandwidthQueueDrops(t *testing.T) {
+	// 1000-byte datagrams take 8ms on a 1Mbps link, so a queue of 10ms
+	// takes two written at once and drops the rest
+	c, to := link(t, netsim.Config{Bandwidth: 1e6, QueueDelay: 10 * time.Millisecond})
+	b := make([]byte, 1000)
+	for round := 1; round <= 2; round++ {
+		// the link is idle again once the previous round was delivered
+		start := time.Now()
+		for range 10 {
+			if _, err := c.WriteTo(b, to.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		delivered := 0
+		for delivered < 2 {
+			to.(interface{ SetReadDeadline(time.Time) error }).SetReadDeadline(time.Now().Add(time.Second))
+			if _, _, err := to.ReadFrom(b); err != nil {
+				t.Fatalf("round %d: %d delivered: %v", round, delivered, err)
+			}
+			delivered++
+		}
+		// datagrams are never delivered before their time on the link,
+		// however late the reader
+		if d := time.Since(start); d < 16*time.Millisecond {
+			t.Errorf("round %d: two datagrams delivered within %s, want 16ms on the link", round, d)
+		}
+
+		if stats := c.Stats(); stats.Sent != 10*round || stats.Dropped != 8*round {
+			t.Fatalf("round %d: %d sent, %d dropped, want %d and %d", round, stats.Sent, stats.Dropped, 10*round, 8*round)
+		}
+	}
+
+	to.(interface{ SetReadDeadline(time.Time) error }).SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := to.ReadFrom(b); err == nil {
+		t.Error("a dropped datagram was delivered")
+	}
+	if stats := c.Stats(); stats.Delivered != 4 {
+		t.Errorf("%d delivered, want 4", stats.Delivered)
+	}
+}
+
+func TestReorderDuplicate(t *testing.T) {
+	const n = 2000
+	c, to := link(t, netsim.Config{
+		Seed:         3,
+		Reorder:      0.1,
+		ReorderDelay: 50 * time.Millisecond,
+		Duplicate:    0.05,
+	})
+	var got []uint32
+	done := make(chan struct{})
+	go func() {
+		got = receive(to, 200*time.Millisecond)
+		close(done)
+	}()
+	send(t, c, to, n)
+	<-done
+
+	stats := c.Stats()
+	if stats.Sent != n || stats.Delivered != n+stats.Duplicated || len(got) != stats.Delivered {
+		t.Fatalf("sent %d, delivered %d with %d duplicates, received %d", stats.Sent, stats.Delivered, stats.Duplicated, len(got))
+	}
+	if stats.Reordered < n/20 || stats.Reordered > n/5 {
+		t.Errorf("%d reordered, want about %d", stats.Reordered, n/10)
+	}
+	if stats.Duplicated < n/40 || stats.Duplicated > n/10 {
+		t.Errorf("%d duplicated, want about %d", stats.Duplicated, n/20)
+	}
+
+	seen := make(map[uint32]int)
+	late := 0
+	highest := uint32(0)
+	for _, seq := range got {
+		seen[seq]++
+		if seq < highest {
+			late++
+		}
+		highest = max(highest, seq)
+	}
+	dups := 0
+	for _, count := range seen {
+		dups += count - 1
+	}
+	if len(seen) != n || dups != stats.Duplicated {
+		t.Errorf("%d distinct datagrams with %d duplicates, want %d and %d", len(seen), dups, n, stats.Duplicated)
+	}
+	if late == 0 {
+		t.Error("no datagram overtaken")
+	}
+}
+
+func TestCloseDiscardsQueued(t *testing.T) {
+	c, to := link(t, netsim.Config{Delay: 50 * time.Millisecond})
+	send(t, c, to, 10)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := receive(to, 150*time.Millisecond); len(got) != 0 {
+		t.Errorf("%d datagrams delivered after Close", len(got))
+	}
+	if stats := c.Stats(); stats.Sent != 10 || stats.Delivered != 0 {
+		t.Errorf("stats %+v, want 10 sent and none delivered", stats)
+	}
+	if _, err := c.WriteTo([]byte{1}, to.LocalAddr()); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("WriteTo after Close: %v, want net.ErrClosed", err)
+	}
+}
+
+// syncBuffer is an Output written by the delivery loop and read by the
+// test.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Write(p)
+}
+
+func (s *syncBuffer) Bytes() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return bytes.Clone(s.b.Bytes())
+}
+
+// TestLossRecovery streams over a link losing datagrams in both
+// directions, so that data, NAKs and retransmissions are all lost at times,
+// and expects everything delivered in order.
+func TestLossRecovery(t *testing.T) {
+	const latency = time.Second // the RTT estimate starts at 100ms
+	a, b := transport.Pipe()
+	listener := mux.New(netsim.New(a, netsim.Config{Seed: 1, Loss: 0.05, Delay: 5 * time.Millisecond}), discard)
+	defer listener.Close()
+	caller := mux.New(netsim.New(b, netsim.Config{Seed: 2, Loss: 0.05, Delay: 5 * time.Millisecond}), discard)
+	t.Cleanup(func() { caller.Close() })
+
+	out := &syncBuffer{}
+	connected := make(chan struct{}, 1)
+	go receiver.Serve(listener, receiver.Options{
+		Output:  out,
+		Latency: latency,
+		Logger:  discard,
+		OnStateChange: func(_ *receiver.Conn, ch state.Change) {
+			if ch.To == state.Connected {
+				connected <- struct{}{}
+			}
+		},
+	})
+
+	// the handshake itself may be lost a few times
+	var conn *sender.Conn
+	var err error
+	for range 5 {
+		if conn, err = sender.Dial(listener.LocalAddr().String(), sender.Options{Mux: caller, Latency: latency, Logger: discard}); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	<-connected
+
+	var sent bytes.Buffer
+	for i := range 500 {
+		p := bytes.Repeat([]byte{byte(i), byte(i >> 8)}, 500)
+		sent.Write(p)
+		if _, err := conn.Write(p); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	// a live stream goes on, and the loss of its last packets is only
+	// noticed once more follow
+	deadline := time.Now().Add(5 * time.Second)
+	for !bytes.HasPrefix(out.Bytes(), sent.Bytes()) {
+		if time.Now().After(deadline) {
+			s := conn.Stats(false)
+			t.Fatalf("%d of %d bytes delivered, %d packets lost, %d retransmitted, %d dropped",
+				min(len(out.Bytes()), sent.Len()), sent.Len(), s.Total.PacketsLost, s.Total.PacketsRetransmitted, s.Total.PacketsDropped)
+		}
+		if _, err := conn.Write([]byte{0}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := conn.Stats(false); s.Total.PacketsRetransmitted == 0 {
+		t.Error("nothing retransmitted over a lossy link")
+	}
+}
+
+// TestHandshakeHighRTT connects over a link slower than the handshake is
+// repeated, so that late duplicate responses to the induction arrive
+// while the conclusion is waited for.
+func TestHandshakeHighRTT(t *testing.T) {
+	a, b := transport.Pipe()
+	listener := mux.New(netsim.New(a, netsim.Config{Delay: 200 * time.Millisecond}), discard)
+	defer listener.Close()
+	caller := mux.New(netsim.New(b, netsim.Config{Delay: 200 * time.Millisecond}), discard)
+	t.Cleanup(func() { caller.Close() })
+
+	go receiver.Serve(listener, receiver.Options{Logger: discard})
+
+	conn, err := sender.Dial(listener.LocalAddr().String(), sender.Options{Mux: caller, Logger: discard})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	conn.Close()
+}
+
+// hub is the listener end of a pipe per caller, sending back to each
+// caller over its own pipe.
+type hub struct {
+	ends  map[string]net.PacketConn // by address of the caller end
+	local net.Addr
+	in    chan hubDatagram
+	once  sync.Once
+	done  chan struct{}
+}
+
+type hubDatagram struct {
+	data []byte
+	addr net.Addr
+}
+
+// newHub returns a hub and the caller ends of n pipes to it.
+func newHub(n int) (*hub, []net.PacketConn) {
+	h := &hub{ends: make(map[string]net.PacketConn), in: make(chan hubDatagram, 256), done: make(chan struct{})}
+	var callers []net.PacketConn
+	for range n {
+		a, b := transport.Pipe()
+		if h.local == nil {
+			h.local = a.LocalAddr()
+		}
+		h.ends[b.LocalAddr().String()] = a
+		callers = append(callers, &hubCaller{b, h.local})
+		go func() {
+			buf := make([]byte, 1500)
+			for {
+				n, addr, err := a.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				select {
+				case h.in <- hubDatagram{bytes.Clone(buf[:n]), addr}:
+				case <-h.done:
+					return
+				}
+			}
+		}()
+	}
+	return h, callers
+}
+
+// hubCaller is the caller end of a pipe to a hub, reading what the hub
+// sends as coming from its address.
+type hubCaller struct {
+	net.PacketConn
+	hub net.Addr
+}
+
+func (c *hubCaller) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, _, err := c.PacketConn.ReadFrom(b)
+	return n, c.hub, err
+}
+
+func (h *hub) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case d := <-h.in:
+		return copy(b, d.data), d.addr, nil
+	case <-h.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (h *hub) WriteTo(b []byte, addr net.Addr) (int, error) {
+	end, ok := h.ends[addr.String()]
+	if !ok {
+		return len(b), nil
+	}
+	return end.WriteTo(b, addr)
+}
+
+func (h *hub) LocalAddr() net.Addr { return h.local }
+
+func (h *hub) Close() error {
+	h.once.Do(func() {
+		close(h.done)
+		for _, end := range h.ends {
+			end.Close()
+		}
+	})
+	return nil
+}
+
+// cutConn is a caller end that can be cut off in both directions, and
+// counts the data packets it sends.
+type cutConn struct {
+	net.PacketConn
+	cut  atomic.Bool
+	data atomic.Int32
+}
+
+func (c *cutConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if c.cut.Load() {
+		return len(b), nil
+	}
+	if len(b) > 0 && b[0]&0x80 == 0 {
+		c.data.Add(1)
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func (c *cutConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil || !c.cut.Load() {
+			return n, addr, err
+		}
+	}
+}
+
+// TestGroupMainLinkBack cuts the main link of a main/backup group for
+// longer than the peer idle timeout, so that it is closed, and expects the
+// stream to go over the backup meanwhile and back over the main link once
+// it is redialed.
+func TestGroupMainLinkBack(t *testing.T) {
+	const idle = 1200 * time.Millisecond // above the keep-alive interval
+	h, ends := newHub(2)
+	listener := mux.New(h, discard)
+	defer listener.Close()
+	main, backup := &cutConn{PacketConn: ends[0]}, &cutConn{PacketConn: ends[1]}
+	mainMux, backupMux := mux.New(main, discard), mux.New(backup, discard)
+	t.Cleanup(func() {
+		mainMux.Close()
+		backupMux.Close()
+	})
+	go receiver.Serve(listener, receiver.Options{PeerIdleTimeout: idle, Logger: discard})
+
+	addr := listener.LocalAddr().String()
+	g, err := sender.DialGroup(packets.GTYPE_MAIN_BACKUP, []sender.Link{
+		{Addr: addr, Weight: 2, Mux: mainMux},
+		{Addr: addr, Weight: 1, Mux: backupMux},
+	}, sender.Options{PeerIdleTimeout: idle, ConnectTimeout: time.Second, Logger: discard})
+	if err != nil {
+		t.Fatalf("DialGroup: %v", err)
+	}
+	defer g.Close()
+
+	// write writes for d and returns the data packets sent over each link
+	write := func(d time.Duration) (int32, int32) {
+		main.data.Store(0)
+		backup.data.Store(0)
+		for end := time.Now().Add(d); time.Now().Before(end); {
+			if _, err := g.Write(make([]byte, 100)); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		return main.data.Load(), backup.data.Load()
+	}
+
+	if m, b := write(200 * time.Millisecond); m == 0 || b != 0 {
+		t.Fatalf("before the cut: %d data packets over the main link, %d over the backup", m, b)
+	}
+
+	main.cut.Store(true)
+	if _, b := write(2 * time.Second); b == 0 {
+		t.Fatal("nothing sent over the backup while the main link was cut")
+	}
+	main.cut.Store(false)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if m, _ := write(100 * time.Millisecond); m > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("main link not used again")
+		}
+	}
+	write(200 * time.Millisecond) // for the backup to settle
+	if m, b := write(200 * time.Millisecond); m == 0 || b != 0 {
+		t.Errorf("after the main link came back: %d data packets over it, %d over the backup", m, b)
+	}
+}
+
+// dropConn loses the first transmission of every tenth of the first 100
+// data packets it sends, from the fifth.
+type dropConn struct {
+	net.PacketConn
+	mu      sync.Mutex
+	seen    map[uint32]bool
+	dropped int
+}
+
+func (c *dropConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if len(b) >= 16 && b[0]&0x80 == 0 {
+		seq := binary.BigEndian.Uint32(b[0:4])
+		c.mu.Lock()
+		first := !c.seen[seq]
+		c.seen[seq] = true
+		drop := first && len(c.seen) <= 100 && len(c.seen)%10 == 5
+		if drop {
+			c.dropped++
+		}
+		c.mu.Unlock()
+		if drop {
+			return len(b), nil
+		}
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// TestStatsAccounting checks the loss and retransmission counters of both
+// ends against the data packets a link lost, and that they start from zero
+// again in a new interval.
+func TestStatsAccounting(t *testing.T) {
+	a, b := transport.Pipe()
+	listener := mux.New(a, discard)
+	defer listener.Close()
+	lossy := &dropConn{PacketConn: b, seen: make(map[uint32]bool)}
+	caller := mux.New(lossy, discard)
+	t.Cleanup(func() { caller.Close() })
+
+	out := &syncBuffer{}
+	accepted := make(chan *receiver.Conn, 1)
+	go receiver.Serve(listener, receiver.Options{
+		Output: out,
+		Logger: discard,
+		OnStateChange: func(c *receiver.Conn, ch state.Change) {
+			if ch.To == state.Connected {
+				accepted <- c
+			}
+		},
+	})
+	conn, err := sender.Dial(listener.LocalAddr().String(), sender.Options{Mux: caller, Logger: discard})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	rconn := <-accepted
+
+	// stream writes n packets and waits for them all to be delivered, and
+	// for retransmissions to settle
+	sent := 0
+	stream := func(n int) {
+		t.Helper()
+		for range n {
+			if _, err := conn.Write(make([]byte, 100)); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			sent += 100
+			time.Sleep(2 * time.Millisecond)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for len(out.Bytes()) < sent {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d of %d bytes delivered", len(out.Bytes()), sent)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	stream(100)
+	lossy.mu.Lock()
+	dropped := uint64(lossy.dropped)
+	lossy.mu.Unlock()
+	if dropped != 10 {
+		t.Fatalf("%d packets dropped, want 10", dropped)
+	}
+	ss, rs := conn.Stats(true), rconn.Stats(true)
+	if ss.Total.PacketsLost != dropped || rs.Total.PacketsLost != dropped {
+		t.Errorf("%d packets lost for the sender, %d for the receiver, want %d", ss.Total.PacketsLost, rs.Total.PacketsLost, dropped)
+	}
+	if ss.Total.PacketsRetransmitted < dropped || rs.Total.PacketsRetransmitted < dropped {
+		t.Errorf("%d packets retransmitted by the sender, %d received, want at least %d",
+			ss.Total.PacketsRetransmitted, rs.Total.PacketsRetransmitted, dropped)
+	}
+	if ss.Total.PacketsSent != 100+ss.Total.PacketsRetransmitted {
+		t.Errorf("%d packets sent with %d retransmitted, want 100 first transmissions", ss.Total.PacketsSent, ss.Total.PacketsRetransmitted)
+	}
+	if rs.Total.PacketsReceived != 100-dropped+rs.Total.PacketsRetransmitted {
+		t.Errorf("%d packets received with %d retransmitted, want %d first transmissions",
+			rs.Total.PacketsReceived, rs.Total.PacketsRetransmitted, 100-dropped)
+	}
+	if ss.Total.BytesSent != 100*ss.Total.PacketsSent || rs.Total.BytesReceived != 100*rs.Total.PacketsReceived {
+		t.Errorf("%d bytes sent, %d received, for packets of 100 bytes", ss.Total.BytesSent, rs.Total.BytesReceived)
+	}
+
+	// a new interval counts the lossless packets that follow alone
+	stream(10)
+	ss2, rs2 := conn.Stats(false), rconn.Stats(false)
+	if want := (stats.Counters{PacketsSent: 10, BytesSent: 1000}); ss2.Interval != want {
+		t.Errorf("sender interval %+v, want %+v", ss2.Interval, want)
+	}
+	if want := (stats.Counters{PacketsReceived: 10, BytesReceived: 1000}); rs2.Interval != want {
+		t.Errorf("receiver interval %+v, want %+v", rs2.Interval, want)
+	}
+	if rs2.Total.PacketsLost != dropped || rs2.Total.PacketsReceived != rs.Total.PacketsReceived+10 {
+		t.Errorf("receiver totals %+v after the new interval", rs2.Total)
+	}
+}
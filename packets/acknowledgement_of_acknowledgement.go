@@ -38,6 +38,8 @@
 // (CIF).
 package packets
 
+import "fmt"
+
 type ACKACKControlPacket struct {
 	PacketType            byte   // 1 bit, value = 1
 	ControlType           uint16 // 15 bits, value = ACKACK{0x0006} value = 6
@@ -45,3 +47,31 @@ type ACKACKControlPacket struct {
 	Timestamp             uint32 // 32 bits
 	DestinationSocketID   uint32 // 32 bits
 }
+
+// ParseACKACKControlPacket decodes an ACKACK from its control packet.
+func ParseACKACKControlPacket(c *Control) (*ACKACKControlPacket, error) {
+	if c.ControlType != ACKACK {
+		return nil, fmt.Errorf("not an ACKACK packet: control type %d", c.ControlType)
+	}
+
+	return &ACKACKControlPacket{
+		PacketType:            1,
+		ControlType:           uint16(ACKACK),
+		AcknowledgementNumber: c.TypeSpecificInfo,
+		Timestamp:             c.Timestamp,
+		DestinationSocketID:   c.DestinationSocketID,
+	}, nil
+}
+
+// Marshal encodes the ACKACK control packet. The CIF carries a single
+// zero word, which is what peers expect to receive.
+func (a *ACKACKControlPacket) Marshal() []byte {
+	c := Control{
+		ControlType:             ACKACK,
+		TypeSpecificInfo:        a.AcknowledgementNumber,
+		Timestamp:               a.Timestamp,
+		DestinationSocketID:     a.DestinationSocketID,
+		ControlInformationField: make([]byte, 4),
+	}
+	return c.Marshal()
+}
@@ -156,6 +156,11 @@
 //	Appendix A.
 package packets
 
+import (
+	"encoding/binary"
+	"fmt"
+)
+
 type AcknowledgementControlPacket struct {
 	PacketType                           uint8  // value = 1.  The packet type value of an acknowledgment control packet is "1"
 	ControlType                          uint16 // 15 bits, value = ACK{0x0002}.  The control type value of an acknowledgment control packet is "2".
@@ -171,3 +176,73 @@ type AcknowledgementControlPacket struct {
 	EstimatedLinkCapacity                uint32 // 32 bits.  Estimated bandwidth of the link,
 	ReceivingRate                        uint32 // 32 bits.  Estimated receiving rate, in bytes per
 }
+
+const (
+	LightACKSize = 4  // Last Acknowledged Packet Sequence Number only
+	SmallACKSize = 16 // fields up to and including Available Buffer Size
+	FullACKSize  = 28 // all fields
+)
+
+// ParseAcknowledgementControlPacket decodes an ACK from its control packet.
+// Fields missing from light and small ACKs are left zero.
+func ParseAcknowledgementControlPacket(c *Control) (*AcknowledgementControlPacket, error) {
+	if c.ControlType != ACK {
+		return nil, fmt.Errorf("not an ACK packet: control type %d", c.ControlType)
+	}
+	cif := c.ControlInformationField
+	if len(cif) < LightACKSize {
+		return nil, fmt.Errorf("ACK too short: %d bytes (minimum %d)", len(cif), LightACKSize)
+	}
+
+	var words [FullACKSize / 4]uint32
+	for i := 0; i < len(words) && (i+1)*4 <= len(cif); i++ {
+		words[i] = binary.BigEndian.Uint32(cif[i*4:])
+	}
+
+	return &AcknowledgementControlPacket{
+		PacketType:                           1,
+		ControlType:                          uint16(ACK),
+		AcknowledgementNumber:                c.TypeSpecificInfo,
+		Timestamp:                            c.Timestamp,
+		DestinationSocketID:                  c.DestinationSocketID,
+		LastAcknowledgedPacketSequenceNumber: words[0],
+		RTT:                                  words[1],
+		RTTVariance:                          words[2],
+		AvailableBufferSize:                  words[3],
+		PacketsReceivingRate:                 words[4],
+		EstimatedLinkCapacity:                words[5],
+		ReceivingRate:                        words[6],
+	}, nil
+}
+
+// IsFull reports whether the ACK was received as a full ACK. Only full ACKs
+// carry an acknowledgement number and are answered with an ACKACK.
+func (a *AcknowledgementControlPacket) IsFull() bool {
+	return a.AcknowledgementNumber != 0
+}
+
+// Marshal encodes a full ACK, or a light ACK if AcknowledgementNumber is 0.
+func (a *AcknowledgementControlPacket) Marshal() []byte {
+	size := FullACKSize
+	if !a.IsFull() {
+		size = LightACKSize
+	}
+
+	cif := make([]byte, FullACKSize)
+	binary.BigEndian.PutUint32(cif[0:4], a.LastAcknowledgedPacketSequenceNumber)
+	binary.BigEndian.PutUint32(cif[4:8], a.RTT)
+	binary.BigEndian.PutUint32(cif[8:12], a.RTTVariance)
+	binary.BigEndian.PutUint32(cif[12:16], a.AvailableBufferSize)
+	binary.BigEndian.PutUint32(cif[16:20], a.PacketsReceivingRate)
+	binary.BigEndian.PutUint32(cif[20:24], a.EstimatedLinkCapacity)
+	binary.BigEndian.PutUint32(cif[24:28], a.ReceivingRate)
+
+	c := Control{
+		ControlType:             ACK,
+		TypeSpecificInfo:        a.AcknowledgementNumber,
+		Timestamp:               a.Timestamp,
+		DestinationSocketID:     a.DestinationSocketID,
+		ControlInformationField: cif[:size],
+	}
+	return c.Marshal()
+}
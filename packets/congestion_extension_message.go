@@ -0,0 +1,42 @@
+//    Congestion Control Extension Message
+
+//    The Congestion Control handshake extension message has
+//    SRT_CMD_CONGESTION extension type (see Table 5).  It carries the name
+//    of the congestion controller the caller wants, "live" or "file".
+//    Live is used when the extension is absent.
+
+//    Like the Stream ID, the content is stored as 32-bit little endian
+//    words, padded with zeros to the Extension Length.
+
+package packets
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// LiveCongestion is the congestion controller of live mode, the default.
+const LiveCongestion = "live"
+
+type CongestionExtensionMessage struct {
+	Type string
+}
+
+// maxCongestionTypeSize bounds the controller name, which is a short word.
+const maxCongestionTypeSize = 32
+
+// ParseCongestionExtensionMessage decodes SRT_CMD_CONGESTION extension
+// contents.
+func ParseCongestionExtensionMessage(data []byte) (*CongestionExtensionMessage, error) {
+	if len(data) > maxCongestionTypeSize {
+		return nil, fmt.Errorf("congestion controller name too long: %d bytes (maximum %d)", len(data), maxCongestionTypeSize)
+	}
+
+	b := swapWords(data)
+	return &CongestionExtensionMessage{Type: string(bytes.TrimRight(b, "\x00"))}, nil
+}
+
+// Marshal encodes the controller name as zero padded little endian words.
+func (m *CongestionExtensionMessage) Marshal() []byte {
+	return swapWords([]byte(m.Type))
+}
@@ -63,6 +63,11 @@
 // Table 1: SRT control packet types
 package packets
 
+import (
+	"encoding/binary"
+	"fmt"
+)
+
 type ControlPacketType uint16
 
 const (
@@ -86,3 +91,35 @@ type Control struct {
 	DestinationSocketID     uint32
 	ControlInformationField []byte // Control Information Field
 }
+
+// ParseControlPacket decodes a control packet header, leaving the CIF
+// for the type-specific parsers.
+func ParseControlPacket(data []byte) (*Control, error) {
+	if len(data) < MinPacketSize {
+		return nil, fmt.Errorf("control packet too short: %d bytes (minimum %d)", len(data), MinPacketSize)
+	}
+	if !isControlPacket(data) {
+		return nil, fmt.Errorf("not a control packet")
+	}
+
+	return &Control{
+		ControlType:             ControlPacketType(binary.BigEndian.Uint16(data[0:2]) & 0x7FFF),
+		Subtype:                 ControlPacketType(binary.BigEndian.Uint16(data[2:4])),
+		TypeSpecificInfo:        binary.BigEndian.Uint32(data[4:8]),
+		Timestamp:               binary.BigEndian.Uint32(data[8:12]),
+		DestinationSocketID:     binary.BigEndian.Uint32(data[12:16]),
+		ControlInformationField: data[16:],
+	}, nil
+}
+
+// Marshal encodes the control packet into its wire format.
+func (c *Control) Marshal() []byte {
+	b := make([]byte, MinPacketSize+len(c.ControlInformationField))
+	binary.BigEndian.PutUint16(b[0:2], 0x8000|uint16(c.ControlType)&0x7FFF)
+	binary.BigEndian.PutUint16(b[2:4], uint16(c.Subtype))
+	binary.BigEndian.PutUint32(b[4:8], c.TypeSpecificInfo)
+	binary.BigEndian.PutUint32(b[8:12], c.Timestamp)
+	binary.BigEndian.PutUint32(b[12:16], c.DestinationSocketID)
+	copy(b[16:], c.ControlInformationField)
+	return b
+}
@@ -56,6 +56,13 @@
 //	of the data is the remaining length of the UDP packet.
 package packets
 
+import (
+	"encoding/binary"
+	"fmt"
+
+	"coresrt/seqno"
+)
+
 type Data struct {
 	PacketSequenceNumber    uint32
 	PacketPositionFlag      byte   // 2 bits
@@ -67,3 +74,42 @@ type Data struct {
 	DestinationSocketID     uint32
 	Data                    []byte
 }
+
+// ParseDataPacket decodes a data packet, including its header.
+func ParseDataPacket(data []byte) (*Data, error) {
+	if len(data) < MinPacketSize {
+		return nil, fmt.Errorf("data packet too short: %d bytes (minimum %d)", len(data), MinPacketSize)
+	}
+	if isControlPacket(data) {
+		return nil, fmt.Errorf("not a data packet")
+	}
+
+	flags := data[4]
+	return &Data{
+		PacketSequenceNumber:    binary.BigEndian.Uint32(data[0:4]) & seqno.Max,
+		PacketPositionFlag:      flags >> 6,
+		OrderFlag:               (flags >> 5) & 0x01,
+		KeyBasedEncryptionFlag:  (flags >> 3) & 0x03,
+		RetransmittedPacketFlag: (flags >> 2) & 0x01,
+		MessageNumber:           binary.BigEndian.Uint32(data[4:8]) & seqno.MaxMessage,
+		Timestamp:               binary.BigEndian.Uint32(data[8:12]),
+		DestinationSocketID:     binary.BigEndian.Uint32(data[12:16]),
+		Data:                    data[16:],
+	}, nil
+}
+
+// Marshal encodes the data packet into its wire format.
+func (d *Data) Marshal() []byte {
+	b := make([]byte, MinPacketSize+len(d.Data))
+	binary.BigEndian.PutUint32(b[0:4], d.PacketSequenceNumber&seqno.Max)
+
+	flags := uint32(d.PacketPositionFlag&0x03)<<30 |
+		uint32(d.OrderFlag&0x01)<<29 |
+		uint32(d.KeyBasedEncryptionFlag&0x03)<<27 |
+		uint32(d.RetransmittedPacketFlag&0x01)<<26
+	binary.BigEndian.PutUint32(b[4:8], flags|d.MessageNumber&seqno.MaxMessage)
+	binary.BigEndian.PutUint32(b[8:12], d.Timestamp)
+	binary.BigEndian.PutUint32(b[12:16], d.DestinationSocketID)
+	copy(b[16:], d.Data)
+	return b
+}
@@ -0,0 +1,39 @@
+//    Packet Filter Extension Message
+
+//    The Packet Filter handshake extension message has SRT_CMD_FILTER
+//    extension type (see Table 5).  It carries the packet filter
+//    configuration string, such as "fec,cols:10,rows:5,arq:onreq".  The
+//    caller sends the configuration it wants and the listener responds
+//    with the configuration agreed for the connection.
+
+//    Like the Stream ID, the content is stored as 32-bit little endian
+//    words, padded with zeros to the Extension Length.
+
+package packets
+
+import (
+	"bytes"
+	"fmt"
+)
+
+type FilterExtensionMessage struct {
+	Config string
+}
+
+// MaxFilterConfigSize is the maximum allowed size of the filter configuration.
+const MaxFilterConfigSize = 512
+
+// ParseFilterExtensionMessage decodes SRT_CMD_FILTER extension contents.
+func ParseFilterExtensionMessage(data []byte) (*FilterExtensionMessage, error) {
+	if len(data) > MaxFilterConfigSize {
+		return nil, fmt.Errorf("filter config too long: %d bytes (maximum %d)", len(data), MaxFilterConfigSize)
+	}
+
+	b := swapWords(data)
+	return &FilterExtensionMessage{Config: string(bytes.TrimRight(b, "\x00"))}, nil
+}
+
+// Marshal encodes the filter configuration as zero padded little endian words.
+func (f *FilterExtensionMessage) Marshal() []byte {
+	return swapWords([]byte(f.Config))
+}
@@ -0,0 +1,335 @@
+package packets
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var controlTypeNames = map[ControlPacketType]string{
+	HANDSHAKE:         "HANDSHAKE",
+	KEEPALIVE:         "KEEPALIVE",
+	ACK:               "ACK",
+	NAK:               "NAK",
+	CongestionWarning: "CONGESTION",
+	SHUTDOWN:          "SHUTDOWN",
+	ACKACK:            "ACKACK",
+	DROPREQ:           "DROPREQ",
+	PEERERROR:         "PEERERROR",
+	UserDefinedType:   "USERDEFINED",
+}
+
+func (t ControlPacketType) String() string {
+	if name, ok := controlTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("CONTROL(%#04x)", uint16(t))
+}
+
+var handshakeTypeNames = map[HandshakeType]string{
+	Done:       "DONE",
+	Agreement:  "AGREEMENT",
+	Conclusion: "CONCLUSION",
+	WaveHand:   "WAVEAHAND",
+	Induction:  "INDUCTION",
+}
+
+func (t HandshakeType) String() string {
+	if name, ok := handshakeTypeNames[t]; ok {
+		return name
+	}
+	if reason, ok := t.RejectReason(); ok {
+		return reason.String()
+	}
+	return fmt.Sprintf("HANDSHAKE(%#08x)", uint32(t))
+}
+
+var extensionTypeNames = map[ExtensionType]string{
+	HSREQ:      "HSREQ",
+	HSRSP:      "HSRSP",
+	KMREQ:      "KMREQ",
+	KMRSP:      "KMRSP",
+	SID:        "SID",
+	Congestion: "CONGESTION",
+	Filter:     "FILTER",
+	Group:      "GROUP",
+}
+
+func (t ExtensionType) String() string {
+	if name, ok := extensionTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("EXT(%d)", uint16(t))
+}
+
+func (c CypherFamilyAndKeySize) String() string {
+	switch c {
+	case NoEncryption:
+		return "none"
+	case AES128:
+		return "AES-128"
+	case AES192:
+		return "AES-192"
+	case AES256:
+		return "AES-256"
+	}
+	return fmt.Sprintf("cipher(%d)", uint16(c))
+}
+
+func (f HandshakeExtensionFlag) String() string {
+	if f == SRTMagicCode {
+		return "SRT_MAGIC"
+	}
+	return flagNames(uint32(f), []string{"HSREQ", "KMREQ", "CONFIG"})
+}
+
+func (f HandshakeExtensionMessageFlags) String() string {
+	return flagNames(uint32(f), []string{
+		"TSBPDSND", "TSBPDRCV", "CRYPT", "TLPKTDROP", "PERIODICNAK", "REXMITFLG", "STREAM", "PACKETFILTER",
+	})
+}
+
+func (g SrtGtype) String() string {
+	switch g {
+	case GTYPE_UNDEFINED:
+		return "undefined"
+	case GTYPE_BROADCAST:
+		return "broadcast"
+	case GTYPE_MAIN_BACKUP:
+		return "main/backup"
+	case GTYPE_BALANCING:
+		return "balancing"
+	case GTYPE_MULTICAST:
+		return "multicast"
+	}
+	return fmt.Sprintf("gtype(%d)", uint8(g))
+}
+
+// flagNames joins the names of the bits set in f, names[i] being the name
+// of bit i, and shows the unnamed bits in hex.
+func flagNames(f uint32, names []string) string {
+	var parts []string
+	for i, name := range names {
+		if f&(1<<i) != 0 {
+			parts = append(parts, name)
+			f &^= 1 << i
+		}
+	}
+	if f != 0 {
+		parts = append(parts, fmt.Sprintf("%#x", f))
+	}
+	if len(parts) == 0 {
+		return "0"
+	}
+	return strings.Join(parts, "|")
+}
+
+// Format renders a packet returned by ParsePacket, or a *Data or *Control,
+// on several lines: a summary of the header, then each field of the
+// control information, indented. Fields that cannot be decoded are
+// reported in place, so a malformed packet still shows what it has.
+func Format(pkt interface{}) string {
+	var b strings.Builder
+	switch p := pkt.(type) {
+	case *Data:
+		formatData(&b, p)
+	case *Control:
+		formatControl(&b, p)
+	default:
+		fmt.Fprintf(&b, "unknown packet %T\n", pkt)
+	}
+	return b.String()
+}
+
+func formatTimestamp(ts uint32) string {
+	return (time.Duration(ts) * time.Microsecond).String()
+}
+
+func formatData(b *strings.Builder, p *Data) {
+	position := [...]string{"middle", "last", "first", "solo"}[p.PacketPositionFlag&0x03]
+	fmt.Fprintf(b, "DATA seq %d, msg %d, ts %s, dst %08x, %d bytes\n",
+		p.PacketSequenceNumber, p.MessageNumber, formatTimestamp(p.Timestamp), p.DestinationSocketID, len(p.Data))
+	fmt.Fprintf(b, "  position: %s, in order: %t, key: %s, retransmitted: %t\n",
+		position, p.OrderFlag != 0, KeyBasedEncryption(p.KeyBasedEncryptionFlag), p.RetransmittedPacketFlag != 0)
+}
+
+func formatControl(b *strings.Builder, c *Control) {
+	fmt.Fprintf(b, "%s ts %s, dst %08x", c.ControlType, formatTimestamp(c.Timestamp), c.DestinationSocketID)
+	if c.Subtype != 0 {
+		fmt.Fprintf(b, ", subtype %d", c.Subtype)
+	}
+	if c.TypeSpecificInfo != 0 {
+		fmt.Fprintf(b, ", info %d", c.TypeSpecificInfo)
+	}
+	b.WriteString("\n")
+
+	cif := c.ControlInformationField
+	switch c.ControlType {
+	case HANDSHAKE:
+		formatHandshake(b, cif)
+	case ACK:
+		ack, err := ParseAcknowledgementControlPacket(c)
+		if err != nil {
+			fmt.Fprintf(b, "  error: %v\n", err)
+			return
+		}
+		kind := "full"
+		switch {
+		case len(cif) < SmallACKSize:
+			kind = "light"
+		case len(cif) < FullACKSize:
+			kind = "small"
+		}
+		fmt.Fprintf(b, "  %s ACK %d: last acknowledged seq %d\n", kind, ack.AcknowledgementNumber, ack.LastAcknowledgedPacketSequenceNumber)
+		if len(cif) >= SmallACKSize {
+			fmt.Fprintf(b, "  rtt: %s, rtt variance: %s, available buffer: %d packets\n",
+				formatTimestamp(ack.RTT), formatTimestamp(ack.RTTVariance), ack.AvailableBufferSize)
+		}
+		if len(cif) >= FullACKSize {
+			fmt.Fprintf(b, "  receiving rate: %d packets/s, %d bytes/s, link capacity: %d packets/s\n",
+				ack.PacketsReceivingRate, ack.ReceivingRate, ack.EstimatedLinkCapacity)
+		}
+	case NAK:
+		nak, err := ParseNegativeAcknowledgmentControlPacket(c)
+		if err == nil {
+			var ranges []LossRange
+			if ranges, err = nak.LossRanges(); err == nil {
+				formatLossRanges(b, ranges)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(b, "  error: %v\n", err)
+		}
+	case ACKACK:
+		fmt.Fprintf(b, "  ACK %d\n", c.TypeSpecificInfo)
+	case DROPREQ:
+		fmt.Fprintf(b, "  message %d", c.TypeSpecificInfo)
+		if len(cif) >= 8 {
+			fmt.Fprintf(b, ": seq %d to %d", binary.BigEndian.Uint32(cif[0:4]), binary.BigEndian.Uint32(cif[4:8]))
+		}
+		b.WriteString("\n")
+	case PEERERROR:
+		fmt.Fprintf(b, "  error code %d\n", c.TypeSpecificInfo)
+	case UserDefinedType:
+		if t := ExtensionType(c.Subtype); t >= HSREQ && t <= KMRSP {
+			fmt.Fprintf(b, "  %s:", t)
+			formatExtension(b, t, cif)
+		}
+	}
+}
+
+func formatLossRanges(b *strings.Builder, ranges []LossRange) {
+	total := 0
+	var parts []string
+	for _, r := range ranges {
+		n := r.Len()
+		total += n
+		if r.From == r.To {
+			parts = append(parts, fmt.Sprint(r.From))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", r.From, r.To))
+		}
+	}
+	fmt.Fprintf(b, "  lost %d packets: %s\n", total, strings.Join(parts, ", "))
+}
+
+func formatHandshake(b *strings.Builder, cif []byte) {
+	hs, err := ParseHandshakeControl(cif)
+	if err != nil && len(cif) > HandshakeCIFSize {
+		// show the fixed fields before the malformed extensions
+		hs, _ = ParseHandshakeControl(cif[:HandshakeCIFSize])
+	}
+	if hs == nil {
+		fmt.Fprintf(b, "  error: %v\n", err)
+		return
+	}
+	fmt.Fprintf(b, "  %s, version %d, socket %08x, cookie %08x, peer ip %s\n",
+		hs.HandshakeType, hs.Version, hs.SRTSocketID, hs.SYNCookie, hs.PeerIPAddress.IP())
+	if hs.Version < 5 {
+		// HSv4 carries the socket type there, 2 for UDT_DGRAM
+		fmt.Fprintf(b, "  encryption: %s, socket type: %d\n", hs.EncryptionField, hs.ExtensionField)
+	} else {
+		fmt.Fprintf(b, "  encryption: %s, extension field: %s\n", hs.EncryptionField, hs.ExtensionField)
+	}
+	fmt.Fprintf(b, "  initial seq: %d, mtu: %d, flow window: %d\n",
+		hs.InitialPacketSequenceNumber, hs.MaximumTransmissionUnitSize, hs.MaximumFlowWindowSize)
+
+	for _, e := range hs.Extensions {
+		fmt.Fprintf(b, "  %s:", e.Type)
+		formatExtension(b, e.Type, e.Contents)
+	}
+	if err != nil {
+		fmt.Fprintf(b, "  error: %v\n", err)
+	}
+}
+
+// formatExtension renders the contents of a handshake extension after
+// its name, ending the line.
+func formatExtension(b *strings.Builder, typ ExtensionType, data []byte) {
+	switch typ {
+	case HSREQ, HSRSP:
+		m, err := ParseHandshakeExtensionMessage(data)
+		if err != nil {
+			fmt.Fprintf(b, " error: %v\n", err)
+			return
+		}
+		fmt.Fprintf(b, " version %s, flags %s, receiver delay %dms, sender delay %dms\n",
+			m.SRTVersion, m.SRTFlags, m.ReceiverTSBPDDelay, m.SenderTSBPDDelay)
+	case KMREQ, KMRSP:
+		formatKeyMaterial(b, data)
+	case SID:
+		sid, err := ParseStreamIdExtensionMessage(data)
+		if err != nil {
+			fmt.Fprintf(b, " error: %v\n", err)
+			return
+		}
+		fmt.Fprintf(b, " %q\n", sid.StreamID)
+	case Congestion:
+		m, err := ParseCongestionExtensionMessage(data)
+		if err != nil {
+			fmt.Fprintf(b, " error: %v\n", err)
+			return
+		}
+		fmt.Fprintf(b, " %q\n", m.Type)
+	case Filter:
+		f, err := ParseFilterExtensionMessage(data)
+		if err != nil {
+			fmt.Fprintf(b, " error: %v\n", err)
+			return
+		}
+		fmt.Fprintf(b, " %q\n", f.Config)
+	case Group:
+		g, err := ParseGroupMembershipExtension(data)
+		if err != nil {
+			fmt.Fprintf(b, " error: %v\n", err)
+			return
+		}
+		fmt.Fprintf(b, " id %08x, type %s, flags %#02x, weight %d\n", g.GroupID, g.Type, g.Flags, g.Weight)
+	default:
+		fmt.Fprintf(b, " % x\n", data)
+	}
+}
+
+func formatKeyMaterial(b *strings.Builder, data []byte) {
+	if len(data) == 4 {
+		// a KMRSP carrying a single state word reports a failure
+		fmt.Fprintf(b, " state %d\n", binary.BigEndian.Uint32(data))
+		return
+	}
+	km, err := ParseKeyMaterialMessage(data)
+	if err != nil {
+		fmt.Fprintf(b, " error: %v\n", err)
+		return
+	}
+	cipher := fmt.Sprintf("cipher %d", km.Cipher)
+	if km.Cipher == AESCTR {
+		cipher = "AES-CTR"
+	}
+	fmt.Fprintf(b, " %s, key length %d bits, keys %s, salt %d bytes, KEK index %d\n",
+		cipher, int(km.KeyLength)*32, KeyBasedEncryption(km.KeyBasedEncryption), len(km.Salt), km.KeyEncryptionKeyIndex)
+}
+
+func (k KeyBasedEncryption) String() string {
+	return [...]string{"none", "even", "odd", "even+odd"}[k&0x03]
+}
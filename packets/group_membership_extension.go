@@ -55,6 +55,11 @@
 //	otherwise transmission is synchronized on sequence numbers.
 package packets
 
+import (
+	"encoding/binary"
+	"fmt"
+)
+
 type SrtGtype uint8
 
 const (
@@ -71,3 +76,34 @@ type GroupMembershipExtension struct {
 	Flags   uint8    // 8 bits for special flags
 	Weight  uint16   // 16 bits for link priority
 }
+
+// GroupMembershipExtensionSize is the size of the SRT_CMD_GROUP contents.
+const GroupMembershipExtensionSize = 8
+
+// GroupFlagMsgSync is the M flag: members are synchronized on message
+// numbers rather than sequence numbers.
+const GroupFlagMsgSync uint8 = 0x01
+
+// ParseGroupMembershipExtension decodes SRT_CMD_GROUP extension contents.
+func ParseGroupMembershipExtension(data []byte) (*GroupMembershipExtension, error) {
+	if len(data) < GroupMembershipExtensionSize {
+		return nil, fmt.Errorf("group membership extension too short: %d bytes (minimum %d)", len(data), GroupMembershipExtensionSize)
+	}
+
+	return &GroupMembershipExtension{
+		GroupID: binary.BigEndian.Uint32(data[0:4]),
+		Type:    SrtGtype(data[4]),
+		Flags:   data[5],
+		Weight:  binary.BigEndian.Uint16(data[6:8]),
+	}, nil
+}
+
+// Marshal encodes the SRT_CMD_GROUP extension contents.
+func (g *GroupMembershipExtension) Marshal() []byte {
+	b := make([]byte, GroupMembershipExtensionSize)
+	binary.BigEndian.PutUint32(b[0:4], g.GroupID)
+	b[4] = byte(g.Type)
+	b[5] = g.Flags
+	binary.BigEndian.PutUint16(b[6:8], g.Weight)
+	return b
+}
@@ -160,6 +160,19 @@
 // Extension Contents: variable length.  The payload of the extension.
 package packets
 
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// HandshakeCIFSize is the size of the handshake CIF without extensions.
+const HandshakeCIFSize = 48
+
+// SRTMagicCode is sent by the listener in the Extension Field of the
+// INDUCTION response.
+const SRTMagicCode HandshakeExtensionFlag = 0x4A17
+
 type CypherFamilyAndKeySize uint16
 
 const (
@@ -218,7 +231,130 @@ type HandshakeControl struct {
 	SRTSocketID                 uint32                 // holds the ID of the source SRT socket from which a handshake packet is issued
 	SYNCookie                   uint32                 // randomized value for processing a handshake
 	PeerIPAddress               PeerIPAddress          // IPv4 or IPv6 address of the packet's sender
-	ExtensionType               ExtensionType          // used to process an integrated handshake
-	ExtensionLength             uint16
-	ExtensionContents           []byte
+	Extensions                  []HandshakeExtension   // in the order they are carried
+}
+
+// HandshakeExtension is one of the extension blocks that follow the fixed
+// handshake fields. Unknown types are kept, so that they can be skipped.
+type HandshakeExtension struct {
+	Type     ExtensionType
+	Contents []byte // padded with zeros to a whole number of four-byte blocks when marshalled
+}
+
+// NewPeerIPAddress encodes ip the way SRT peers expect it: IPv4 addresses
+// occupy the first field, and every field holds a little endian word.
+func NewPeerIPAddress(ip net.IP) PeerIPAddress {
+	var raw [16]byte
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(raw[:4], ip4)
+	} else {
+		copy(raw[:], ip.To16())
+	}
+
+	return PeerIPAddress{
+		IP1: binary.LittleEndian.Uint32(raw[0:4]),
+		IP2: binary.LittleEndian.Uint32(raw[4:8]),
+		IP3: binary.LittleEndian.Uint32(raw[8:12]),
+		IP4: binary.LittleEndian.Uint32(raw[12:16]),
+	}
+}
+
+// IP decodes the address back into a net.IP.
+func (p PeerIPAddress) IP() net.IP {
+	var raw [16]byte
+	binary.LittleEndian.PutUint32(raw[0:4], p.IP1)
+	binary.LittleEndian.PutUint32(raw[4:8], p.IP2)
+	binary.LittleEndian.PutUint32(raw[8:12], p.IP3)
+	binary.LittleEndian.PutUint32(raw[12:16], p.IP4)
+
+	if p.IP2 == 0 && p.IP3 == 0 && p.IP4 == 0 {
+		return net.IPv4(raw[0], raw[1], raw[2], raw[3])
+	}
+	return net.IP(raw[:])
+}
+
+// ParseHandshakeControl decodes the CIF of a handshake control packet,
+// with all the extension blocks that follow the fixed fields.
+func ParseHandshakeControl(cif []byte) (*HandshakeControl, error) {
+	if len(cif) < HandshakeCIFSize {
+		return nil, fmt.Errorf("handshake too short: %d bytes (minimum %d)", len(cif), HandshakeCIFSize)
+	}
+
+	h := &HandshakeControl{
+		Version:                     binary.BigEndian.Uint32(cif[0:4]),
+		EncryptionField:             CypherFamilyAndKeySize(binary.BigEndian.Uint16(cif[4:6])),
+		ExtensionField:              HandshakeExtensionFlag(binary.BigEndian.Uint16(cif[6:8])),
+		InitialPacketSequenceNumber: binary.BigEndian.Uint32(cif[8:12]),
+		MaximumTransmissionUnitSize: binary.BigEndian.Uint32(cif[12:16]),
+		MaximumFlowWindowSize:       binary.BigEndian.Uint32(cif[16:20]),
+		HandshakeType:               HandshakeType(binary.BigEndian.Uint32(cif[20:24])),
+		SRTSocketID:                 binary.BigEndian.Uint32(cif[24:28]),
+		SYNCookie:                   binary.BigEndian.Uint32(cif[28:32]),
+		PeerIPAddress: PeerIPAddress{
+			IP1: binary.BigEndian.Uint32(cif[32:36]),
+			IP2: binary.BigEndian.Uint32(cif[36:40]),
+			IP3: binary.BigEndian.Uint32(cif[40:44]),
+			IP4: binary.BigEndian.Uint32(cif[44:48]),
+		},
+	}
+
+	ext := cif[HandshakeCIFSize:]
+	for len(ext) > 0 {
+		if len(ext) < 4 {
+			return nil, fmt.Errorf("handshake extension truncated: %d bytes left", len(ext))
+		}
+		typ := ExtensionType(binary.BigEndian.Uint16(ext[0:2]))
+		end := 4 + int(binary.BigEndian.Uint16(ext[2:4]))*4
+		if end > len(ext) {
+			return nil, fmt.Errorf("handshake extension %d truncated: need %d bytes, have %d", typ, end, len(ext))
+		}
+		h.Extensions = append(h.Extensions, HandshakeExtension{Type: typ, Contents: ext[4:end]})
+		ext = ext[end:]
+	}
+
+	return h, nil
+}
+
+// Extension returns the contents of the first extension of type t.
+func (h *HandshakeControl) Extension(t ExtensionType) ([]byte, bool) {
+	for _, e := range h.Extensions {
+		if e.Type == t {
+			return e.Contents, true
+		}
+	}
+	return nil, false
+}
+
+// AddExtension appends an extension after those already set.
+func (h *HandshakeControl) AddExtension(t ExtensionType, contents []byte) {
+	h.Extensions = append(h.Extensions, HandshakeExtension{Type: t, Contents: contents})
+}
+
+// Marshal encodes the handshake CIF, followed by its extensions.
+func (h *HandshakeControl) Marshal() []byte {
+	b := make([]byte, HandshakeCIFSize)
+	binary.BigEndian.PutUint32(b[0:4], h.Version)
+	binary.BigEndian.PutUint16(b[4:6], uint16(h.EncryptionField))
+	binary.BigEndian.PutUint16(b[6:8], uint16(h.ExtensionField))
+	binary.BigEndian.PutUint32(b[8:12], h.InitialPacketSequenceNumber)
+	binary.BigEndian.PutUint32(b[12:16], h.MaximumTransmissionUnitSize)
+	binary.BigEndian.PutUint32(b[16:20], h.MaximumFlowWindowSize)
+	binary.BigEndian.PutUint32(b[20:24], uint32(h.HandshakeType))
+	binary.BigEndian.PutUint32(b[24:28], h.SRTSocketID)
+	binary.BigEndian.PutUint32(b[28:32], h.SYNCookie)
+	binary.BigEndian.PutUint32(b[32:36], h.PeerIPAddress.IP1)
+	binary.BigEndian.PutUint32(b[36:40], h.PeerIPAddress.IP2)
+	binary.BigEndian.PutUint32(b[40:44], h.PeerIPAddress.IP3)
+	binary.BigEndian.PutUint32(b[44:48], h.PeerIPAddress.IP4)
+
+	for _, e := range h.Extensions {
+		blocks := (len(e.Contents) + 3) / 4
+		b = binary.BigEndian.AppendUint16(b, uint16(e.Type))
+		b = binary.BigEndian.AppendUint16(b, uint16(blocks))
+		b = append(b, e.Contents...)
+		for i := len(e.Contents); i < blocks*4; i++ {
+			b = append(b, 0)
+		}
+	}
+	return b
 }
@@ -0,0 +1,186 @@
+package packets_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"coresrt/packets"
+)
+
+func TestHandshakeExtensions(t *testing.T) {
+	tests := []struct {
+		name string
+		exts []packets.HandshakeExtension
+		want []packets.HandshakeExtension // as parsed, padded
+	}{
+		{"none", nil, nil},
+		{
+			"several in order",
+			[]packets.HandshakeExtension{
+				{Type: packets.HSREQ, Contents: []byte{0, 1, 5, 0, 0, 0, 0, 0xbf, 0, 0x78, 0, 0x78}},
+				{Type: packets.SID, Contents: []byte("dcba")},
+				{Type: packets.Filter, Contents: []byte{1, 2, 3, 4, 5, 6, 7, 8}},
+				{Type: packets.Group, Contents: []byte{0x40, 0, 0, 1, 1, 0, 0, 0}},
+			},
+			nil,
+		},
+		{
+			"unknown types kept",
+			[]packets.HandshakeExtension{
+				{Type: 99, Contents: []byte{9, 9, 9, 9}},
+				{Type: packets.HSREQ, Contents: []byte{0, 1, 5, 0}},
+			},
+			nil,
+		},
+		{
+			"odd lengths padded",
+			[]packets.HandshakeExtension{
+				{Type: packets.SID, Contents: []byte{1, 2, 3, 4, 5}},
+				{Type: packets.Filter, Contents: []byte{6}},
+				{Type: packets.Congestion, Contents: nil},
+			},
+			[]packets.HandshakeExtension{
+				{Type: packets.SID, Contents: []byte{1, 2, 3, 4, 5, 0, 0, 0}},
+				{Type: packets.Filter, Contents: []byte{6, 0, 0, 0}},
+				{Type: packets.Congestion, Contents: []byte{}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hs := packets.HandshakeControl{
+				Version:       5,
+				HandshakeType: packets.Conclusion,
+				SRTSocketID:   0x12345678,
+				SYNCookie:     0xcafe,
+			}
+			for _, e := range tt.exts {
+				hs.AddExtension(e.Type, e.Contents)
+			}
+
+			b := hs.Marshal()
+			if len(b)%4 != 0 {
+				t.Fatalf("%d bytes marshalled, not whole blocks", len(b))
+			}
+			got, err := packets.ParseHandshakeControl(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.want
+			if want == nil {
+				want = tt.exts
+			}
+			if len(got.Extensions) != len(want) {
+				t.Fatalf("%d extensions parsed, want %d", len(got.Extensions), len(want))
+			}
+			for i, e := range got.Extensions {
+				if e.Type != want[i].Type || !bytes.Equal(e.Contents, want[i].Contents) {
+					t.Errorf("extension %d: type %d %x, want type %d %x", i, e.Type, e.Contents, want[i].Type, want[i].Contents)
+				}
+			}
+			if got.SRTSocketID != hs.SRTSocketID || got.SYNCookie != hs.SYNCookie || got.HandshakeType != hs.HandshakeType {
+				t.Errorf("fixed fields %+v, want %+v", got, hs)
+			}
+		})
+	}
+}
+
+func TestHandshakeExtensionFirstOfType(t *testing.T) {
+	var hs packets.HandshakeControl
+	hs.AddExtension(packets.SID, []byte("1111"))
+	hs.AddExtension(packets.SID, []byte("2222"))
+
+	got, err := packets.ParseHandshakeControl(hs.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, ok := got.Extension(packets.SID); !ok || string(data) != "1111" {
+		t.Errorf("Extension(SID) = %q, %v, want the first one", data, ok)
+	}
+	if _, ok := got.Extension(packets.KMREQ); ok {
+		t.Error("Extension(KMREQ) found in a handshake without one")
+	}
+}
+
+func TestHandshakeTruncated(t *testing.T) {
+	var full packets.HandshakeControl
+	full.AddExtension(packets.HSREQ, make([]byte, 12))
+	b := full.Marshal()
+
+	tests := []struct {
+		name string
+		cif  []byte
+	}{
+		{"fixed fields cut", b[:packets.HandshakeCIFSize-1]},
+		{"extension header cut", b[:packets.HandshakeCIFSize+2]},
+		{"extension contents cut", b[:len(b)-4]},
+		{"extension length beyond the packet", append(bytes.Clone(b), 0, 1, 0xff, 0xff, 0, 0, 0, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if hs, err := packets.ParseHandshakeControl(tt.cif); err == nil {
+				t.Errorf("parsed as %+v", hs)
+			}
+		})
+	}
+}
+
+func TestStreamIDAndFilterEncoding(t *testing.T) {
+	tests := []struct {
+		value string
+		wire  []byte // each four-byte block reversed, zero padded
+	}{
+		{"", []byte{}},
+		{"a", []byte{0, 0, 0, 'a'}},
+		{"abc", []byte{0, 'c', 'b', 'a'}},
+		{"abcd", []byte("dcba")},
+		{"abcde", []byte{'d', 'c', 'b', 'a', 0, 0, 0, 'e'}},
+		{"#!::r=live/feed,m=publish", nil},
+		{"fec,cols:10,rows:5,arq:onreq", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			sid := (&packets.StreamIdExtensionMessage{StreamID: tt.value}).Marshal()
+			filter := (&packets.FilterExtensionMessage{Config: tt.value}).Marshal()
+			if len(sid)%4 != 0 || len(sid) < len(tt.value) {
+				t.Errorf("stream ID marshalled to %d bytes", len(sid))
+			}
+			if tt.wire != nil && !bytes.Equal(sid, tt.wire) {
+				t.Errorf("stream ID marshalled to %q, want %q", sid, tt.wire)
+			}
+			if !bytes.Equal(filter, sid) {
+				t.Errorf("filter config marshalled to %q, stream ID to %q", filter, sid)
+			}
+
+			// through a handshake, as peers exchange them
+			var hs packets.HandshakeControl
+			hs.AddExtension(packets.SID, sid)
+			hs.AddExtension(packets.Filter, filter)
+			parsed, err := packets.ParseHandshakeControl(hs.Marshal())
+			if err != nil {
+				t.Fatal(err)
+			}
+			sidData, _ := parsed.Extension(packets.SID)
+			s, err := packets.ParseStreamIdExtensionMessage(sidData)
+			if err != nil || s.StreamID != tt.value {
+				t.Errorf("stream ID parsed as %+v, %v, want %q", s, err, tt.value)
+			}
+			filterData, _ := parsed.Extension(packets.Filter)
+			f, err := packets.ParseFilterExtensionMessage(filterData)
+			if err != nil || f.Config != tt.value {
+				t.Errorf("filter config parsed as %+v, %v, want %q", f, err, tt.value)
+			}
+		})
+	}
+}
+
+func TestStreamIDTooLong(t *testing.T) {
+	long := []byte(strings.Repeat("x", packets.MaxStreamIDSize+4))
+	if s, err := packets.ParseStreamIdExtensionMessage(long); err == nil {
+		t.Errorf("stream ID of %d bytes parsed as %q", len(long), s.StreamID)
+	}
+	if f, err := packets.ParseFilterExtensionMessage(long); err == nil {
+		t.Errorf("filter config of %d bytes parsed as %q", len(long), f.Config)
+	}
+}
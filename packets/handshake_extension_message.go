@@ -81,6 +81,11 @@
 // *  PACKET_FILTER flag indicates if the peer supports packet filter.
 package packets
 
+import (
+	"encoding/binary"
+	"fmt"
+)
+
 type HandshakeExtensionMessageFlags uint32
 
 const (
@@ -95,8 +100,35 @@ const (
 )
 
 type HandshakeExtensionMessage struct {
-	SRTVersion         uint32                         // SRT library version formed as major * 0x10000 + minor * 0x100 + patch
+	SRTVersion         Version                        // SRT library version formed as major * 0x10000 + minor * 0x100 + patch
 	SRTFlags           HandshakeExtensionMessageFlags // SRT configuration flags
 	ReceiverTSBPDDelay uint16                         // Timestamp-Based Packet Delivery (TSBPD) Delay of the receiver
 	SenderTSBPDDelay   uint16                         // TSBPD of the sender
 }
+
+// HandshakeExtensionMessageSize is the size of the HSREQ/HSRSP contents.
+const HandshakeExtensionMessageSize = 12
+
+// ParseHandshakeExtensionMessage decodes HSREQ or HSRSP extension contents.
+func ParseHandshakeExtensionMessage(data []byte) (*HandshakeExtensionMessage, error) {
+	if len(data) < HandshakeExtensionMessageSize {
+		return nil, fmt.Errorf("handshake extension message too short: %d bytes (minimum %d)", len(data), HandshakeExtensionMessageSize)
+	}
+
+	return &HandshakeExtensionMessage{
+		SRTVersion:         Version(binary.BigEndian.Uint32(data[0:4])),
+		SRTFlags:           HandshakeExtensionMessageFlags(binary.BigEndian.Uint32(data[4:8])),
+		ReceiverTSBPDDelay: binary.BigEndian.Uint16(data[8:10]),
+		SenderTSBPDDelay:   binary.BigEndian.Uint16(data[10:12]),
+	}, nil
+}
+
+// Marshal encodes the HSREQ/HSRSP extension contents.
+func (m *HandshakeExtensionMessage) Marshal() []byte {
+	b := make([]byte, HandshakeExtensionMessageSize)
+	binary.BigEndian.PutUint32(b[0:4], uint32(m.SRTVersion))
+	binary.BigEndian.PutUint32(b[4:8], uint32(m.SRTFlags))
+	binary.BigEndian.PutUint16(b[8:10], m.ReceiverTSBPDDelay)
+	binary.BigEndian.PutUint16(b[10:12], m.SenderTSBPDDelay)
+	return b
+}
@@ -43,6 +43,8 @@
 // (CIF).
 package packets
 
+import "fmt"
+
 type KeepAliveControl struct {
 	PacketType              uint8  // value = 1.  The packet type value of a keep-alive control packet is "1"
 	ControlType             uint16 // 15 bits, value = KEEPALIVE{0x0001}.  The control type value of a keep-alive control packet is "1".
@@ -51,3 +53,31 @@ type KeepAliveControl struct {
 	Timestamp               uint32 // 32 bits.  See Section 3.
 	DestinationSocketID     uint32 // 32 bits.  See Section 3.
 }
+
+// ParseKeepAliveControl decodes a keep-alive from its control packet.
+func ParseKeepAliveControl(c *Control) (*KeepAliveControl, error) {
+	if c.ControlType != KEEPALIVE {
+		return nil, fmt.Errorf("not a keep-alive packet: control type %d", c.ControlType)
+	}
+
+	return &KeepAliveControl{
+		PacketType:              1,
+		ControlType:             uint16(KEEPALIVE),
+		TypeSpecificInformation: c.TypeSpecificInfo,
+		Timestamp:               c.Timestamp,
+		DestinationSocketID:     c.DestinationSocketID,
+	}, nil
+}
+
+// Marshal encodes the keep-alive control packet. Like the ACKACK, it is
+// sent with a single zero word of CIF.
+func (k *KeepAliveControl) Marshal() []byte {
+	c := Control{
+		ControlType:             KEEPALIVE,
+		TypeSpecificInfo:        k.TypeSpecificInformation,
+		Timestamp:               k.Timestamp,
+		DestinationSocketID:     k.DestinationSocketID,
+		ControlInformationField: make([]byte, 4),
+	}
+	return c.Marshal()
+}
@@ -165,6 +165,11 @@
 
 package packets
 
+import (
+	"encoding/binary"
+	"fmt"
+)
+
 type KeyMaterialPacketType byte
 
 const (
@@ -225,3 +230,60 @@ type KeyMaterialMessage struct {
 	Xsek                  []byte                         // variable width, identifies an odd or even SEK
 	Osek                  []byte                         // variable width, identifies an odd SEK
 }
+
+// KeyMaterialSignature is the Sign field of every Key Material message.
+const KeyMaterialSignature = 0x2029
+
+// keyMaterialHeaderSize is the size of the fields before the Salt.
+const keyMaterialHeaderSize = 16
+
+// icvSize is the size of the AES key wrap Integrity Check Vector.
+const icvSize = 8
+
+// ParseKeyMaterialMessage decodes the contents of a KMREQ or KMRSP
+// extension, or of a key-refresh control packet.
+func ParseKeyMaterialMessage(data []byte) (*KeyMaterialMessage, error) {
+	if len(data) < keyMaterialHeaderSize {
+		return nil, fmt.Errorf("key material message too short: %d bytes (minimum %d)", len(data), keyMaterialHeaderSize)
+	}
+
+	km := &KeyMaterialMessage{
+		S:                     data[0] >> 7,
+		Version:               (data[0] >> 4) & 0x07,
+		PacketType:            KeyMaterialPacketType(data[0] & 0x0F),
+		Sign:                  binary.BigEndian.Uint16(data[1:3]),
+		Resv1:                 data[3] >> 2,
+		KeyBasedEncryption:    data[3] & 0x03,
+		KeyEncryptionKeyIndex: binary.BigEndian.Uint32(data[4:8]),
+		Cipher:                KeyMaterialCipher(data[8]),
+		Authentication:        KeyMaterialAuthentication(data[9]),
+		StreamEncapsulation:   KeyMaterialStreamEncapsulation(data[10]),
+		Resv2:                 data[11],
+		Resv3:                 binary.BigEndian.Uint16(data[12:14]),
+		SaltLength:            data[14],
+		KeyLength:             data[15],
+	}
+	if km.Sign != KeyMaterialSignature {
+		return nil, fmt.Errorf("key material message with signature %04x", km.Sign)
+	}
+
+	saltEnd := keyMaterialHeaderSize + int(km.SaltLength)*4
+	keys := 1
+	if KeyBasedEncryption(km.KeyBasedEncryption) == BothKeys {
+		keys = 2
+	}
+	keySize := int(km.KeyLength) * 4
+	end := saltEnd + icvSize + keys*keySize
+	if len(data) < end {
+		return nil, fmt.Errorf("key material message truncated: need %d bytes, have %d", end, len(data))
+	}
+
+	km.Salt = data[keyMaterialHeaderSize:saltEnd]
+	km.Wrap = data[saltEnd:end]
+	km.IntegrityCheckVector = km.Wrap[:icvSize]
+	km.Xsek = km.Wrap[icvSize : icvSize+keySize]
+	if keys == 2 {
+		km.Osek = km.Wrap[icvSize+keySize:]
+	}
+	return km, nil
+}
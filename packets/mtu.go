@@ -0,0 +1,17 @@
+package packets
+
+// The maximum transmission unit exchanged in the handshake is the size of
+// the largest IP packet, headers included, either peer may send.
+const (
+	// MTUOverhead is the size of the IPv4 and UDP headers.
+	MTUOverhead = 28
+
+	// MinMTU is the smallest MTU a connection may use, as in libsrt.
+	MinMTU = 76
+)
+
+// MaxPayloadSize returns the largest data packet payload fitting in the
+// given MTU.
+func MaxPayloadSize(mtu int) int {
+	return mtu - MTUOverhead - MinPacketSize
+}
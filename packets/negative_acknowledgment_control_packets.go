@@ -51,6 +51,13 @@
 //	Appendix A.
 package packets
 
+import (
+	"encoding/binary"
+	"fmt"
+
+	"coresrt/seqno"
+)
+
 type NegativeAcknowledgmentControlPacket struct {
 	PacketType              uint8    // value = 1.  The packet type value of a NAK control packet is "1"
 	ControlType             uint16   // value = NAK{0x0003}.  The control type value of a NAK control packet is "3"
@@ -60,3 +67,59 @@ type NegativeAcknowledgmentControlPacket struct {
 	DestinationSocketID     uint32   // See Section 3.
 	ControlInformationField []uint32 // Control Information Field (CIF).  A single value or a range of lost packets sequence numbers.
 }
+
+// LossRange is an inclusive range of lost packet sequence numbers.
+type LossRange = seqno.Range
+
+// ParseNegativeAcknowledgmentControlPacket decodes a NAK from its control
+// packet.
+func ParseNegativeAcknowledgmentControlPacket(c *Control) (*NegativeAcknowledgmentControlPacket, error) {
+	if c.ControlType != NAK {
+		return nil, fmt.Errorf("not a NAK packet: control type %d", c.ControlType)
+	}
+	cif := c.ControlInformationField
+	if len(cif)%4 != 0 {
+		return nil, fmt.Errorf("NAK loss list is not word aligned: %d bytes", len(cif))
+	}
+
+	words := make([]uint32, len(cif)/4)
+	for i := range words {
+		words[i] = binary.BigEndian.Uint32(cif[i*4:])
+	}
+
+	return &NegativeAcknowledgmentControlPacket{
+		PacketType:              1,
+		ControlType:             uint16(NAK),
+		TypeSpecificInformation: c.TypeSpecificInfo,
+		Timestamp:               c.Timestamp,
+		DestinationSocketID:     c.DestinationSocketID,
+		ControlInformationField: words,
+	}, nil
+}
+
+// Marshal encodes the NAK control packet.
+func (n *NegativeAcknowledgmentControlPacket) Marshal() []byte {
+	cif := make([]byte, len(n.ControlInformationField)*4)
+	for i, w := range n.ControlInformationField {
+		binary.BigEndian.PutUint32(cif[i*4:], w)
+	}
+
+	c := Control{
+		ControlType:             NAK,
+		TypeSpecificInfo:        n.TypeSpecificInformation,
+		Timestamp:               n.Timestamp,
+		DestinationSocketID:     n.DestinationSocketID,
+		ControlInformationField: cif,
+	}
+	return c.Marshal()
+}
+
+// LossRanges decodes the loss list (Appendix A) into ranges.
+func (n *NegativeAcknowledgmentControlPacket) LossRanges() ([]LossRange, error) {
+	return seqno.DecodeLossList(n.ControlInformationField)
+}
+
+// EncodeLossList encodes ranges into the loss list coding of Appendix A.
+func EncodeLossList(ranges []LossRange) []uint32 {
+	return seqno.EncodeLossList(ranges)
+}
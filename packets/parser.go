@@ -1,5 +1,7 @@
 package packets
 
+import "fmt"
+
 // MinPacketSize is the minimum size of an SRT packet (16 bytes header).
 const MinPacketSize = 16
 
@@ -9,13 +11,15 @@ func isControlPacket(data []byte) bool {
 	return data[0]&0x80 != 0
 }
 
-// func ParsePacket(data []byte) (interface{}, error) {
-// 	if len(data) < MinPacketSize {
-// 		return nil, fmt.Errorf("packet too short: %d bytes (minimum %d)", len(data), MinPacketSize)
-// 	}
+// ParsePacket decodes a datagram into either a *Data or a *Control packet
+// depending on the packet type flag.
+func ParsePacket(data []byte) (interface{}, error) {
+	if len(data) < MinPacketSize {
+		return nil, fmt.Errorf("packet too short: %d bytes (minimum %d)", len(data), MinPacketSize)
+	}
 
-// 	if isControlPacket(data) {
-// 		return ParseControlPacket(data)
-// 	}
-// 	return ParseDataPacket(data)
-// }
+	if isControlPacket(data) {
+		return ParseControlPacket(data)
+	}
+	return ParseDataPacket(data)
+}
@@ -39,6 +39,8 @@
 // Destination Socket ID: 32 bits.  See Section 3.
 package packets
 
+import "fmt"
+
 const (
 	FileSystemErrorCode = 4000 // Error code for file system error
 )
@@ -49,3 +51,30 @@ type PeerErrorControlPacket struct {
 	Timestamp   uint32 // Timestamp
 	DstSocketID uint32 // Destination Socket ID
 }
+
+// ParsePeerErrorControlPacket decodes a Peer Error from its control
+// packet. The error code travels in the Type-specific Information field.
+func ParsePeerErrorControlPacket(c *Control) (*PeerErrorControlPacket, error) {
+	if c.ControlType != PEERERROR {
+		return nil, fmt.Errorf("not a peer error packet: control type %d", c.ControlType)
+	}
+
+	return &PeerErrorControlPacket{
+		ControlType: uint16(PEERERROR),
+		ErrorCode:   c.TypeSpecificInfo,
+		Timestamp:   c.Timestamp,
+		DstSocketID: c.DestinationSocketID,
+	}, nil
+}
+
+// Marshal encodes the Peer Error control packet.
+func (p *PeerErrorControlPacket) Marshal() []byte {
+	c := Control{
+		ControlType:             PEERERROR,
+		TypeSpecificInfo:        p.ErrorCode,
+		Timestamp:               p.Timestamp,
+		DestinationSocketID:     p.DstSocketID,
+		ControlInformationField: make([]byte, 4),
+	}
+	return c.Marshal()
+}
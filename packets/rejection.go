@@ -0,0 +1,98 @@
+//    Handshake Rejection Reason Codes
+
+//    A listener rejecting a connection responds to the Conclusion with
+//    one of these codes in the Handshake Type field (Table 7).
+
+//    +======+================+=========================================+
+//    | Code | Error          | Description                             |
+//    +======+================+=========================================+
+//    | 1000 | REJ_UNKNOWN    | Unknown reason                          |
+//    | 1001 | REJ_SYSTEM     | System function error                   |
+//    | 1002 | REJ_PEER       | Rejected by peer                        |
+//    | 1003 | REJ_RESOURCE   | Resource allocation problem             |
+//    | 1004 | REJ_ROGUE      | incorrect data in handshake             |
+//    | 1005 | REJ_BACKLOG    | listener's backlog exceeded             |
+//    | 1006 | REJ_IPE        | internal program error                  |
+//    | 1007 | REJ_CLOSE      | socket is closing                       |
+//    | 1008 | REJ_VERSION    | peer is older version than agent's min  |
+//    | 1009 | REJ_RDVCOOKIE  | rendezvous cookie collision             |
+//    | 1010 | REJ_BADSECRET  | wrong password                          |
+//    | 1011 | REJ_UNSECURE   | password required or unexpected         |
+//    | 1012 | REJ_MESSAGEAPI | Stream flag collision                   |
+//    | 1013 | REJ_CONGESTION | incompatible congestion-controller type |
+//    | 1014 | REJ_FILTER     | incompatible packet filter              |
+//    | 1015 | REJ_GROUP      | incompatible group                      |
+//    +======+================+=========================================+
+
+package packets
+
+import "fmt"
+
+// RejectReason is the code of a rejected handshake. It is an error, so
+// that a caller can tell why it was rejected with errors.Is:
+//
+//	if errors.Is(err, packets.RejectFilter) { ... }
+type RejectReason uint32
+
+const (
+	RejectUnknown    RejectReason = 1000 // REJ_UNKNOWN
+	RejectSystem     RejectReason = 1001 // REJ_SYSTEM
+	RejectPeer       RejectReason = 1002 // REJ_PEER
+	RejectResource   RejectReason = 1003 // REJ_RESOURCE
+	RejectRogue      RejectReason = 1004 // REJ_ROGUE
+	RejectBacklog    RejectReason = 1005 // REJ_BACKLOG
+	RejectIPE        RejectReason = 1006 // REJ_IPE
+	RejectClose      RejectReason = 1007 // REJ_CLOSE
+	RejectVersion    RejectReason = 1008 // REJ_VERSION
+	RejectRdvCookie  RejectReason = 1009 // REJ_RDVCOOKIE
+	RejectBadSecret  RejectReason = 1010 // REJ_BADSECRET
+	RejectUnsecure   RejectReason = 1011 // REJ_UNSECURE
+	RejectMessageAPI RejectReason = 1012 // REJ_MESSAGEAPI
+	RejectCongestion RejectReason = 1013 // REJ_CONGESTION
+	RejectFilter     RejectReason = 1014 // REJ_FILTER
+	RejectGroup      RejectReason = 1015 // REJ_GROUP
+)
+
+var rejectReasons = map[RejectReason]struct{ name, description string }{
+	RejectUnknown:    {"REJ_UNKNOWN", "unknown reason"},
+	RejectSystem:     {"REJ_SYSTEM", "system function error"},
+	RejectPeer:       {"REJ_PEER", "rejected by peer"},
+	RejectResource:   {"REJ_RESOURCE", "resource allocation problem"},
+	RejectRogue:      {"REJ_ROGUE", "incorrect data in handshake"},
+	RejectBacklog:    {"REJ_BACKLOG", "listener's backlog exceeded"},
+	RejectIPE:        {"REJ_IPE", "internal program error"},
+	RejectClose:      {"REJ_CLOSE", "socket is closing"},
+	RejectVersion:    {"REJ_VERSION", "peer is older version than agent's minimum"},
+	RejectRdvCookie:  {"REJ_RDVCOOKIE", "rendezvous cookie collision"},
+	RejectBadSecret:  {"REJ_BADSECRET", "wrong password"},
+	RejectUnsecure:   {"REJ_UNSECURE", "password required or unexpected"},
+	RejectMessageAPI: {"REJ_MESSAGEAPI", "stream flag collision"},
+	RejectCongestion: {"REJ_CONGESTION", "incompatible congestion-controller type"},
+	RejectFilter:     {"REJ_FILTER", "incompatible packet filter"},
+	RejectGroup:      {"REJ_GROUP", "incompatible group"},
+}
+
+// String returns the name of the code in the specification, such as
+// REJ_FILTER.
+func (r RejectReason) String() string {
+	if reason, ok := rejectReasons[r]; ok {
+		return reason.name
+	}
+	return fmt.Sprintf("REJ(%d)", uint32(r))
+}
+
+func (r RejectReason) Error() string {
+	if reason, ok := rejectReasons[r]; ok {
+		return fmt.Sprintf("connection rejected: %s (%s)", reason.description, reason.name)
+	}
+	return fmt.Sprintf("connection rejected: code %d", uint32(r))
+}
+
+// RejectReason returns the rejection code held by a handshake type, if
+// it is one. Codes from 2000 are left to applications.
+func (t HandshakeType) RejectReason() (RejectReason, bool) {
+	if t >= HandshakeType(RejectUnknown) && t < Done {
+		return RejectReason(t), true
+	}
+	return 0, false
+}
@@ -36,9 +36,37 @@
 // (CIF).
 package packets
 
+import "fmt"
+
 type ShutdownControlPacket struct {
 	ControlPacketType          // 1 bit, value = 1
 	ControlType         uint16 // 15 bits, value = SHUTDOWN{0x0005} value = 5
 	Timestamp           uint32 // 32 bits
 	DestinationSocketID uint32 // 32 bits
 }
+
+// ParseShutdownControlPacket decodes a SHUTDOWN from its control packet.
+func ParseShutdownControlPacket(c *Control) (*ShutdownControlPacket, error) {
+	if c.ControlType != SHUTDOWN {
+		return nil, fmt.Errorf("not a shutdown packet: control type %d", c.ControlType)
+	}
+
+	return &ShutdownControlPacket{
+		ControlPacketType:   1,
+		ControlType:         uint16(SHUTDOWN),
+		Timestamp:           c.Timestamp,
+		DestinationSocketID: c.DestinationSocketID,
+	}, nil
+}
+
+// Marshal encodes the SHUTDOWN control packet, with a single zero word of
+// CIF like the ACKACK.
+func (s *ShutdownControlPacket) Marshal() []byte {
+	c := Control{
+		ControlType:             SHUTDOWN,
+		Timestamp:               s.Timestamp,
+		DestinationSocketID:     s.DestinationSocketID,
+		ControlInformationField: make([]byte, 4),
+	}
+	return c.Marshal()
+}
@@ -32,6 +32,41 @@
 
 package packets
 
+import (
+	"bytes"
+	"fmt"
+)
+
 type StreamIdExtensionMessage struct {
 	StreamID string
 }
+
+// MaxStreamIDSize is the maximum allowed size of the Stream ID.
+const MaxStreamIDSize = 512
+
+// ParseStreamIdExtensionMessage decodes SRT_CMD_SID extension contents,
+// swapping each 32-bit little endian word and trimming the zero padding.
+func ParseStreamIdExtensionMessage(data []byte) (*StreamIdExtensionMessage, error) {
+	if len(data) > MaxStreamIDSize {
+		return nil, fmt.Errorf("stream id too long: %d bytes (maximum %d)", len(data), MaxStreamIDSize)
+	}
+
+	b := swapWords(data)
+	return &StreamIdExtensionMessage{StreamID: string(bytes.TrimRight(b, "\x00"))}, nil
+}
+
+// Marshal encodes the Stream ID as zero padded little endian words.
+func (s *StreamIdExtensionMessage) Marshal() []byte {
+	b := make([]byte, (len(s.StreamID)+3)/4*4)
+	copy(b, s.StreamID)
+	return swapWords(b)
+}
+
+func swapWords(data []byte) []byte {
+	b := make([]byte, (len(data)+3)/4*4)
+	copy(b, data)
+	for i := 0; i < len(b); i += 4 {
+		b[i], b[i+1], b[i+2], b[i+3] = b[i+3], b[i+2], b[i+1], b[i]
+	}
+	return b
+}
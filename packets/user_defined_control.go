@@ -0,0 +1,64 @@
+//    User-Defined Control Packets
+
+//    Before HSv5, the SRT extensions were not carried by the handshake:
+//    once connected, an HSv4 caller sends its SRT_CMD_HSREQ, and its
+//    SRT_CMD_KMREQ if encrypted, in control packets of the User-Defined
+//    Type (0x7FFF), with the extension type in the Subtype field of the
+//    header and the extension contents as CIF.  The peer answers with
+//    SRT_CMD_HSRSP and SRT_CMD_KMRSP the same way.  The caller repeats its
+//    requests until answered.
+
+//    In this legacy exchange, the TSBPD delay of the HSREQ and HSRSP is
+//    the lower 16 bits of their third word, the Sender TSBPD Delay of
+//    HSv5.
+
+//    Later versions still use these packets for key material refreshes.
+
+package packets
+
+import "fmt"
+
+// KeyMaterialState is the single word of a KMRSP refusing the key
+// material.
+type KeyMaterialState uint32
+
+const (
+	KMUnsecured KeyMaterialState = 0 // SRT_KM_S_UNSECURED
+	KMSecuring  KeyMaterialState = 1 // SRT_KM_S_SECURING
+	KMSecured   KeyMaterialState = 2 // SRT_KM_S_SECURED
+	KMNoSecret  KeyMaterialState = 3 // SRT_KM_S_NOSECRET, no passphrase on this side
+	KMBadSecret KeyMaterialState = 4 // SRT_KM_S_BADSECRET
+)
+
+type UserDefinedControlPacket struct {
+	Subtype             ExtensionType // SRT_CMD_HSREQ to SRT_CMD_KMRSP
+	Timestamp           uint32
+	DestinationSocketID uint32
+	Contents            []byte // of the extension
+}
+
+// ParseUserDefinedControlPacket decodes an extension message carried by
+// a user-defined control packet.
+func ParseUserDefinedControlPacket(c *Control) (*UserDefinedControlPacket, error) {
+	if c.ControlType != UserDefinedType {
+		return nil, fmt.Errorf("not a user-defined packet: control type %d", c.ControlType)
+	}
+
+	return &UserDefinedControlPacket{
+		Subtype:             ExtensionType(c.Subtype),
+		Timestamp:           c.Timestamp,
+		DestinationSocketID: c.DestinationSocketID,
+		Contents:            c.ControlInformationField,
+	}, nil
+}
+
+func (u *UserDefinedControlPacket) Marshal() []byte {
+	c := Control{
+		ControlType:             UserDefinedType,
+		Subtype:                 ControlPacketType(u.Subtype),
+		Timestamp:               u.Timestamp,
+		DestinationSocketID:     u.DestinationSocketID,
+		ControlInformationField: u.Contents,
+	}
+	return c.Marshal()
+}
@@ -0,0 +1,56 @@
+//    SRT Version
+
+//    The SRT Version field of the HSREQ and HSRSP extensions holds the
+//    version of the SRT library of each peer, formed as
+//    major * 0x10000 + minor * 0x100 + patch.  Features that appeared in
+//    later versions are only used when the peer is at least that recent.
+
+package packets
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is an SRT library version, 0x00MMmmpp. Versions compare with
+// the usual operators.
+type Version uint32
+
+// Oldest versions supporting each feature.
+const (
+	MinVersionStreamID Version = 0x010300 // SRT_CMD_SID, with HSv5
+	MinVersionFilter   Version = 0x010400 // SRT_CMD_FILTER
+	MinVersionGroup    Version = 0x010500 // SRT_CMD_GROUP
+)
+
+// MakeVersion returns the version major.minor.patch.
+func MakeVersion(major, minor, patch uint8) Version {
+	return Version(major)<<16 | Version(minor)<<8 | Version(patch)
+}
+
+// ParseVersion parses a version such as "1.4.2". The patch, and the minor
+// version with it, may be left out.
+func ParseVersion(s string) (Version, error) {
+	fields := strings.Split(s, ".")
+	if len(fields) > 3 {
+		return 0, fmt.Errorf("invalid SRT version %q", s)
+	}
+	var parts [3]uint8
+	for i, f := range fields {
+		n, err := strconv.ParseUint(f, 10, 8)
+		if err != nil {
+			return 0, fmt.Errorf("invalid SRT version %q", s)
+		}
+		parts[i] = uint8(n)
+	}
+	return MakeVersion(parts[0], parts[1], parts[2]), nil
+}
+
+func (v Version) Major() uint8 { return uint8(v >> 16) }
+func (v Version) Minor() uint8 { return uint8(v >> 8) }
+func (v Version) Patch() uint8 { return uint8(v) }
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major(), v.Minor(), v.Patch())
+}
@@ -0,0 +1,72 @@
+package packets_test
+
+import (
+	"testing"
+
+	"coresrt/packets"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		s    string
+		want packets.Version
+		ok   bool
+	}{
+		{"1.4.2", 0x010402, true},
+		{"1.5", 0x010500, true},
+		{"2", 0x020000, true},
+		{"255.255.255", 0xFFFFFF, true},
+		{"0.0.0", 0, true},
+		{"", 0, false},
+		{"1.2.3.4", 0, false},
+		{"1.256.0", 0, false},
+		{"1..2", 0, false},
+		{"1.4.", 0, false},
+		{"-1.4.2", 0, false},
+		{"v1.4.2", 0, false},
+		{" 1.4.2", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := packets.ParseVersion(tt.s)
+		switch {
+		case tt.ok && err != nil:
+			t.Errorf("ParseVersion(%q): %v", tt.s, err)
+		case !tt.ok && err == nil:
+			t.Errorf("ParseVersion(%q) = %s, want an error", tt.s, got)
+		case got != tt.want:
+			t.Errorf("ParseVersion(%q) = %06x, want %06x", tt.s, uint32(got), uint32(tt.want))
+		}
+	}
+}
+
+func TestVersion(t *testing.T) {
+	v := packets.MakeVersion(1, 4, 2)
+	if v.Major() != 1 || v.Minor() != 4 || v.Patch() != 2 {
+		t.Errorf("MakeVersion(1, 4, 2) is %d.%d.%d", v.Major(), v.Minor(), v.Patch())
+	}
+	if s := v.String(); s != "1.4.2" {
+		t.Errorf("String() = %q, want 1.4.2", s)
+	}
+	if s := packets.MakeVersion(1, 10, 255).String(); s != "1.10.255" {
+		t.Errorf("String() = %q, want 1.10.255", s)
+	}
+
+	// each part outweighs all the parts after it
+	ordered := []packets.Version{
+		packets.MakeVersion(0, 0, 0),
+		packets.MakeVersion(0, 255, 255),
+		packets.MakeVersion(1, 2, 255),
+		packets.MinVersionStreamID,
+		packets.MinVersionFilter,
+		packets.MakeVersion(1, 4, 9),
+		packets.MakeVersion(1, 4, 10),
+		packets.MinVersionGroup,
+		packets.MakeVersion(1, 10, 0),
+		packets.MakeVersion(2, 0, 0),
+	}
+	for i := 1; i < len(ordered); i++ {
+		if a, b := ordered[i-1], ordered[i]; !(a < b) {
+			t.Errorf("%s is not older than %s", a, b)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+// Package pcap reads the packets of pcap and pcapng capture files, such as
+// written by tcpdump and Wireshark, and extracts the UDP datagrams they
+// carry.
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Link types of the captured frames.
+const (
+	LinkNull      = 0   // BSD loopback, with a host byte order protocol family
+	LinkEthernet  = 1   // Ethernet II, possibly VLAN tagged
+	LinkRaw       = 101 // raw IPv4 or IPv6
+	LinkLinuxSLL  = 113 // Linux "any" device
+	LinkIPv4      = 228
+	LinkIPv6      = 229
+	LinkLinuxSLL2 = 276
+)
+
+const (
+	pcapMagic      = 0xA1B2C3D4 // microsecond timestamps
+	pcapMagicNano  = 0xA1B23C4D // nanosecond timestamps
+	pcapngMagic    = 0x0A0D0D0A // Section Header Block type
+	byteOrderMagic = 0x1A2B3C4D
+
+	blockInterface = 0x00000001
+	blockSimple    = 0x00000003
+	blockEnhanced  = 0x00000006
+	optionEnd      = 0
+	optionTSResol  = 9
+	maxBlockSize   = 16 << 20
+)
+
+// Packet is a captured frame.
+type Packet struct {
+	Time     time.Time
+	LinkType uint32
+	Data     []byte
+}
+
+// Reader reads the packets of a pcap or pcapng capture.
+type Reader struct {
+	r      *bufio.Reader
+	ng     bool
+	order  binary.ByteOrder
+	nano   bool // pcap: nanosecond timestamps
+	link   uint32
+	ifaces []iface // pcapng: interfaces of the current section
+}
+
+type iface struct {
+	linkType uint32
+	tsUnit   time.Duration // duration of a timestamp unit
+}
+
+// NewReader reads the file header and tells a pcap capture from a pcapng
+// one.
+func NewReader(r io.Reader) (*Reader, error) {
+	pr := &Reader{r: bufio.NewReader(r)}
+	magic, err := pr.r.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("reading capture header: %w", err)
+	}
+
+	if binary.LittleEndian.Uint32(magic) == pcapngMagic {
+		pr.ng = true
+		return pr, nil
+	}
+
+	var hdr [24]byte
+	if _, err := io.ReadFull(pr.r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("reading pcap header: %w", err)
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(hdr[0:4]) {
+		case pcapMagic:
+			pr.order = order
+		case pcapMagicNano:
+			pr.order, pr.nano = order, true
+		default:
+			continue
+		}
+		pr.link = order.Uint32(hdr[20:24]) & 0x0FFFFFFF
+		return pr, nil
+	}
+	return nil, errors.New("not a pcap or pcapng capture")
+}
+
+// Next returns the next packet, or io.EOF at the end of the capture.
+func (r *Reader) Next() (Packet, error) {
+	if r.ng {
+		return r.nextBlock()
+	}
+
+	var hdr [16]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return Packet{}, fmt.Errorf("truncated pcap record header")
+		}
+		return Packet{}, err
+	}
+	sec := int64(r.order.Uint32(hdr[0:4]))
+	frac := int64(r.order.Uint32(hdr[4:8]))
+	capLen := r.order.Uint32(hdr[8:12])
+	if capLen > maxBlockSize {
+		return Packet{}, fmt.Errorf("pcap record of %d bytes", capLen)
+	}
+	data := make([]byte, capLen)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return Packet{}, fmt.Errorf("truncated pcap record: %w", err)
+	}
+	if !r.nano {
+		frac *= 1000
+	}
+	return Packet{Time: time.Unix(sec, frac), LinkType: r.link, Data: data}, nil
+}
+
+// nextBlock reads pcapng blocks until one holds a packet.
+func (r *Reader) nextBlock() (Packet, error) {
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return Packet{}, fmt.Errorf("truncated pcapng block header")
+			}
+			return Packet{}, err
+		}
+
+		if binary.LittleEndian.Uint32(hdr[0:4]) == pcapngMagic {
+			// a new section, which may change the byte order
+			var bom [4]byte
+			if _, err := io.ReadFull(r.r, bom[:]); err != nil {
+				return Packet{}, fmt.Errorf("truncated pcapng section header: %w", err)
+			}
+			switch {
+			case binary.LittleEndian.Uint32(bom[:]) == byteOrderMagic:
+				r.order = binary.LittleEndian
+			case binary.BigEndian.Uint32(bom[:]) == byteOrderMagic:
+				r.order = binary.BigEndian
+			default:
+				return Packet{}, errors.New("pcapng section header with invalid byte order magic")
+			}
+			r.ifaces = nil
+			length := r.order.Uint32(hdr[4:8])
+			if length < 16 || length > maxBlockSize {
+				return Packet{}, fmt.Errorf("pcapng section header of %d bytes", length)
+			}
+			if _, err := r.r.Discard(int(length) - 12); err != nil {
+				return Packet{}, fmt.Errorf("truncated pcapng section header: %w", err)
+			}
+			continue
+		}
+		if r.order == nil {
+			return Packet{}, errors.New("pcapng block before the section header")
+		}
+
+		typ := r.order.Uint32(hdr[0:4])
+		length := r.order.Uint32(hdr[4:8])
+		if length < 12 || length%4 != 0 || length > maxBlockSize {
+			return Packet{}, fmt.Errorf("pcapng block of %d bytes", length)
+		}
+		body := make([]byte, length-8)
+		if _, err := io.ReadFull(r.r, body); err != nil {
+			return Packet{}, fmt.Errorf("truncated pcapng block: %w", err)
+		}
+		body = body[:len(body)-4] // trailing block length
+
+		switch typ {
+		case blockInterface:
+			if len(body) < 8 {
+				return Packet{}, errors.New("pcapng interface description too short")
+			}
+			r.ifaces = append(r.ifaces, iface{
+				linkType: uint32(r.order.Uint16(body[0:2])),
+				tsUnit:   r.timestampUnit(body[8:]),
+			})
+		case blockEnhanced:
+			if len(body) < 20 {
+				return Packet{}, errors.New("pcapng enhanced packet block too short")
+			}
+			id := r.order.Uint32(body[0:4])
+			if int(id) >= len(r.ifaces) {
+				return Packet{}, fmt.Errorf("pcapng packet on unknown interface %d", id)
+			}
+			ifc := r.ifaces[id]
+			ts := uint64(r.order.Uint32(body[4:8]))<<32 | uint64(r.order.Uint32(body[8:12]))
+			capLen := r.order.Uint32(body[12:16])
+			if int(capLen) > len(body)-20 {
+				return Packet{}, fmt.Errorf("pcapng packet of %d bytes in a block of %d", capLen, len(body))
+			}
+			return Packet{
+				Time:     time.Unix(0, 0).Add(time.Duration(ts) * ifc.tsUnit),
+				LinkType: ifc.linkType,
+				Data:     body[20 : 20+capLen],
+			}, nil
+		case blockSimple:
+			if len(body) < 4 || len(r.ifaces) == 0 {
+				return Packet{}, errors.New("invalid pcapng simple packet block")
+			}
+			origLen := r.order.Uint32(body[0:4])
+			data := body[4:]
+			if int(origLen) < len(data) {
+				data = data[:origLen]
+			}
+			// simple packets carry no timestamp
+			return Packet{LinkType: r.ifaces[0].linkType, Data: data}, nil
+		}
+		// other blocks, such as name resolution or statistics, are skipped
+	}
+}
+
+// timestampUnit reads the if_tsresol option of an interface description.
+func (r *Reader) timestampUnit(opts []byte) time.Duration {
+	unit := time.Microsecond
+	for len(opts) >= 4 {
+		code := r.order.Uint16(opts[0:2])
+		length := int(r.order.Uint16(opts[2:4]))
+		if code == optionEnd || 4+length > len(opts) {
+			break
+		}
+		if code == optionTSResol && length >= 1 {
+			v := opts[4]
+			if v&0x80 == 0 && v <= 9 {
+				unit = time.Second
+				for i := byte(0); i < v; i++ {
+					unit /= 10
+				}
+			}
+			// binary resolutions are rare, and kept as microseconds
+		}
+		opts = opts[4+(length+3)/4*4:]
+	}
+	return unit
+}
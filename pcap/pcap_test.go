@@ -0,0 +1,253 @@
+package pcap_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"slices"
+	"testing"
+	"time"
+
+	"coresrt/pcap"
+)
+
+// byteOrder is the byte order of a capture built by a test.
+type byteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// record is a packet of a capture built by a test.
+type record struct {
+	time time.Time
+	data []byte
+}
+
+// pcapFile returns a pcap capture of link type link.
+func pcapFile(order byteOrder, nano bool, link uint32, records ...record) []byte {
+	magic := uint32(0xA1B2C3D4)
+	if nano {
+		magic = 0xA1B23C4D
+	}
+	b := order.AppendUint32(nil, magic)
+	b = order.AppendUint16(b, 2)
+	b = order.AppendUint16(b, 4)
+	b = append(b, make([]byte, 8)...) // time zone and accuracy
+	b = order.AppendUint32(b, 65535)
+	b = order.AppendUint32(b, link)
+	for _, r := range records {
+		frac := r.time.Nanosecond() / 1000
+		if nano {
+			frac = r.time.Nanosecond()
+		}
+		b = order.AppendUint32(b, uint32(r.time.Unix()))
+		b = order.AppendUint32(b, uint32(frac))
+		b = order.AppendUint32(b, uint32(len(r.data)))
+		b = order.AppendUint32(b, uint32(len(r.data)))
+		b = append(b, r.data...)
+	}
+	return b
+}
+
+// block returns a pcapng block, its body padded to 32 bits.
+func block(order byteOrder, typ uint32, body []byte) []byte {
+	body = append(slices.Clone(body), make([]byte, -len(body)&3)...)
+	b := order.AppendUint32(nil, typ)
+	b = order.AppendUint32(b, uint32(12+len(body)))
+	b = append(b, body...)
+	return order.AppendUint32(b, uint32(12+len(body)))
+}
+
+func sectionHeader(order byteOrder) []byte {
+	body := order.AppendUint32(nil, 0x1A2B3C4D)
+	body = order.AppendUint16(body, 1)
+	body = order.AppendUint16(body, 0)
+	body = append(body, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF) // unknown section length
+	return block(order, 0x0A0D0D0A, body)
+}
+
+// interfaceDescription returns an interface of link type link, with an
+// if_tsresol option unless tsresol is negative.
+func interfaceDescription(order byteOrder, link uint16, tsresol int) []byte {
+	body := order.AppendUint16(nil, link)
+	body = order.AppendUint16(body, 0)
+	body = order.AppendUint32(body, 65535)
+	if tsresol >= 0 {
+		body = order.AppendUint16(body, 9)
+		body = order.AppendUint16(body, 1)
+		body = append(body, byte(tsresol), 0, 0, 0)
+		body = append(body, 0, 0, 0, 0) // opt_endofopt
+	}
+	return block(order, 1, body)
+}
+
+func enhancedPacket(order byteOrder, iface uint32, ts uint64, data []byte) []byte {
+	body := order.AppendUint32(nil, iface)
+	body = order.AppendUint32(body, uint32(ts>>32))
+	body = order.AppendUint32(body, uint32(ts))
+	body = order.AppendUint32(body, uint32(len(data)))
+	body = order.AppendUint32(body, uint32(len(data)))
+	return block(order, 6, append(body, data...))
+}
+
+func simplePacket(order byteOrder, data []byte) []byte {
+	return block(order, 3, append(order.AppendUint32(nil, uint32(len(data))), data...))
+}
+
+// readAll returns the packets of a capture.
+func readAll(t *testing.T, capture []byte) []pcap.Packet {
+	t.Helper()
+	r, err := pcap.NewReader(bytes.NewReader(capture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pkts []pcap.Packet
+	for {
+		p, err := r.Next()
+		if err == io.EOF {
+			return pkts
+		}
+		if err != nil {
+			t.Fatalf("packet %d: %v", len(pkts), err)
+		}
+		pkts = append(pkts, p)
+	}
+}
+
+func checkPackets(t *testing.T, got, want []pcap.Packet) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%d packets, want %d", len(got), len(want))
+	}
+	for i := range got {
+		g, w := got[i], want[i]
+		if !g.Time.Equal(w.Time) || g.LinkType != w.LinkType || !bytes.Equal(g.Data, w.Data) {
+			t.Errorf("packet %d: %v link %d %x, want %v link %d %x", i, g.Time, g.LinkType, g.Data, w.Time, w.LinkType, w.Data)
+		}
+	}
+}
+
+func TestReadPcap(t *testing.T) {
+	t1 := time.Unix(1700000000, 123456000)
+	t2 := time.Unix(1700000001, 789000)
+	tests := []struct {
+		name  string
+		order byteOrder
+		nano  bool
+		t2    time.Time
+	}{
+		{"little endian", binary.LittleEndian, false, t2},
+		{"big endian", binary.BigEndian, false, t2},
+		{"nanoseconds", binary.LittleEndian, true, t2.Add(321 * time.Nanosecond)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			capture := pcapFile(tt.order, tt.nano, pcap.LinkEthernet,
+				record{t1, []byte{1, 2, 3}}, record{tt.t2, nil})
+			checkPackets(t, readAll(t, capture), []pcap.Packet{
+				{Time: t1, LinkType: pcap.LinkEthernet, Data: []byte{1, 2, 3}},
+				{Time: tt.t2, LinkType: pcap.LinkEthernet, Data: []byte{}},
+			})
+		})
+	}
+}
+
+func TestReadPcapng(t *testing.T) {
+	le, be := binary.LittleEndian, binary.BigEndian
+	var capture []byte
+	for _, b := range [][]byte{
+		sectionHeader(le),
+		interfaceDescription(le, pcap.LinkEthernet, -1),
+		interfaceDescription(le, pcap.LinkRaw, 9),
+		enhancedPacket(le, 0, 1700000000_000001, []byte{1, 2, 3, 4, 5}),
+		block(le, 4, []byte{0, 0, 0, 0}), // name resolution, skipped
+		enhancedPacket(le, 1, 1700000000_000000002, []byte{6}),
+		simplePacket(le, []byte{7, 8}),
+		// a new section, of another byte order, forgets the interfaces
+		sectionHeader(be),
+		interfaceDescription(be, pcap.LinkIPv4, 3),
+		enhancedPacket(be, 0, 1700000000_003, []byte{9, 10, 11}),
+	} {
+		capture = append(capture, b...)
+	}
+	checkPackets(t, readAll(t, capture), []pcap.Packet{
+		{Time: time.Unix(1700000000, 1000), LinkType: pcap.LinkEthernet, Data: []byte{1, 2, 3, 4, 5}},
+		{Time: time.Unix(1700000000, 2), LinkType: pcap.LinkRaw, Data: []byte{6}},
+		{LinkType: pcap.LinkEthernet, Data: []byte{7, 8}}, // without a timestamp
+		{Time: time.Unix(1700000000, 3000000), LinkType: pcap.LinkIPv4, Data: []byte{9, 10, 11}},
+	})
+}
+
+func TestReadErrors(t *testing.T) {
+	le := binary.LittleEndian
+	header := pcapFile(le, false, pcap.LinkEthernet)
+	ng := append(sectionHeader(le), interfaceDescription(le, pcap.LinkEthernet, -1)...)
+	concat := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	recordHeader := func(capLen uint32) []byte {
+		return le.AppendUint32(make([]byte, 8), capLen)[:12:12]
+	}
+	tests := []struct {
+		name    string
+		capture []byte
+	}{
+		{"empty", nil},
+		{"not a capture", make([]byte, 24)},
+		{"truncated pcap header", header[:20]},
+		{"truncated record header", concat(header, make([]byte, 8))},
+		{"truncated record", concat(header, recordHeader(10), make([]byte, 4), make([]byte, 4))},
+		{"oversized record", concat(header, recordHeader(1<<25), make([]byte, 4))},
+		{"truncated block header", concat(sectionHeader(le), []byte{1, 0, 0, 0})},
+		{"section header byte order", concat(sectionHeader(le)[:8], []byte{1, 2, 3, 4}, sectionHeader(le)[12:])},
+		{"short section header", concat(sectionHeader(le)[:4], le.AppendUint32(nil, 12), sectionHeader(le)[8:])},
+		{"truncated section header", sectionHeader(le)[:20]},
+		{"unaligned block length", concat(ng, le.AppendUint32(nil, 6), le.AppendUint32(nil, 13), make([]byte, 8))},
+		{"block length below minimum", concat(ng, le.AppendUint32(nil, 6), le.AppendUint32(nil, 8))},
+		{"truncated block", concat(ng, enhancedPacket(le, 0, 0, make([]byte, 8))[:20])},
+		{"short interface description", concat(sectionHeader(le), block(le, 1, []byte{1, 0, 0, 0}))},
+		{"short enhanced packet", concat(ng, block(le, 6, make([]byte, 16)))},
+		{"unknown interface", concat(ng, enhancedPacket(le, 1, 0, []byte{1}))},
+		{"packet larger than its block", concat(ng, func() []byte {
+			b := enhancedPacket(le, 0, 0, []byte{1, 2, 3, 4})
+			le.PutUint32(b[20:24], 100)
+			return b
+		}())},
+		{"simple packet without interface", concat(sectionHeader(le), simplePacket(le, []byte{1}))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := pcap.NewReader(bytes.NewReader(tt.capture))
+			if err == nil {
+				_, err = r.Next()
+			}
+			if err == nil || err == io.EOF {
+				t.Errorf("error %v, want a malformed capture", err)
+			}
+		})
+	}
+}
+
+// FuzzRead checks that no capture makes the reader or UDP panic.
+func FuzzRead(f *testing.F) {
+	le := binary.LittleEndian
+	f.Add(pcapFile(le, false, pcap.LinkEthernet, record{time.Unix(1, 0), ethernet(0x0800, udp4())}))
+	f.Add(pcapFile(binary.BigEndian, true, pcap.LinkLinuxSLL2, record{time.Unix(1, 0), linuxSLL2(0x86DD, udp6())}))
+	f.Add(bytes.Join([][]byte{
+		sectionHeader(le),
+		interfaceDescription(le, pcap.LinkIPv6, 6),
+		enhancedPacket(le, 0, 1, ipv6(0, extension(17, 1, udpHeader(src6, dst6, payload)))),
+		simplePacket(le, udp6()),
+	}, nil))
+	f.Fuzz(func(t *testing.T, capture []byte) {
+		r, err := pcap.NewReader(bytes.NewReader(capture))
+		if err != nil {
+			return
+		}
+		for {
+			p, err := r.Next()
+			if err != nil {
+				return
+			}
+			pcap.UDP(p)
+		}
+	})
+}
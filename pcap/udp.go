@@ -0,0 +1,170 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86DD
+	etherTypeVLAN = 0x8100
+	etherTypeQinQ = 0x88A8
+
+	protocolUDP = 17
+)
+
+// ErrNotUDP is returned by UDP for frames that do not carry a complete UDP
+// datagram, such as other protocols or IP fragments.
+var ErrNotUDP = errors.New("not a UDP datagram")
+
+// Datagram is a UDP datagram extracted from a captured frame.
+type Datagram struct {
+	Src, Dst netip.AddrPort
+	Payload  []byte
+}
+
+// UDP extracts the UDP datagram carried by a captured frame. Fragmented
+// IP packets are not reassembled.
+func UDP(p Packet) (Datagram, error) {
+	data := p.Data
+	var etherType uint16
+	switch p.LinkType {
+	case LinkEthernet:
+		if len(data) < 14 {
+			return Datagram{}, errors.New("truncated Ethernet header")
+		}
+		etherType = binary.BigEndian.Uint16(data[12:14])
+		data = data[14:]
+		for etherType == etherTypeVLAN || etherType == etherTypeQinQ {
+			if len(data) < 4 {
+				return Datagram{}, errors.New("truncated VLAN tag")
+			}
+			etherType = binary.BigEndian.Uint16(data[2:4])
+			data = data[4:]
+		}
+	case LinkNull:
+		if len(data) < 4 {
+			return Datagram{}, errors.New("truncated loopback header")
+		}
+		// the protocol family is in the byte order of the capturing host,
+		// and IPv6 has a different value on each BSD
+		family := binary.LittleEndian.Uint32(data[0:4])
+		if family > 0xFFFF {
+			family = binary.BigEndian.Uint32(data[0:4])
+		}
+		data = data[4:]
+		etherType = etherTypeIPv6
+		if family == 2 {
+			etherType = etherTypeIPv4
+		}
+	case LinkRaw:
+		if len(data) == 0 {
+			return Datagram{}, ErrNotUDP
+		}
+		etherType = etherTypeIPv4
+		if data[0]>>4 == 6 {
+			etherType = etherTypeIPv6
+		}
+	case LinkIPv4:
+		etherType = etherTypeIPv4
+	case LinkIPv6:
+		etherType = etherTypeIPv6
+	case LinkLinuxSLL:
+		if len(data) < 16 {
+			return Datagram{}, errors.New("truncated Linux cooked header")
+		}
+		etherType = binary.BigEndian.Uint16(data[14:16])
+		data = data[16:]
+	case LinkLinuxSLL2:
+		if len(data) < 20 {
+			return Datagram{}, errors.New("truncated Linux cooked v2 header")
+		}
+		etherType = binary.BigEndian.Uint16(data[0:2])
+		data = data[20:]
+	default:
+		return Datagram{}, fmt.Errorf("unsupported link type %d", p.LinkType)
+	}
+
+	switch etherType {
+	case etherTypeIPv4:
+		return ipv4UDP(data)
+	case etherTypeIPv6:
+		return ipv6UDP(data)
+	}
+	return Datagram{}, ErrNotUDP
+}
+
+func ipv4UDP(data []byte) (Datagram, error) {
+	if len(data) < 20 || data[0]>>4 != 4 {
+		return Datagram{}, errors.New("invalid IPv4 header")
+	}
+	headerLen := int(data[0]&0x0F) * 4
+	total := int(binary.BigEndian.Uint16(data[2:4]))
+	if headerLen < 20 || total < headerLen || len(data) < headerLen {
+		return Datagram{}, errors.New("invalid IPv4 header")
+	}
+	if data[9] != protocolUDP {
+		return Datagram{}, ErrNotUDP
+	}
+	if flags := binary.BigEndian.Uint16(data[6:8]); flags&0x3FFF != 0 {
+		// more fragments, or a fragment offset
+		return Datagram{}, ErrNotUDP
+	}
+	if total < len(data) {
+		data = data[:total] // Ethernet padding
+	}
+	src := netip.AddrFrom4([4]byte(data[12:16]))
+	dst := netip.AddrFrom4([4]byte(data[16:20]))
+	return udp(src, dst, data[headerLen:])
+}
+
+func ipv6UDP(data []byte) (Datagram, error) {
+	if len(data) < 40 || data[0]>>4 != 6 {
+		return Datagram{}, errors.New("invalid IPv6 header")
+	}
+	payloadLen := int(binary.BigEndian.Uint16(data[4:6]))
+	next := data[6]
+	src := netip.AddrFrom16([16]byte(data[8:24]))
+	dst := netip.AddrFrom16([16]byte(data[24:40]))
+	data = data[40:]
+	if payloadLen < len(data) {
+		data = data[:payloadLen]
+	}
+
+	// skip the extension headers that may precede UDP
+	for next != protocolUDP {
+		switch next {
+		case 0, 43, 60: // hop-by-hop, routing, destination options
+			if len(data) < 8 {
+				return Datagram{}, errors.New("truncated IPv6 extension header")
+			}
+			n := (int(data[1]) + 1) * 8
+			if len(data) < n {
+				return Datagram{}, errors.New("truncated IPv6 extension header")
+			}
+			next, data = data[0], data[n:]
+		default:
+			// fragments and other protocols
+			return Datagram{}, ErrNotUDP
+		}
+	}
+	return udp(src, dst, data)
+}
+
+func udp(src, dst netip.Addr, data []byte) (Datagram, error) {
+	if len(data) < 8 {
+		return Datagram{}, errors.New("truncated UDP header")
+	}
+	length := int(binary.BigEndian.Uint16(data[4:6]))
+	if length < 8 || length > len(data) {
+		return Datagram{}, fmt.Errorf("UDP datagram of %d bytes, %d captured", length, len(data))
+	}
+	return Datagram{
+		Src:     netip.AddrPortFrom(src, binary.BigEndian.Uint16(data[0:2])),
+		Dst:     netip.AddrPortFrom(dst, binary.BigEndian.Uint16(data[2:4])),
+		Payload: data[8:length],
+	}, nil
+}
@@ -0,0 +1,177 @@
+package pcap_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"coresrt/pcap"
+)
+
+var (
+	src4 = netip.MustParseAddrPort("10.0.0.1:5000")
+	dst4 = netip.MustParseAddrPort("10.0.0.2:6000")
+	src6 = netip.MustParseAddrPort("[fd00::1]:5000")
+	dst6 = netip.MustParseAddrPort("[fd00::2]:6000")
+
+	payload = []byte("srt payload")
+)
+
+func udpHeader(src, dst netip.AddrPort, payload []byte) []byte {
+	b := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint16(b[0:2], src.Port())
+	binary.BigEndian.PutUint16(b[2:4], dst.Port())
+	binary.BigEndian.PutUint16(b[4:6], uint16(8+len(payload)))
+	return append(b, payload...)
+}
+
+// ipv4 returns an IPv4 packet of protocol proto with the given flags and
+// fragment offset word.
+func ipv4(proto byte, flags uint16, body []byte) []byte {
+	b := make([]byte, 20, 20+len(body))
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:4], uint16(20+len(body)))
+	binary.BigEndian.PutUint16(b[6:8], flags)
+	b[8] = 64
+	b[9] = proto
+	s, d := src4.Addr().As4(), dst4.Addr().As4()
+	copy(b[12:16], s[:])
+	copy(b[16:20], d[:])
+	return append(b, body...)
+}
+
+func ipv6(next byte, body []byte) []byte {
+	b := make([]byte, 40, 40+len(body))
+	b[0] = 0x60
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(body)))
+	b[6] = next
+	b[7] = 64
+	s, d := src6.Addr().As16(), dst6.Addr().As16()
+	copy(b[8:24], s[:])
+	copy(b[24:40], d[:])
+	return append(b, body...)
+}
+
+// extension returns an IPv6 extension header of n 8-byte units followed
+// by next.
+func extension(next byte, n int, rest []byte) []byte {
+	b := make([]byte, 8*n)
+	b[0] = next
+	b[1] = byte(n - 1)
+	return append(b, rest...)
+}
+
+func udp4() []byte { return ipv4(17, 0, udpHeader(src4, dst4, payload)) }
+func udp6() []byte { return ipv6(17, udpHeader(src6, dst6, payload)) }
+
+func ethernet(etherType uint16, body []byte) []byte {
+	b := make([]byte, 14, 14+len(body))
+	binary.BigEndian.PutUint16(b[12:14], etherType)
+	return append(b, body...)
+}
+
+// vlanTag returns a VLAN tag of id followed by etherType.
+func vlanTag(id, etherType uint16, body []byte) []byte {
+	b := binary.BigEndian.AppendUint16(nil, id)
+	b = binary.BigEndian.AppendUint16(b, etherType)
+	return append(b, body...)
+}
+
+func linuxSLL(etherType uint16, body []byte) []byte {
+	b := make([]byte, 16, 16+len(body))
+	binary.BigEndian.PutUint16(b[14:16], etherType)
+	return append(b, body...)
+}
+
+func linuxSLL2(etherType uint16, body []byte) []byte {
+	b := make([]byte, 20, 20+len(body))
+	binary.BigEndian.PutUint16(b[0:2], etherType)
+	return append(b, body...)
+}
+
+func loopback(order binary.AppendByteOrder, family uint32, body []byte) []byte {
+	return append(order.AppendUint32(nil, family), body...)
+}
+
+func TestUDP(t *testing.T) {
+	want4 := pcap.Datagram{Src: src4, Dst: dst4, Payload: payload}
+	want6 := pcap.Datagram{Src: src6, Dst: dst6, Payload: payload}
+	tests := []struct {
+		name  string
+		link  uint32
+		frame []byte
+		want  pcap.Datagram
+	}{
+		{"ethernet", pcap.LinkEthernet, ethernet(0x0800, udp4()), want4},
+		{"ethernet ipv6", pcap.LinkEthernet, ethernet(0x86DD, udp6()), want6},
+		{"ethernet padding", pcap.LinkEthernet, ethernet(0x0800, append(udp4(), 0, 0, 0, 0)), want4},
+		{"vlan", pcap.LinkEthernet, ethernet(0x8100, vlanTag(42, 0x0800, udp4())), want4},
+		{"qinq", pcap.LinkEthernet, ethernet(0x88A8, vlanTag(1, 0x8100, vlanTag(42, 0x86DD, udp6()))), want6},
+		{"linux cooked", pcap.LinkLinuxSLL, linuxSLL(0x0800, udp4()), want4},
+		{"linux cooked v2", pcap.LinkLinuxSLL2, linuxSLL2(0x86DD, udp6()), want6},
+		{"loopback", pcap.LinkNull, loopback(binary.LittleEndian, 2, udp4()), want4},
+		{"loopback big endian ipv6", pcap.LinkNull, loopback(binary.BigEndian, 30, udp6()), want6},
+		{"raw ipv4", pcap.LinkRaw, udp4(), want4},
+		{"raw ipv6", pcap.LinkRaw, udp6(), want6},
+		{"ipv4", pcap.LinkIPv4, udp4(), want4},
+		{"ipv6", pcap.LinkIPv6, udp6(), want6},
+		{"ipv6 extension headers", pcap.LinkIPv6,
+			ipv6(0, extension(60, 1, extension(17, 2, udpHeader(src6, dst6, payload)))), want6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := pcap.UDP(pcap.Packet{LinkType: tt.link, Data: tt.frame})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Src != tt.want.Src || got.Dst != tt.want.Dst || !slices.Equal(got.Payload, tt.want.Payload) {
+				t.Errorf("got %v > %v %q, want %v > %v %q", got.Src, got.Dst, got.Payload, tt.want.Src, tt.want.Dst, tt.want.Payload)
+			}
+		})
+	}
+}
+
+func TestUDPErrors(t *testing.T) {
+	udp := udpHeader(src4, dst4, payload)
+	tests := []struct {
+		name  string
+		link  uint32
+		frame []byte
+		want  error // ErrNotUDP, or nil for any other error
+	}{
+		{"tcp", pcap.LinkIPv4, ipv4(6, 0, udp), pcap.ErrNotUDP},
+		{"ipv4 more fragments", pcap.LinkIPv4, ipv4(17, 0x2000, udp), pcap.ErrNotUDP},
+		{"ipv4 fragment offset", pcap.LinkIPv4, ipv4(17, 0x0010, udp), pcap.ErrNotUDP},
+		{"ipv6 fragment", pcap.LinkIPv6, ipv6(44, extension(17, 1, udp)), pcap.ErrNotUDP},
+		{"arp", pcap.LinkEthernet, ethernet(0x0806, make([]byte, 28)), pcap.ErrNotUDP},
+		{"raw empty", pcap.LinkRaw, nil, pcap.ErrNotUDP},
+		{"truncated ethernet", pcap.LinkEthernet, make([]byte, 13), nil},
+		{"truncated vlan tag", pcap.LinkEthernet, ethernet(0x8100, []byte{0, 42}), nil},
+		{"truncated linux cooked", pcap.LinkLinuxSLL, make([]byte, 15), nil},
+		{"truncated linux cooked v2", pcap.LinkLinuxSLL2, make([]byte, 19), nil},
+		{"truncated loopback", pcap.LinkNull, []byte{2, 0}, nil},
+		{"truncated ipv4", pcap.LinkIPv4, udp4()[:19], nil},
+		{"ipv4 header length", pcap.LinkIPv4, append([]byte{0x44}, udp4()[1:]...), nil},
+		{"ipv4 total length", pcap.LinkIPv4, append(append([]byte{}, udp4()[:2]...), append([]byte{0, 10}, udp4()[4:]...)...), nil},
+		{"truncated ipv6", pcap.LinkIPv6, udp6()[:39], nil},
+		{"truncated extension header", pcap.LinkIPv6, ipv6(0, extension(17, 2, nil)[:12]), nil},
+		{"truncated udp header", pcap.LinkIPv4, ipv4(17, 0, udp[:7]), nil},
+		{"udp longer than captured", pcap.LinkIPv4, udp4()[:30], nil},
+		{"unsupported link type", 12345, udp4(), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := pcap.UDP(pcap.Packet{LinkType: tt.link, Data: tt.frame})
+			switch {
+			case err == nil:
+				t.Fatal("no error")
+			case tt.want != nil && !errors.Is(err, tt.want):
+				t.Errorf("error %v, want %v", err, tt.want)
+			case tt.want == nil && errors.Is(err, pcap.ErrNotUDP):
+				t.Errorf("error %v, want a malformed frame", err)
+			}
+		})
+	}
+}
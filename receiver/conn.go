@@ -0,0 +1,77 @@
+package receiver
+
+import (
+	"net"
+	"time"
+
+	"coresrt/packets"
+	"coresrt/state"
+	"coresrt/stats"
+)
+
+// Conn is the handle of an accepted connection given to state change
+// callbacks.
+type Conn struct {
+	c *connection
+}
+
+// SocketID returns our socket ID for the connection.
+func (h *Conn) SocketID() uint32 { return h.c.socketID }
+
+// PeerSocketID returns the caller's socket ID.
+func (h *Conn) PeerSocketID() uint32 { return h.c.peerSocket }
+
+// PeerAddr returns the caller's address.
+func (h *Conn) PeerAddr() *net.UDPAddr { return h.c.addr }
+
+// StreamID returns the stream ID the caller asked for, if any.
+func (h *Conn) StreamID() string { return h.c.streamID }
+
+// State returns the current state of the connection.
+func (h *Conn) State() state.State { return h.c.state.State() }
+
+// Stats returns the statistics of the connection. If clear is set, a new
+// interval starts.
+func (h *Conn) Stats(clear bool) stats.Stats {
+	c := h.c
+	now := time.Now()
+
+	// the buffer is the group's when grouped
+	buf := c.buf.Occupancy()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// the capacity is in packets, of the size the caller sends on average
+	payloadSize := 0
+	if c.counters.PacketsReceived > 0 {
+		payloadSize = int(c.counters.BytesReceived / c.counters.PacketsReceived)
+	}
+	s := stats.Stats{
+		Elapsed:        now.Sub(c.startTime),
+		RTT:            c.rtt,
+		RTTVar:         c.rttVar,
+		Bandwidth:      stats.Bandwidth(c.window.Capacity(), payloadSize),
+		FlowWindow:     c.sendQueue.FlowWindow(),
+		SendLatency:    c.sendLatency,
+		ReceiveLatency: c.latency,
+		SendBuffer:     c.sendQueue.Occupancy(),
+		ReceiveBuffer:  buf,
+	}
+	c.interval.Snapshot(&s, c.counters, now, clear)
+	return s
+}
+
+// Close sends SHUTDOWN to the caller and frees the connection.
+func (h *Conn) Close() {
+	c := h.c
+	if !c.end(state.Closing, nil) {
+		return
+	}
+	c.flushProbe(time.Now(), 0)
+	shutdown := packets.ShutdownControlPacket{
+		Timestamp:           c.timestamp(),
+		DestinationSocketID: c.peerSocket,
+	}
+	c.send(shutdown.Marshal())
+	c.finish(nil)
+}
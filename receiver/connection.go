@@ -0,0 +1,384 @@
+package receiver
+
+import (
+	"time"
+
+	"coresrt/filter"
+	"coresrt/mux"
+	"coresrt/packets"
+	"coresrt/state"
+)
+
+func (c *connection) handleData(p *packets.Data) {
+	now := time.Now()
+
+	c.mu.Lock()
+	c.lastPacketTime = now
+	c.counters.PacketsReceived++
+	c.metrics.packetsReceived.Add(1)
+	c.counters.BytesReceived += uint64(len(p.Data))
+	if p.RetransmittedPacketFlag != 0 {
+		c.counters.PacketsRetransmitted++
+		c.counters.BytesRetransmitted += uint64(len(p.Data))
+	}
+	if !c.seqInitialized {
+		c.seqInitialized = true
+		c.firstPacketTime = now
+	}
+
+	pkts := []*packets.Data{p}
+	pass := true
+	var lost []packets.LossRange
+	if c.filter != nil {
+		res := c.filter.Receive(p)
+		pkts = res.Rebuilt
+		pass = res.Pass
+		if res.Pass {
+			pkts = append([]*packets.Data{p}, pkts...)
+		}
+		if c.filter.ARQ() == filter.ARQOnRequest {
+			for _, r := range res.Lost {
+				lost = append(lost, c.seqs.Losses.Intersect(r)...)
+			}
+			for _, r := range lost {
+				c.seqs.Losses.Report(r, now)
+			}
+		}
+	}
+	if pass {
+		c.window.Arrival(p.PacketSequenceNumber, len(p.Data), p.RetransmittedPacketFlag != 0, now)
+	}
+	c.mu.Unlock()
+
+	if len(lost) > 0 {
+		c.sendNAK(lost)
+	}
+	for _, p := range pkts {
+		c.receive(p, now)
+	}
+}
+
+// receive handles a data packet that came from the peer or was rebuilt
+// by the packet filter.
+func (c *connection) receive(p *packets.Data, now time.Time) {
+	if c.buf.Free() == 0 {
+		// not taken as received, so that it is requested again once
+		// there is room
+		c.log.Debug("receive buffer full, dropping packet", "seq", p.PacketSequenceNumber)
+		c.metrics.overflowed.Add(1)
+		return
+	}
+
+	c.mu.Lock()
+	deliverAt := c.deliveryTime(p.Timestamp)
+	if deliverAt.Before(now) {
+		c.counters.PacketsBelated++
+		c.counters.BytesBelated += uint64(len(p.Data))
+	}
+
+	if c.group != nil && c.group.gtype == packets.GTYPE_BALANCING {
+		// each link carries only part of the stream, so losses can only
+		// be told apart from packets sent over other links group-wide
+		c.mu.Unlock()
+		c.group.receiveBalanced(p, deliverAt)
+		return
+	}
+
+	gap, isNew := c.seqs.Receive(p.PacketSequenceNumber)
+	if !isNew {
+		c.mu.Unlock()
+		return
+	}
+	var lost []packets.LossRange
+	if gap != nil {
+		lost = []packets.LossRange{*gap}
+		if c.group != nil && !c.group.msgSync {
+			lost = c.buf.Missing(gap.From, gap.To)
+		}
+		for _, r := range lost {
+			c.seqs.AddLoss(r, now)
+			n := uint64(r.Len())
+			c.countLoss(&c.counters.PacketsLost, &c.counters.BytesLost, n)
+			c.metrics.packetsLost.Add(n)
+		}
+		if c.filter != nil && c.filter.ARQ() != filter.ARQAlways {
+			// left for the filter to recover
+			lost = nil
+		}
+		for _, r := range lost {
+			c.seqs.Losses.Report(r, now)
+		}
+	}
+	c.mu.Unlock()
+
+	if len(lost) > 0 {
+		c.sendNAK(lost)
+	}
+
+	key, payload := p.PacketSequenceNumber, p.Data
+	if c.assembler != nil {
+		msg, ok := c.assembler.add(p)
+		if !ok {
+			return
+		}
+		key, payload = p.MessageNumber, msg
+	}
+	if c.buf.Push(key, payload, deliverAt) && c.group != nil {
+		c.group.received(c)
+	}
+}
+
+// deliveryTime converts a peer timestamp into the local TSBPD delivery
+// time. It must be called with c.mu held.
+func (c *connection) deliveryTime(ts uint32) time.Time {
+	return c.tsbpdBase.Add(c.timeline.Elapsed(ts) + c.latency)
+}
+
+func (c *connection) handleControl(p *packets.Control) {
+	c.mu.Lock()
+	c.lastPacketTime = time.Now()
+	c.mu.Unlock()
+
+	switch p.ControlType {
+	case packets.ACKACK:
+		ackack, err := packets.ParseACKACKControlPacket(p)
+		if err != nil {
+			c.log.Debug("malformed control packet", "err", err)
+			return
+		}
+		c.handleACKACK(ackack)
+	case packets.ACK:
+		ack, err := packets.ParseAcknowledgementControlPacket(p)
+		if err != nil {
+			c.log.Debug("malformed control packet", "err", err)
+			return
+		}
+		c.handleACK(ack)
+	case packets.NAK:
+		nak, err := packets.ParseNegativeAcknowledgmentControlPacket(p)
+		if err != nil {
+			c.log.Debug("malformed control packet", "err", err)
+			return
+		}
+		c.handleNAK(nak)
+	case packets.KEEPALIVE:
+		// refreshing lastPacketTime is all a keep-alive does
+	case packets.SHUTDOWN:
+		if _, err := packets.ParseShutdownControlPacket(p); err != nil {
+			c.log.Debug("malformed control packet", "err", err)
+			return
+		}
+		if c.end(state.Closing, state.ErrPeerShutdown) {
+			c.log.Info("peer shut down the connection")
+			// let the packets already received reach their delivery time
+			c.mu.Lock()
+			latency := c.latency // a legacy caller may have changed it
+			c.mu.Unlock()
+			time.AfterFunc(latency+ackInterval, func() { c.finish(state.ErrPeerShutdown) })
+		}
+	case packets.PEERERROR:
+		pe, err := packets.ParsePeerErrorControlPacket(p)
+		if err != nil {
+			c.log.Debug("malformed control packet", "err", err)
+			return
+		}
+		reason := state.PeerError{Code: pe.ErrorCode}
+		if c.end(state.Broken, reason) {
+			c.log.Warn("peer error, closing connection", "code", pe.ErrorCode)
+			c.finish(reason)
+		}
+	default:
+		c.log.Debug("unhandled control packet", "control_type", p.ControlType)
+	}
+}
+
+func (c *connection) handleACKACK(p *packets.ACKACKControlPacket) {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rtt, ok := c.acks.Answered(p.AcknowledgementNumber, now)
+	if !ok {
+		return
+	}
+	diff := c.rtt - rtt
+	if diff < 0 {
+		diff = -diff
+	}
+	c.rttVar = (3*c.rttVar + diff) / 4
+	c.rtt = (7*c.rtt + rtt) / 8
+	c.metrics.observeRTT(rtt)
+}
+
+func (c *connection) ackLoop() {
+	ticker := time.NewTicker(ackInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stopACK:
+			return
+		case <-c.mux.Done():
+			if c.end(state.Closing, mux.ErrClosed) {
+				c.finish(mux.ErrClosed)
+			}
+			return
+		case now := <-ticker.C:
+			if c.idle(now) {
+				if c.end(state.Broken, state.ErrPeerIdle) {
+					c.log.Warn("no packet from peer, closing connection", "timeout", c.idleTimeout)
+					c.finish(state.ErrPeerIdle)
+				}
+				return
+			}
+			c.flushProbe(now, probeWait)
+			if c.group != nil {
+				c.group.checkSource(now)
+			}
+			c.sendACK(now)
+			c.sendPeriodicNAK(now)
+			c.retransmitUnacknowledged(now)
+			c.dropTooLate(now)
+			c.sendKeepAlive(now)
+		}
+	}
+}
+
+func (c *connection) idle(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return now.Sub(c.lastPacketTime) > c.idleTimeout
+}
+
+// end moves a connected connection to the closing or broken state and
+// stops its ACKs. It reports false if the connection already ended, in
+// which case the caller leaves it alone.
+func (c *connection) end(to state.State, reason error) bool {
+	if !c.state.Set(to, reason) {
+		return false
+	}
+	close(c.stopACK)
+	return true
+}
+
+// finish frees the state of an ended connection.
+func (c *connection) finish(reason error) {
+	c.release()
+	c.state.Set(state.Closed, reason)
+}
+
+// sendKeepAlive tells the peer we are still there when nothing else was
+// sent for a while.
+func (c *connection) sendKeepAlive(now time.Time) {
+	c.mu.Lock()
+	quiet := now.Sub(c.lastSendTime) >= keepAliveInterval
+	c.mu.Unlock()
+	if !quiet {
+		return
+	}
+
+	ka := packets.KeepAliveControl{
+		Timestamp:           c.timestamp(),
+		DestinationSocketID: c.peerSocket,
+	}
+	c.send(ka.Marshal())
+}
+
+func (c *connection) sendACK(now time.Time) {
+	var ackSeq uint32
+	if c.group != nil && c.group.gtype == packets.GTYPE_BALANCING {
+		ackSeq = c.group.checkLosses(now)
+	}
+
+	c.mu.Lock()
+	if dropped := c.seqs.Expire(now.Add(-c.latency)); dropped > 0 && c.group == nil {
+		// group members expect to miss what the other links deliver
+		c.log.Warn("gave up on lost packets", "count", dropped)
+		c.countLoss(&c.counters.PacketsDropped, &c.counters.BytesDropped, uint64(dropped))
+	}
+	if c.group == nil || c.group.gtype != packets.GTYPE_BALANCING {
+		ackSeq = c.seqs.ACKSeq()
+	}
+	// an ACK also tells a sender stopped by a full buffer that it drained
+	free := c.buf.Free()
+	if !c.seqInitialized {
+		c.mu.Unlock()
+		return
+	}
+	number, ok := c.acks.Next(ackSeq, free, now)
+	if !ok {
+		c.mu.Unlock()
+		return
+	}
+	pktRate, byteRate := c.window.ReceivingRate()
+	ack := packets.AcknowledgementControlPacket{
+		AcknowledgementNumber:                number,
+		Timestamp:                            c.timestamp(),
+		DestinationSocketID:                  c.peerSocket,
+		LastAcknowledgedPacketSequenceNumber: ackSeq,
+		RTT:                                  uint32(c.rtt.Microseconds()),
+		RTTVariance:                          uint32(c.rttVar.Microseconds()),
+		AvailableBufferSize:                  uint32(free),
+		PacketsReceivingRate:                 pktRate,
+		EstimatedLinkCapacity:                c.window.Capacity(),
+		ReceivingRate:                        byteRate,
+	}
+	c.mu.Unlock()
+
+	c.send(ack.Marshal())
+}
+
+// countLoss adds n packets that never arrived to a pair of counters,
+// estimating their size from the average payload received. It must be
+// called with c.mu held.
+func (c *connection) countLoss(pkts, bytes *uint64, n uint64) {
+	*pkts += n
+	if c.counters.PacketsReceived > 0 {
+		*bytes += n * c.counters.BytesReceived / c.counters.PacketsReceived
+	}
+}
+
+// sendPeriodicNAK reports again the losses that a NAK reported at least a
+// NAK interval ago, in case the NAK or the retransmission was lost, if
+// the handshake agreed on periodic NAKs. The losses of a balancing group
+// are reported by the group.
+func (c *connection) sendPeriodicNAK(now time.Time) {
+	if c.group != nil && c.group.gtype == packets.GTYPE_BALANCING {
+		return
+	}
+	c.mu.Lock()
+	if !c.periodicNAK {
+		c.mu.Unlock()
+		return
+	}
+	lost := c.seqs.Losses.Due(now, c.rtt, c.rttVar, c.mtu)
+	c.mu.Unlock()
+
+	if len(lost) > 0 {
+		c.sendNAK(lost)
+	}
+}
+
+func (c *connection) sendNAK(lost []packets.LossRange) {
+	nak := packets.NegativeAcknowledgmentControlPacket{
+		Timestamp:               c.timestamp(),
+		DestinationSocketID:     c.peerSocket,
+		ControlInformationField: packets.EncodeLossList(lost),
+	}
+	c.send(nak.Marshal())
+}
+
+func (c *connection) send(b []byte) {
+	c.mu.Lock()
+	c.lastSendTime = time.Now()
+	c.mu.Unlock()
+
+	if err := c.mux.WriteTo(b, c.addr); err != nil {
+		c.log.Error("error sending", "err", err)
+	}
+}
+
+func (c *connection) timestamp() uint32 {
+	return uint32(time.Since(c.startTime).Microseconds())
+}
@@ -0,0 +1,315 @@
+package receiver
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"coresrt/internal/live"
+	"coresrt/mux"
+	"coresrt/packets"
+	"coresrt/seqno"
+)
+
+const (
+	// balancing groups wait this long at least before reporting a hole,
+	// as packets sent over a slower link are expected to arrive late
+	minReorderTolerance = 20 * time.Millisecond
+
+	// a main/backup source bringing nothing new for this long plus its
+	// RTT is logged as silent, as for the stability timeout of the caller
+	sourceSilence = 60 * time.Millisecond
+)
+
+// group bonds the member connections that a caller opened with the same
+// group ID. Every member feeds the same receive buffer, so each packet is
+// delivered once, from whichever link brought it first.
+//
+// In a balancing group each link carries only a share of the stream, so
+// losses are tracked once for the whole group rather than per member. In a
+// main/backup group each member acknowledges and reports the losses of what
+// it received on its own; which member the caller is sending over is only
+// tracked to log the switches.
+type group struct {
+	id      uint32 // caller's group ID
+	localID uint32 // our group ID, reported back in the handshake
+	gtype   packets.SrtGtype
+	msgSync bool // synchronized on message numbers (M flag)
+	buf     *live.RecvBuffer
+	log     *slog.Logger
+
+	mu      sync.Mutex
+	members map[uint32]*groupMember // key: our socket ID
+	source  *connection             // main/backup: member that last brought new data, for the log
+	seqs    live.SeqTracker         // balancing: sequence numbers over all members
+	latency time.Duration           // balancing: losses older than this are given up
+}
+
+type groupMember struct {
+	conn     *connection
+	weight   uint16    // link priority for main/backup groups
+	lastData time.Time // main/backup: when it last brought new data
+}
+
+func (r *Receiver) joinGroup(c *connection, ext *packets.GroupMembershipExtension) (*group, error) {
+	switch ext.Type {
+	case packets.GTYPE_BROADCAST, packets.GTYPE_MAIN_BACKUP, packets.GTYPE_BALANCING:
+	default:
+		return nil, fmt.Errorf("unsupported group type %d", ext.Type)
+	}
+	msgSync := ext.Flags&packets.GroupFlagMsgSync != 0
+	if msgSync && ext.Type == packets.GTYPE_BALANCING {
+		// the packets of one message may travel over different links
+		return nil, fmt.Errorf("balancing group %08x cannot be synchronized on messages", ext.GroupID)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	g, ok := r.groups[ext.GroupID]
+	if !ok {
+		g = &group{
+			id:      ext.GroupID,
+			localID: mux.NewGroupID(),
+			gtype:   ext.Type,
+			msgSync: msgSync,
+			log:     r.log.With("group", fmt.Sprintf("%08x", ext.GroupID)),
+			members: make(map[uint32]*groupMember),
+			seqs:    live.NewSeqTracker(c.isn),
+			latency: c.latency,
+		}
+		g.buf = r.newRecvBuffer(msgSync, g.log)
+		r.groups[ext.GroupID] = g
+		g.log.Info("group created", "type", g.gtype, "msg_sync", g.msgSync)
+	} else if g.gtype != ext.Type || g.msgSync != msgSync {
+		return nil, fmt.Errorf("group %08x: member type %d does not match group type %d", ext.GroupID, ext.Type, g.gtype)
+	}
+
+	g.mu.Lock()
+	g.members[c.socketID] = &groupMember{conn: c, weight: ext.Weight}
+	g.latency = max(g.latency, c.latency)
+	g.mu.Unlock()
+
+	c.group = g
+	c.buf = g.buf
+	if msgSync {
+		c.assembler = newMessageAssembler()
+	}
+	g.log.Info("member joined", "socket", fmt.Sprintf("%08x", c.socketID), "peer", c.addr, "weight", ext.Weight)
+	return g, nil
+}
+
+func (g *group) response(c *connection) *packets.GroupMembershipExtension {
+	flags := uint8(0)
+	if g.msgSync {
+		flags |= packets.GroupFlagMsgSync
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return &packets.GroupMembershipExtension{
+		GroupID: g.localID,
+		Type:    g.gtype,
+		Flags:   flags,
+		Weight:  g.members[c.socketID].weight,
+	}
+}
+
+// leave removes a closed member and reports whether the group is empty.
+func (g *group) leave(c *connection) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.members, c.socketID)
+	if g.source == c {
+		g.source = nil
+	}
+	g.log.Info("member left", "socket", fmt.Sprintf("%08x", c.socketID))
+	return len(g.members) == 0
+}
+
+// received notes that c brought a packet no other member had. In a
+// main/backup group this tells which link the sender is currently using,
+// and a change is logged.
+func (g *group) received(c *connection) {
+	if g.gtype != packets.GTYPE_MAIN_BACKUP {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	m, ok := g.members[c.socketID]
+	if !ok {
+		return
+	}
+	m.lastData = time.Now()
+	if g.source == c {
+		return
+	}
+	from := "none"
+	if g.source != nil {
+		from = fmt.Sprintf("%08x", g.source.socketID)
+	}
+	g.source = c
+	g.log.Info("receiving over member", "socket", fmt.Sprintf("%08x", c.socketID),
+		"peer", c.addr, "weight", m.weight, "switched_from", from)
+}
+
+// checkSource logs that the member a main/backup group is receiving over
+// brought nothing new for sourceSilence plus its RTT, as the caller is
+// then about to resend over a backup. It changes nothing in what the
+// members acknowledge or report lost.
+func (g *group) checkSource(now time.Time) {
+	if g.gtype != packets.GTYPE_MAIN_BACKUP {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	c := g.source
+	if c == nil {
+		return
+	}
+	m := g.members[c.socketID]
+	c.mu.Lock()
+	silence := sourceSilence + c.rtt
+	c.mu.Unlock()
+	if now.Sub(m.lastData) <= silence {
+		return
+	}
+	g.source = nil
+	g.log.Info("active member went silent, waiting for a backup", "socket", fmt.Sprintf("%08x", c.socketID),
+		"peer", c.addr, "weight", m.weight, "silent_for", now.Sub(m.lastData).Round(time.Millisecond))
+}
+
+// receiveBalanced merges a packet received by a member of a balancing
+// group. Holes are only reported later by checkLosses, since the packets
+// missing from them may still be on their way over another link.
+func (g *group) receiveBalanced(p *packets.Data, deliverAt time.Time) {
+	g.mu.Lock()
+	gap, isNew := g.seqs.Receive(p.PacketSequenceNumber)
+	if gap != nil {
+		g.seqs.AddLoss(*gap, time.Now())
+	}
+	g.mu.Unlock()
+
+	if isNew {
+		g.buf.Push(p.PacketSequenceNumber, p.Data, deliverAt)
+	}
+}
+
+// checkLosses gives up on holes older than the latency and reports those
+// older than the reorder tolerance over the live member with the lowest
+// RTT, then returns the sequence number the members acknowledge.
+func (g *group) checkLosses(now time.Time) uint32 {
+	g.mu.Lock()
+	if dropped := g.seqs.Expire(now.Add(-g.latency)); dropped > 0 {
+		g.log.Warn("gave up on lost packets", "count", dropped)
+	}
+
+	var nakConn *connection
+	var nakRTT, nakRTTVar, maxRTT time.Duration
+	nakMTU := 0
+	nakLive := false
+	for _, m := range g.members {
+		m.conn.mu.Lock()
+		rtt, rttVar, mtu := m.conn.rtt, m.conn.rttVar, m.conn.mtu
+		// a link that recently brought data is likely to carry the NAK
+		live := now.Sub(m.conn.lastPacketTime) < g.latency
+		m.conn.mu.Unlock()
+		if nakConn == nil || (live && !nakLive) || (live == nakLive && rtt < nakRTT) {
+			nakConn, nakRTT, nakRTTVar, nakMTU, nakLive = m.conn, rtt, rttVar, mtu, live
+		}
+		maxRTT = max(maxRTT, rtt)
+	}
+	tolerance := max(maxRTT/2, minReorderTolerance)
+
+	// holes reported before are reported again every NAK interval, in
+	// case the NAK or the retransmission was lost
+	interval, limit := live.NAKInterval(nakRTT, nakRTTVar), live.MaxNAKRanges(nakMTU)
+	var lost []packets.LossRange
+	for i := range g.seqs.Losses {
+		if len(lost) == limit {
+			break
+		}
+		r := &g.seqs.Losses[i]
+		if r.NAKAt.IsZero() && now.Sub(r.Detected) >= tolerance ||
+			!r.NAKAt.IsZero() && now.Sub(r.NAKAt) >= interval {
+			r.NAKAt = now
+			lost = append(lost, r.LossRange)
+		}
+	}
+	ackSeq := g.seqs.ACKSeq()
+	g.mu.Unlock()
+
+	if len(lost) > 0 && nakConn != nil {
+		nakConn.sendNAK(lost)
+	}
+	return ackSeq
+}
+
+const (
+	packetPositionMiddle = 0b00
+	packetPositionLast   = 0b01
+	packetPositionFirst  = 0b10
+	packetPositionSolo   = 0b11
+
+	// incomplete messages this far behind the newest one are abandoned
+	maxMessageBacklog = 1024
+)
+
+type fragment struct {
+	seq      uint32
+	position byte
+	payload  []byte
+}
+
+// messageAssembler joins the packets of a message so that a
+// message-synchronized group can key its buffer on whole messages.
+type messageAssembler struct {
+	messages map[uint32][]fragment // key: message number
+}
+
+func newMessageAssembler() *messageAssembler {
+	return &messageAssembler{messages: make(map[uint32][]fragment)}
+}
+
+// add stores a packet and returns the complete message once its first
+// and last packets and everything between them have arrived.
+func (a *messageAssembler) add(p *packets.Data) ([]byte, bool) {
+	if p.PacketPositionFlag == packetPositionSolo {
+		return p.Data, true
+	}
+
+	a.expire(p.MessageNumber)
+
+	frags := append(a.messages[p.MessageNumber], fragment{
+		seq:      p.PacketSequenceNumber,
+		position: p.PacketPositionFlag,
+		payload:  p.Data,
+	})
+	sort.Slice(frags, func(i, j int) bool { return seqno.Less(frags[i].seq, frags[j].seq) })
+	a.messages[p.MessageNumber] = frags
+
+	first, last := frags[0], frags[len(frags)-1]
+	if first.position != packetPositionFirst || last.position != packetPositionLast ||
+		int(seqno.Diff(last.seq, first.seq))+1 != len(frags) {
+		return nil, false
+	}
+
+	var msg []byte
+	for _, f := range frags {
+		msg = append(msg, f.payload...)
+	}
+	delete(a.messages, p.MessageNumber)
+	return msg, true
+}
+
+func (a *messageAssembler) expire(newest uint32) {
+	for msgNum := range a.messages {
+		if seqno.MessageDiff(newest, msgNum) > maxMessageBacklog {
+			delete(a.messages, msgNum)
+		}
+	}
+}
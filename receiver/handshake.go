@@ -0,0 +1,372 @@
+package receiver
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"coresrt/filter"
+	"coresrt/internal/live"
+	"coresrt/packets"
+	"coresrt/state"
+	"coresrt/stats"
+)
+
+const (
+	defaultMTU           = 1500
+	defaultReceiveBuffer = 8192 // packets
+)
+
+// synCookie is crafted from the peer address and the current minute, so
+// the listener does not need to keep any state for the induction phase.
+func (r *Receiver) synCookie(addr *net.UDPAddr, t time.Time) uint32 {
+	h := sha256.New()
+	h.Write(r.cookieSecret[:])
+	h.Write([]byte(addr.String()))
+	binary.Write(h, binary.BigEndian, t.Unix()/60)
+	return binary.BigEndian.Uint32(h.Sum(nil))
+}
+
+func (r *Receiver) validCookie(addr *net.UDPAddr, cookie uint32) bool {
+	now := time.Now()
+	return cookie == r.synCookie(addr, now) || cookie == r.synCookie(addr, now.Add(-time.Minute))
+}
+
+func (r *Receiver) handleHandshake(p *packets.Control, addr *net.UDPAddr) {
+	hs, err := packets.ParseHandshakeControl(p.ControlInformationField)
+	if err != nil {
+		r.log.Debug("error parsing handshake", "peer", addr, "err", err)
+		r.metrics.handshakeFailure("malformed")
+		return
+	}
+
+	switch hs.HandshakeType {
+	case packets.Induction:
+		r.handleInduction(hs, addr)
+	case packets.Conclusion:
+		r.handleConclusion(p, hs, addr)
+	default:
+		r.log.Debug("unexpected handshake type", "peer", addr, "handshake_type", fmt.Sprintf("%08x", uint32(hs.HandshakeType)))
+	}
+}
+
+func (r *Receiver) handleInduction(hs *packets.HandshakeControl, addr *net.UDPAddr) {
+	r.log.Debug("induction", "peer", addr, "peer_socket", fmt.Sprintf("%08x", hs.SRTSocketID))
+
+	resp := *hs
+	resp.Version = 5
+	resp.EncryptionField = packets.NoEncryption
+	resp.ExtensionField = packets.SRTMagicCode
+	resp.SYNCookie = r.synCookie(addr, time.Now())
+	resp.PeerIPAddress = packets.NewPeerIPAddress(addr.IP)
+	resp.Extensions = nil
+
+	r.sendHandshake(resp.Marshal(), hs.SRTSocketID, r.timestamp(), addr)
+}
+
+func (r *Receiver) handleConclusion(p *packets.Control, hs *packets.HandshakeControl, addr *net.UDPAddr) {
+	r.mu.Lock()
+	existing := r.peers[peerKey(addr, hs.SRTSocketID)]
+	r.mu.Unlock()
+	if existing != nil {
+		// our response was lost and the caller repeated its conclusion
+		r.sendHandshake(existing.conclusionResponse, existing.peerSocket, existing.timestamp(), addr)
+		return
+	}
+
+	if !r.validCookie(addr, hs.SYNCookie) {
+		r.log.Warn("conclusion with invalid cookie", "peer", addr, "cookie", fmt.Sprintf("%08x", hs.SYNCookie))
+		r.metrics.handshakeFailure("invalid_cookie")
+		return
+	}
+	if hs.Version != 4 && hs.Version != 5 {
+		r.reject(hs, packets.RejectVersion, addr, fmt.Errorf("unsupported handshake version %d", hs.Version))
+		return
+	}
+	if limit := r.opts.MaxConnections; limit > 0 {
+		r.mu.Lock()
+		n := len(r.connections)
+		r.mu.Unlock()
+		if n >= limit {
+			r.reject(hs, packets.RejectBacklog, addr, fmt.Errorf("%d connections already", n))
+			return
+		}
+	}
+	if mtu := min(int(hs.MaximumTransmissionUnitSize), r.opts.MTU); mtu < packets.MinMTU {
+		r.reject(hs, packets.RejectRogue, addr, fmt.Errorf("MTU %d is below %d", mtu, packets.MinMTU))
+		return
+	}
+	if hs.MaximumFlowWindowSize == 0 {
+		r.reject(hs, packets.RejectRogue, addr, errors.New("flow window of 0 packets"))
+		return
+	}
+	if hs.Version == 4 {
+		r.handleLegacyConclusion(p, hs, addr)
+		return
+	}
+
+	hsreqData, ok := hs.Extension(packets.HSREQ)
+	if !ok {
+		r.reject(hs, packets.RejectRogue, addr, errors.New("conclusion without HSREQ extension"))
+		return
+	}
+	hsreq, err := packets.ParseHandshakeExtensionMessage(hsreqData)
+	if err != nil {
+		r.reject(hs, packets.RejectRogue, addr, err)
+		return
+	}
+	if hsreq.SRTVersion < r.opts.MinPeerVersion {
+		r.reject(hs, packets.RejectVersion, addr, fmt.Errorf("SRT version %s is older than %s", hsreq.SRTVersion, r.opts.MinPeerVersion))
+		return
+	}
+	if hsreq.SRTFlags&packets.STREAM != 0 {
+		r.reject(hs, packets.RejectMessageAPI, addr, errors.New("stream mode is not supported"))
+		return
+	}
+	if _, ok := hs.Extension(packets.KMREQ); ok {
+		r.reject(hs, packets.RejectUnsecure, addr, errors.New("encryption is not supported"))
+		return
+	}
+	if data, ok := hs.Extension(packets.Congestion); ok {
+		m, err := packets.ParseCongestionExtensionMessage(data)
+		if err != nil {
+			r.reject(hs, packets.RejectRogue, addr, err)
+			return
+		}
+		if m.Type != packets.LiveCongestion {
+			r.reject(hs, packets.RejectCongestion, addr, fmt.Errorf("congestion controller %q is not supported", m.Type))
+			return
+		}
+	}
+
+	streamID := ""
+	if sidData, ok := hs.Extension(packets.SID); ok {
+		sid, err := packets.ParseStreamIdExtensionMessage(sidData)
+		if err != nil {
+			r.reject(hs, packets.RejectRogue, addr, err)
+			return
+		}
+		if hsreq.SRTVersion >= packets.MinVersionStreamID {
+			streamID = sid.StreamID
+		} else {
+			r.log.Warn("ignoring stream ID of an older peer", "peer", addr, "version", hsreq.SRTVersion.String())
+		}
+	}
+
+	peerFilter := ""
+	if filterData, ok := hs.Extension(packets.Filter); ok {
+		ext, err := packets.ParseFilterExtensionMessage(filterData)
+		if err != nil {
+			r.reject(hs, packets.RejectRogue, addr, err)
+			return
+		}
+		peerFilter = ext.Config
+	}
+	filterConfig, err := filter.Negotiate(r.opts.PacketFilter, peerFilter)
+	if err == nil && filterConfig != "" && (hsreq.SRTFlags&packets.PACKETFILTER == 0 || hsreq.SRTVersion < packets.MinVersionFilter) {
+		err = errors.New("peer does not support packet filters")
+	}
+	if err != nil {
+		r.reject(hs, packets.RejectFilter, addr, err)
+		return
+	}
+
+	var groupExt *packets.GroupMembershipExtension
+	if groupData, ok := hs.Extension(packets.Group); ok {
+		if groupExt, err = packets.ParseGroupMembershipExtension(groupData); err != nil {
+			r.reject(hs, packets.RejectRogue, addr, err)
+			return
+		}
+		if hsreq.SRTVersion < packets.MinVersionGroup {
+			r.reject(hs, packets.RejectGroup, addr, fmt.Errorf("SRT version %s does not support groups", hsreq.SRTVersion))
+			return
+		}
+		if filterConfig != "" && groupExt.Type == packets.GTYPE_BALANCING {
+			// a balancing member only sees part of the stream
+			r.reject(hs, packets.RejectFilter, addr, fmt.Errorf("packet filter not supported by %s groups", groupExt.Type))
+			return
+		}
+	}
+
+	var pf filter.Filter
+	if filterConfig != "" {
+		if pf, err = filter.New(filterConfig, hs.InitialPacketSequenceNumber); err != nil {
+			r.reject(hs, packets.RejectFilter, addr, err)
+			return
+		}
+	}
+
+	latency := r.opts.Latency
+	if peer := time.Duration(hsreq.SenderTSBPDDelay) * time.Millisecond; peer > latency {
+		latency = peer
+	}
+
+	// each direction has a delay of its own, the greater of both proposals
+	sendLatency := r.opts.SendLatency
+	if peer := time.Duration(hsreq.ReceiverTSBPDDelay) * time.Millisecond; peer > sendLatency {
+		sendLatency = peer
+	}
+
+	c := r.newConnection(p, hs, addr, latency)
+	c.streamID = streamID
+	c.filter = pf
+	c.peerReceives = hsreq.SRTFlags&packets.TSBPDRCV != 0
+	// periodic NAKs are sent both ways only if the caller sends them too,
+	// so that either side may rely on the timer retransmit otherwise
+	c.periodicNAK = hsreq.SRTFlags&packets.PERIODICNAK != 0
+	c.sendQueue.PeriodicNAK = c.periodicNAK
+	c.sendLatency = sendLatency
+	if !r.register(c, hs, addr) {
+		return
+	}
+
+	resp := &packets.HandshakeControl{
+		Version:                     5,
+		EncryptionField:             packets.NoEncryption,
+		ExtensionField:              packets.HSREQFlag,
+		InitialPacketSequenceNumber: hs.InitialPacketSequenceNumber,
+		MaximumTransmissionUnitSize: uint32(c.mtu),
+		MaximumFlowWindowSize:       uint32(r.opts.ReceiveBuffer),
+		HandshakeType:               packets.Conclusion,
+		SRTSocketID:                 c.socketID,
+		PeerIPAddress:               packets.NewPeerIPAddress(addr.IP),
+	}
+	hsrsp := packets.HandshakeExtensionMessage{
+		SRTVersion:         srtVersion,
+		SRTFlags:           packets.TSBPDSND | packets.TSBPDRCV | packets.CRYPT | packets.TLPKTDROP | hsreq.SRTFlags&packets.PERIODICNAK | packets.REXMITFLG | packets.PACKETFILTER,
+		ReceiverTSBPDDelay: uint16(latency / time.Millisecond),
+		SenderTSBPDDelay:   uint16(sendLatency / time.Millisecond),
+	}
+	resp.AddExtension(packets.HSRSP, hsrsp.Marshal())
+
+	var groupResp []byte
+	if groupExt != nil {
+		g, err := r.joinGroup(c, groupExt)
+		if err != nil {
+			r.mux.Unregister(c.socketID)
+			c.state.Set(state.Broken, err)
+			c.state.Set(state.Closed, err)
+			r.reject(hs, packets.RejectGroup, addr, err)
+			return
+		}
+		resp.ExtensionField |= packets.CONFIGFlag
+		groupResp = g.response(c).Marshal()
+	} else {
+		c.buf = r.newRecvBuffer(false, c.log)
+	}
+	if filterConfig != "" {
+		resp.ExtensionField |= packets.CONFIGFlag
+		ext := packets.FilterExtensionMessage{Config: filterConfig}
+		resp.AddExtension(packets.Filter, ext.Marshal())
+	}
+	if groupResp != nil {
+		resp.AddExtension(packets.Group, groupResp)
+	}
+	c.conclusionResponse = resp.Marshal()
+
+	c.log.Info("connected", "peer_socket", fmt.Sprintf("%08x", c.peerSocket),
+		"peer_version", hsreq.SRTVersion.String(), "stream_id", streamID, "latency", latency, "send_latency", sendLatency,
+		"filter", filterConfig, "mtu", c.mtu)
+	r.establish(c)
+}
+
+// newConnection sets up the state of a connection accepted from the
+// conclusion hs, before it is registered.
+func (r *Receiver) newConnection(p *packets.Control, hs *packets.HandshakeControl, addr *net.UDPAddr, latency time.Duration) *connection {
+	now := time.Now()
+	c := &connection{
+		peerSocket:     hs.SRTSocketID,
+		addr:           addr,
+		cookie:         hs.SYNCookie,
+		startTime:      now,
+		mux:            r.mux,
+		metrics:        r.metrics,
+		latency:        latency,
+		tsbpdBase:      now.Add(-time.Duration(p.Timestamp) * time.Microsecond),
+		isn:            hs.InitialPacketSequenceNumber,
+		seqs:           live.NewSeqTracker(hs.InitialPacketSequenceNumber),
+		rtt:            100 * time.Millisecond,
+		rttVar:         50 * time.Millisecond,
+		idleTimeout:    r.opts.PeerIdleTimeout,
+		mtu:            min(int(hs.MaximumTransmissionUnitSize), r.opts.MTU),
+		interval:       stats.NewInterval(now),
+		lastPacketTime: now,
+		stopACK:        make(chan struct{}),
+		nextSeq:        hs.InitialPacketSequenceNumber,
+		nextMsg:        1,
+	}
+	c.sendQueue = live.NewSendQueue(hs.SRTSocketID, int(hs.MaximumFlowWindowSize), &c.counters)
+	c.state = state.NewMachine(r.stateCallback(c))
+	c.release = func() { r.release(c) }
+	return c
+}
+
+// register gives c a socket ID, or rejects the conclusion hs if it
+// cannot.
+func (r *Receiver) register(c *connection, hs *packets.HandshakeControl, addr *net.UDPAddr) bool {
+	var err error
+	c.socketID, err = r.mux.Register(func(data []byte, from *net.UDPAddr) {
+		// only the caller may use the socket
+		if !from.IP.Equal(addr.IP) || from.Port != addr.Port {
+			return
+		}
+		if len(data) > c.mtu-packets.MTUOverhead {
+			c.log.Debug("dropping datagram larger than the MTU", "size", len(data), "mtu", c.mtu)
+			return
+		}
+		r.handlePacket(c, data, from)
+	})
+	if err != nil {
+		r.log.Error("error registering socket", "peer", addr, "err", err)
+		r.reject(hs, packets.RejectResource, addr, err)
+		return false
+	}
+	c.log = r.log.With("socket", fmt.Sprintf("%08x", c.socketID), "peer", addr)
+	c.state.Set(state.Connecting, nil)
+	return true
+}
+
+// establish answers the conclusion with c.conclusionResponse and starts
+// serving c.
+func (r *Receiver) establish(c *connection) {
+	r.mu.Lock()
+	r.connections[c.socketID] = c
+	r.peers[peerKey(c.addr, c.peerSocket)] = c
+	r.mu.Unlock()
+
+	r.sendHandshake(c.conclusionResponse, c.peerSocket, c.timestamp(), c.addr)
+	r.metrics.accepted.Add(1)
+	c.state.Set(state.Connected, nil)
+	go c.ackLoop()
+}
+
+// reject responds to a conclusion with the reason it was rejected for,
+// err telling more in the log.
+func (r *Receiver) reject(hs *packets.HandshakeControl, reason packets.RejectReason, addr *net.UDPAddr, err error) {
+	r.log.Warn("rejecting connection", "peer", addr, "peer_socket", fmt.Sprintf("%08x", hs.SRTSocketID), "reason", reason.String(), "err", err)
+	r.metrics.reject(reason)
+
+	resp := *hs
+	resp.HandshakeType = packets.HandshakeType(reason)
+	resp.Extensions = nil
+	r.sendHandshake(resp.Marshal(), hs.SRTSocketID, r.timestamp(), addr)
+}
+
+func (r *Receiver) sendHandshake(cif []byte, dst uint32, timestamp uint32, addr *net.UDPAddr) {
+	p := packets.Control{
+		ControlType:             packets.HANDSHAKE,
+		Timestamp:               timestamp,
+		DestinationSocketID:     dst,
+		ControlInformationField: cif,
+	}
+	if err := r.mux.WriteTo(p.Marshal(), addr); err != nil {
+		r.log.Error("error sending handshake", "peer", addr, "err", err)
+	}
+}
+
+func (r *Receiver) timestamp() uint32 {
+	return uint32(time.Since(r.startTime).Microseconds())
+}
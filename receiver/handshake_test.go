@@ -0,0 +1,283 @@
+package receiver_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"coresrt/mux"
+	"coresrt/packets"
+	"coresrt/receiver"
+	"coresrt/sender"
+	"coresrt/transport"
+)
+
+var discard = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// rewriteConn is the caller end of a pipe, changing the conclusions sent
+// by the caller and collecting the rejections sent back.
+type rewriteConn struct {
+	net.PacketConn
+	rewrite    func(hs *packets.HandshakeControl)
+	rejections chan packets.RejectReason
+}
+
+func (c *rewriteConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if p, err := packets.ParseControlPacket(b); err == nil && p.ControlType == packets.HANDSHAKE {
+		hs, err := packets.ParseHandshakeControl(p.ControlInformationField)
+		if err == nil && hs.HandshakeType == packets.Conclusion {
+			c.rewrite(hs)
+			p.ControlInformationField = hs.Marshal()
+			c.PacketConn.WriteTo(p.Marshal(), addr)
+			return len(b), nil
+		}
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func (c *rewriteConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if p, perr := packets.ParseControlPacket(b[:n]); err == nil && perr == nil && p.ControlType == packets.HANDSHAKE {
+		if hs, perr := packets.ParseHandshakeControl(p.ControlInformationField); perr == nil {
+			if reason, ok := hs.HandshakeType.RejectReason(); ok {
+				select {
+				case c.rejections <- reason:
+				default:
+				}
+			}
+		}
+	}
+	return n, addr, err
+}
+
+// hsreq returns a rewrite of the HSREQ extension of a conclusion.
+func hsreq(f func(m *packets.HandshakeExtensionMessage)) func(hs *packets.HandshakeControl) {
+	return func(hs *packets.HandshakeControl) {
+		for i, ext := range hs.Extensions {
+			if ext.Type != packets.HSREQ {
+				continue
+			}
+			m, err := packets.ParseHandshakeExtensionMessage(ext.Contents)
+			if err != nil {
+				panic(err)
+			}
+			f(m)
+			hs.Extensions[i].Contents = m.Marshal()
+		}
+	}
+}
+
+func TestRejections(t *testing.T) {
+	tests := []struct {
+		name    string
+		rewrite func(hs *packets.HandshakeControl)
+		want    packets.RejectReason
+	}{
+		{"handshake version", func(hs *packets.HandshakeControl) { hs.Version = 6 }, packets.RejectVersion},
+		{"MTU below the minimum", func(hs *packets.HandshakeControl) {
+			hs.MaximumTransmissionUnitSize = packets.MinMTU - 1
+		}, packets.RejectRogue},
+		{"flow window of 0 packets", func(hs *packets.HandshakeControl) { hs.MaximumFlowWindowSize = 0 }, packets.RejectRogue},
+		{"missing HSREQ", func(hs *packets.HandshakeControl) {
+			hs.Extensions = slices.DeleteFunc(hs.Extensions, func(ext packets.HandshakeExtension) bool { return ext.Type == packets.HSREQ })
+		}, packets.RejectRogue},
+		{"stream mode", hsreq(func(m *packets.HandshakeExtensionMessage) { m.SRTFlags |= packets.STREAM }), packets.RejectMessageAPI},
+		{"encryption", func(hs *packets.HandshakeControl) {
+			hs.AddExtension(packets.KMREQ, make([]byte, 16))
+		}, packets.RejectUnsecure},
+		{"congestion controller", func(hs *packets.HandshakeControl) {
+			m := packets.CongestionExtensionMessage{Type: "file"}
+			hs.AddExtension(packets.Congestion, m.Marshal())
+		}, packets.RejectCongestion},
+		{"unknown packet filter", func(hs *packets.HandshakeControl) {
+			m := packets.FilterExtensionMessage{Config: "bogus,cols:10"}
+			hs.AddExtension(packets.Filter, m.Marshal())
+		}, packets.RejectFilter},
+		{"group of a version without groups", func(hs *packets.HandshakeControl) {
+			hsreq(func(m *packets.HandshakeExtensionMessage) { m.SRTVersion = packets.MinVersionGroup - 1 })(hs)
+			g := packets.GroupMembershipExtension{GroupID: mux.NewGroupID(), Type: packets.GTYPE_BROADCAST}
+			hs.AddExtension(packets.Group, g.Marshal())
+		}, packets.RejectGroup},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := transport.Pipe()
+			listener := mux.New(a, discard)
+			defer listener.Close()
+			end := &rewriteConn{PacketConn: b, rewrite: tt.rewrite, rejections: make(chan packets.RejectReason, 1)}
+			caller := mux.New(end, discard)
+			defer caller.Close()
+			go receiver.Serve(listener, receiver.Options{Logger: discard})
+
+			conn, err := sender.Dial(listener.LocalAddr().String(), sender.Options{Mux: caller, Logger: discard})
+			if err == nil {
+				conn.Close()
+				t.Fatal("connection accepted")
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Dial: %v, want %v", err, tt.want)
+			}
+			select {
+			case got := <-end.rejections:
+				if got != tt.want {
+					t.Errorf("%v sent back, want %v", got, tt.want)
+				}
+			default:
+				t.Error("no rejection sent back")
+			}
+		})
+	}
+}
+
+func TestMinPeerVersion(t *testing.T) {
+	newer := packets.MakeVersion(1, 6, 0)
+	tests := []struct {
+		name             string
+		listener, caller packets.Version // MinPeerVersion of each side
+		want             error
+	}{
+		{"listener requires a newer caller", newer, 0, packets.RejectVersion},
+		{"caller at the listener minimum", packets.MinVersionGroup, 0, nil},
+		{"caller requires a newer listener", 0, newer, packets.RejectVersion},
+		{"listener at the caller minimum", 0, packets.MinVersionGroup, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := transport.Pipe()
+			listener := mux.New(a, discard)
+			defer listener.Close()
+			caller := mux.New(b, discard)
+			defer caller.Close()
+			go receiver.Serve(listener, receiver.Options{MinPeerVersion: tt.listener, Logger: discard})
+
+			conn, err := sender.Dial(listener.LocalAddr().String(), sender.Options{Mux: caller, MinPeerVersion: tt.caller, Logger: discard})
+			if err == nil {
+				conn.Close()
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Dial: %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// legacyCaller connects to the listener at the other end of conn with an
+// HSv4 handshake, returning the listener's socket ID.
+func legacyCaller(t *testing.T, conn net.PacketConn, to net.Addr, socketID uint32) uint32 {
+	t.Helper()
+	hs := packets.HandshakeControl{
+		Version:                     4,
+		ExtensionField:              2, // UDT_DGRAM
+		InitialPacketSequenceNumber: 1000,
+		MaximumTransmissionUnitSize: 1500,
+		MaximumFlowWindowSize:       8192,
+		HandshakeType:               packets.Induction,
+		SRTSocketID:                 socketID,
+	}
+	resp := handshake(t, conn, to, hs)
+	hs.HandshakeType = packets.Conclusion
+	hs.SYNCookie = resp.SYNCookie
+	resp = handshake(t, conn, to, hs)
+	if resp.HandshakeType != packets.Conclusion {
+		t.Fatalf("conclusion answered with %v", resp.HandshakeType)
+	}
+	return resp.SRTSocketID
+}
+
+// handshake sends hs until the listener answers it.
+func handshake(t *testing.T, conn net.PacketConn, to net.Addr, hs packets.HandshakeControl) *packets.HandshakeControl {
+	t.Helper()
+	req := packets.Control{ControlType: packets.HANDSHAKE, ControlInformationField: hs.Marshal()}
+	buf := make([]byte, 1500)
+	for range 10 {
+		if _, err := conn.WriteTo(req.Marshal(), to); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			continue
+		}
+		p, err := packets.ParseControlPacket(buf[:n])
+		if err != nil || p.ControlType != packets.HANDSHAKE {
+			continue
+		}
+		resp, err := packets.ParseHandshakeControl(p.ControlInformationField)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	t.Fatalf("no answer to the %v handshake", hs.HandshakeType)
+	return nil
+}
+
+// TestLegacyRefused checks that an HSv4 caller sending SRT extensions the
+// listener refuses once connected gets a SHUTDOWN, after a KMRSP telling
+// it that the listener has no passphrase if it asked for encryption.
+func TestLegacyRefused(t *testing.T) {
+	old := packets.HandshakeExtensionMessage{SRTVersion: packets.MakeVersion(1, 2, 0), SRTFlags: packets.TSBPDSND, SenderTSBPDDelay: 120}
+	tests := []struct {
+		name    string
+		subtype packets.ExtensionType
+		data    []byte
+		want    []string // packets received, by name
+	}{
+		{"KMREQ", packets.KMREQ, make([]byte, 16), []string{"KMRSP", "SHUTDOWN"}},
+		{"HSREQ older than MinPeerVersion", packets.HSREQ, old.Marshal(), []string{"SHUTDOWN"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := transport.Pipe()
+			listener := mux.New(a, discard)
+			defer listener.Close()
+			defer b.Close()
+			go receiver.Serve(listener, receiver.Options{MinPeerVersion: packets.MinVersionStreamID, Logger: discard})
+
+			const socketID = 0x1234
+			peer := legacyCaller(t, b, listener.LocalAddr(), socketID)
+			ext := packets.UserDefinedControlPacket{Subtype: tt.subtype, DestinationSocketID: peer, Contents: tt.data}
+			if _, err := b.WriteTo(ext.Marshal(), listener.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+
+			// ACKs and keep-alives may come in between
+			var got []string
+			buf := make([]byte, 1500)
+			b.SetReadDeadline(time.Now().Add(time.Second))
+			for len(got) < len(tt.want) {
+				n, _, err := b.ReadFrom(buf)
+				if err != nil {
+					t.Fatalf("received %v, want %v: %v", got, tt.want, err)
+				}
+				p, err := packets.ParseControlPacket(buf[:n])
+				if err != nil || p.DestinationSocketID != socketID {
+					continue
+				}
+				switch p.ControlType {
+				case packets.UserDefinedType:
+					u, err := packets.ParseUserDefinedControlPacket(p)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if u.Subtype == packets.KMRSP {
+						if state := binary.BigEndian.Uint32(u.Contents); packets.KeyMaterialState(state) != packets.KMNoSecret {
+							t.Errorf("KMRSP state %d, want %d", state, packets.KMNoSecret)
+						}
+					}
+					got = append(got, u.Subtype.String())
+				case packets.SHUTDOWN:
+					got = append(got, "SHUTDOWN")
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("received %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
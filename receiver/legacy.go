@@ -0,0 +1,111 @@
+package receiver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"coresrt/packets"
+	"coresrt/state"
+)
+
+// handleLegacyConclusion accepts an HSv4 caller. Its conclusion carries no
+// SRT extensions: the HSREQ follows in a user-defined control packet once
+// connected, and the connection runs with our latency until then.
+func (r *Receiver) handleLegacyConclusion(p *packets.Control, hs *packets.HandshakeControl, addr *net.UDPAddr) {
+	c := r.newConnection(p, hs, addr, r.opts.Latency)
+	c.legacy = true
+	if !r.register(c, hs, addr) {
+		return
+	}
+	c.buf = r.newRecvBuffer(false, c.log)
+
+	// the response keeps the socket type of the request in the extension
+	// field, as HSv4 did
+	resp := *hs
+	resp.EncryptionField = packets.NoEncryption
+	resp.MaximumTransmissionUnitSize = uint32(c.mtu)
+	resp.MaximumFlowWindowSize = uint32(r.opts.ReceiveBuffer)
+	resp.SRTSocketID = c.socketID
+	resp.PeerIPAddress = packets.NewPeerIPAddress(addr.IP)
+	resp.Extensions = nil
+	c.conclusionResponse = resp.Marshal()
+
+	c.log.Info("connected", "peer_socket", fmt.Sprintf("%08x", c.peerSocket),
+		"handshake_version", hs.Version, "latency", c.latency, "mtu", c.mtu)
+	r.establish(c)
+}
+
+// handleLegacyExtension answers the SRT extensions an HSv4 caller sends
+// once connected, which it repeats until answered.
+func (r *Receiver) handleLegacyExtension(c *connection, p *packets.Control) {
+	u, err := packets.ParseUserDefinedControlPacket(p)
+	if err != nil {
+		c.log.Debug("malformed control packet", "err", err)
+		return
+	}
+
+	switch u.Subtype {
+	case packets.HSREQ:
+		hsreq, err := packets.ParseHandshakeExtensionMessage(u.Contents)
+		if err != nil {
+			c.log.Debug("malformed control packet", "err", err)
+			return
+		}
+		if hsreq.SRTVersion < r.opts.MinPeerVersion {
+			r.refuseLegacy(c, packets.RejectVersion, fmt.Errorf("SRT version %s is older than %s", hsreq.SRTVersion, r.opts.MinPeerVersion))
+			return
+		}
+
+		// the legacy TSBPD delay is the lower half of the third word
+		c.mu.Lock()
+		if peer := time.Duration(hsreq.SenderTSBPDDelay) * time.Millisecond; peer > c.latency {
+			c.latency = peer
+		}
+		latency := c.latency
+		c.periodicNAK = hsreq.SRTFlags&packets.PERIODICNAK != 0
+		c.mu.Unlock()
+		c.log.Debug("legacy HSREQ", "peer_version", hsreq.SRTVersion.String(), "flags", hsreq.SRTFlags, "latency", latency)
+
+		hsrsp := packets.HandshakeExtensionMessage{
+			SRTVersion:       srtVersion,
+			SRTFlags:         packets.TSBPDRCV | packets.TLPKTDROP | hsreq.SRTFlags&(packets.PERIODICNAK|packets.REXMITFLG),
+			SenderTSBPDDelay: uint16(latency / time.Millisecond),
+		}
+		c.sendExtension(packets.HSRSP, hsrsp.Marshal())
+	case packets.KMREQ:
+		c.sendExtension(packets.KMRSP, binary.BigEndian.AppendUint32(nil, uint32(packets.KMNoSecret)))
+		r.refuseLegacy(c, packets.RejectUnsecure, errors.New("encryption is not supported"))
+	default:
+		c.log.Debug("unhandled control packet", "control_type", p.ControlType, "subtype", u.Subtype)
+	}
+}
+
+// refuseLegacy closes a legacy connection for an extension its caller
+// sent once connected, too late for a rejection code.
+func (r *Receiver) refuseLegacy(c *connection, reason packets.RejectReason, err error) {
+	if !c.end(state.Broken, reason) {
+		return
+	}
+	c.log.Warn("closing legacy connection", "reason", reason.String(), "err", err)
+	r.metrics.reject(reason)
+
+	shutdown := packets.ShutdownControlPacket{
+		Timestamp:           c.timestamp(),
+		DestinationSocketID: c.peerSocket,
+	}
+	c.send(shutdown.Marshal())
+	c.finish(reason)
+}
+
+func (c *connection) sendExtension(typ packets.ExtensionType, contents []byte) {
+	u := packets.UserDefinedControlPacket{
+		Subtype:             typ,
+		Timestamp:           c.timestamp(),
+		DestinationSocketID: c.peerSocket,
+		Contents:            contents,
+	}
+	c.send(u.Marshal())
+}
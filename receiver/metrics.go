@@ -0,0 +1,223 @@
+package receiver
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"coresrt/packets"
+	"coresrt/stats"
+)
+
+// rttBuckets are the upper bounds of the RTT histogram, in seconds.
+var rttBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// metrics are the listener-wide counters exported at /metrics.
+// Per-connection metrics come from the statistics of each connection.
+type metrics struct {
+	accepted        atomic.Uint64
+	packetsReceived atomic.Uint64
+	packetsLost     atomic.Uint64
+	tsbpdDropped    atomic.Uint64 // skipped at delivery as too late
+	overflowed      atomic.Uint64 // dropped with the receive buffer full
+
+	mu         sync.Mutex
+	rejected   map[string]uint64 // key: rejection reason
+	failures   map[string]uint64 // key: reason the handshake was ignored
+	rttCounts  []uint64          // per bucket, not cumulative, +Inf last
+	rttSum     float64
+	rttSamples uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		rejected:  make(map[string]uint64),
+		failures:  make(map[string]uint64),
+		rttCounts: make([]uint64, len(rttBuckets)+1),
+	}
+}
+
+// reject counts a rejection under the name of its code, such as
+// "filter" for REJ_FILTER.
+func (m *metrics) reject(reason packets.RejectReason) {
+	name := strings.ToLower(strings.TrimPrefix(reason.String(), "REJ_"))
+	m.mu.Lock()
+	m.rejected[name]++
+	m.mu.Unlock()
+}
+
+// handshakeFailure counts a handshake ignored without a rejection.
+func (m *metrics) handshakeFailure(reason string) {
+	m.mu.Lock()
+	m.failures[reason]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) observeRTT(rtt time.Duration) {
+	s := rtt.Seconds()
+	i := sort.SearchFloat64s(rttBuckets, s)
+	m.mu.Lock()
+	m.rttCounts[i]++
+	m.rttSum += s
+	m.rttSamples++
+	m.mu.Unlock()
+}
+
+// serveMetrics exports the metrics in the Prometheus text format on addr
+// until done is closed.
+func (r *Receiver) serveMetrics(addr string, done <-chan struct{}) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("error listening for metrics: %w", err)
+	}
+	handler := http.NewServeMux()
+	handler.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.writeMetrics(w)
+	})
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-done
+		srv.Close()
+	}()
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			r.log.Error("error serving metrics", "err", err)
+		}
+	}()
+	r.log.Info("exporting metrics", "url", fmt.Sprintf("http://%s/metrics", ln.Addr()))
+	return nil
+}
+
+func (r *Receiver) writeMetrics(w io.Writer) {
+	m := r.metrics
+
+	r.mu.Lock()
+	conns := make([]*connection, 0, len(r.connections))
+	for _, c := range r.connections {
+		conns = append(conns, c)
+	}
+	r.mu.Unlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].socketID < conns[j].socketID })
+
+	family(w, "srt_connections", "gauge", "Connections currently established.")
+	sample(w, "srt_connections", "", len(conns))
+	family(w, "srt_connections_accepted_total", "counter", "Connections accepted.")
+	sample(w, "srt_connections_accepted_total", "", m.accepted.Load())
+
+	m.mu.Lock()
+	family(w, "srt_connections_rejected_total", "counter", "Connection requests rejected, by reason.")
+	for _, reason := range sortedKeys(m.rejected) {
+		sample(w, "srt_connections_rejected_total", labels("reason", reason), m.rejected[reason])
+	}
+	family(w, "srt_handshake_failures_total", "counter", "Handshakes ignored as invalid, by reason.")
+	for _, reason := range sortedKeys(m.failures) {
+		sample(w, "srt_handshake_failures_total", labels("reason", reason), m.failures[reason])
+	}
+	family(w, "srt_rtt_seconds", "histogram", "Round trip time samples of all connections.")
+	cumulative := uint64(0)
+	for i, le := range rttBuckets {
+		cumulative += m.rttCounts[i]
+		sample(w, "srt_rtt_seconds_bucket", labels("le", fmt.Sprint(le)), cumulative)
+	}
+	sample(w, "srt_rtt_seconds_bucket", labels("le", "+Inf"), m.rttSamples)
+	sample(w, "srt_rtt_seconds_sum", "", m.rttSum)
+	sample(w, "srt_rtt_seconds_count", "", m.rttSamples)
+	m.mu.Unlock()
+
+	family(w, "srt_packets_received_total", "counter", "Data packets received by all connections.")
+	sample(w, "srt_packets_received_total", "", m.packetsReceived.Load())
+	family(w, "srt_packets_lost_total", "counter", "Data packets detected missing by all connections.")
+	sample(w, "srt_packets_lost_total", "", m.packetsLost.Load())
+	family(w, "srt_tsbpd_dropped_packets_total", "counter", "Data packets skipped at delivery as too late.")
+	sample(w, "srt_tsbpd_dropped_packets_total", "", m.tsbpdDropped.Load())
+	family(w, "srt_receive_buffer_overflow_packets_total", "counter", "Data packets dropped as the receive buffer was full.")
+	sample(w, "srt_receive_buffer_overflow_packets_total", "", m.overflowed.Load())
+
+	type connMetric struct {
+		name, typ, help string
+		value           func(s stats.Stats) any
+	}
+	perConn := []connMetric{
+		{"srt_connection_packets_received_total", "counter", "Data packets received.",
+			func(s stats.Stats) any { return s.Total.PacketsReceived }},
+		{"srt_connection_bytes_received_total", "counter", "Payload bytes received.",
+			func(s stats.Stats) any { return s.Total.BytesReceived }},
+		{"srt_connection_packets_lost_total", "counter", "Data packets detected missing.",
+			func(s stats.Stats) any { return s.Total.PacketsLost }},
+		{"srt_connection_packets_retransmitted_total", "counter", "Retransmitted data packets received.",
+			func(s stats.Stats) any { return s.Total.PacketsRetransmitted }},
+		{"srt_connection_packets_dropped_total", "counter", "Lost data packets given up on as too late.",
+			func(s stats.Stats) any { return s.Total.PacketsDropped }},
+		{"srt_connection_packets_belated_total", "counter", "Data packets received after their delivery time.",
+			func(s stats.Stats) any { return s.Total.PacketsBelated }},
+		{"srt_connection_loss_ratio", "gauge", "Share of the data packets detected missing.",
+			func(s stats.Stats) any { return lossRatio(s.Total.PacketsReceived, s.Total.PacketsLost) }},
+		{"srt_connection_rtt_seconds", "gauge", "Smoothed round trip time.",
+			func(s stats.Stats) any { return s.RTT.Seconds() }},
+		{"srt_connection_latency_seconds", "gauge", "Negotiated TSBPD latency of the data received.",
+			func(s stats.Stats) any { return s.ReceiveLatency.Seconds() }},
+		{"srt_connection_receive_buffer_packets", "gauge", "Packets waiting for delivery.",
+			func(s stats.Stats) any { return s.ReceiveBuffer.Packets }},
+	}
+	snapshots := make([]stats.Stats, len(conns))
+	for i, c := range conns {
+		snapshots[i] = (&Conn{c: c}).Stats(false)
+	}
+	for _, cm := range perConn {
+		family(w, cm.name, cm.typ, cm.help)
+		for i, c := range conns {
+			sample(w, cm.name, labels(
+				"socket_id", fmt.Sprintf("%08x", c.socketID),
+				"peer", c.addr.String(),
+				"stream_id", c.streamID,
+			), cm.value(snapshots[i]))
+		}
+	}
+}
+
+func lossRatio(received, lost uint64) float64 {
+	if received+lost == 0 {
+		return 0
+	}
+	return float64(lost) / float64(received+lost)
+}
+
+func family(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func sample(w io.Writer, name, labels string, value any) {
+	fmt.Fprintf(w, "%s%s %v\n", name, labels, value)
+}
+
+// labels formats name/value pairs as a Prometheus label set.
+func labels(pairs ...string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", pairs[i], labelEscaper.Replace(pairs[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,123 @@
+package receiver
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"coresrt/internal/live"
+	"coresrt/mux"
+	"coresrt/packets"
+	"coresrt/stats"
+	"coresrt/transport"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+// checkGolden compares got with the golden file testdata/name.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s, run with -update to rewrite it:\n%s", path, got)
+	}
+}
+
+// addConnection adds an established connection with the given totals
+// and packets waiting in its buffer.
+func addConnection(t *testing.T, r *Receiver, socketID uint32, peer, streamID string, rtt time.Duration, counters stats.Counters, buffered int) *connection {
+	t.Helper()
+	addr, err := net.ResolveUDPAddr("udp", peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &connection{
+		socketID:   socketID,
+		peerSocket: socketID + 1,
+		addr:       addr,
+		startTime:  time.Now(),
+		metrics:    r.metrics,
+		streamID:   streamID,
+		latency:    120 * time.Millisecond,
+		rtt:        rtt,
+		counters:   counters,
+	}
+	c.buf = live.NewRecvBuffer(io.Discard, 64, false, &r.metrics.tsbpdDropped, nil)
+	for i := range uint32(buffered) {
+		c.buf.Push(i, make([]byte, 100), time.Now().Add(time.Hour))
+	}
+	c.sendQueue = live.NewSendQueue(c.peerSocket, 8192, &c.counters)
+	r.mu.Lock()
+	r.connections[socketID] = c
+	r.peers[peerKey(addr, c.peerSocket)] = c
+	r.mu.Unlock()
+	return c
+}
+
+func TestWriteMetrics(t *testing.T) {
+	end, _ := transport.Pipe()
+	m := mux.New(end, nil)
+	defer m.Close()
+	r := &Receiver{
+		mux:         m,
+		connections: make(map[uint32]*connection),
+		peers:       make(map[string]*connection),
+		groups:      make(map[uint32]*group),
+		metrics:     newMetrics(),
+	}
+
+	r.metrics.accepted.Add(3)
+	r.metrics.reject(packets.RejectRogue)
+	r.metrics.reject(packets.RejectRogue)
+	r.metrics.reject(packets.RejectFilter)
+	r.metrics.reject(packets.RejectVersion)
+	r.metrics.handshakeFailure("malformed")
+	r.metrics.handshakeFailure("invalid_cookie")
+	r.metrics.handshakeFailure("invalid_cookie")
+	// samples below, on and between bounds, and one above all the buckets
+	for _, rtt := range []time.Duration{500 * time.Microsecond, time.Millisecond, 20 * time.Millisecond, 20 * time.Millisecond, 2 * time.Second} {
+		r.metrics.observeRTT(rtt)
+	}
+	r.metrics.packetsReceived.Add(1100)
+	r.metrics.packetsLost.Add(12)
+	r.metrics.tsbpdDropped.Add(2)
+	r.metrics.overflowed.Add(1)
+
+	second := addConnection(t, r, 0x2000, "10.0.0.2:5000", "live/second", 20*time.Millisecond, stats.Counters{
+		PacketsReceived: 100, BytesReceived: 131600,
+	}, 0)
+	defer second.buf.Close()
+	first := addConnection(t, r, 0x1000, "10.0.0.1:5000", "#!::r=live/\"first\"\\\n", 4*time.Millisecond, stats.Counters{
+		PacketsReceived:      1000,
+		BytesReceived:        1316000,
+		PacketsLost:          10,
+		PacketsRetransmitted: 8,
+		PacketsDropped:       2,
+		PacketsBelated:       1,
+	}, 3)
+
+	var out bytes.Buffer
+	r.writeMetrics(&out)
+	checkGolden(t, "metrics.golden", out.Bytes())
+
+	// the samples of a closed connection are gone, the listener-wide
+	// counters stay
+	r.release(first)
+	out.Reset()
+	r.writeMetrics(&out)
+	checkGolden(t, "metrics_closed.golden", out.Bytes())
+}
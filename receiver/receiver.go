@@ -1,22 +1,73 @@
 package receiver
 
 import (
-	"encoding/binary"
+	"context"
+	"crypto/rand"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"coresrt/filter"
+	"coresrt/internal/live"
+	"coresrt/mux"
+	"coresrt/packets"
+	"coresrt/record"
+	"coresrt/seqno"
+	"coresrt/state"
+	"coresrt/stats"
+)
+
+const (
+	defaultLatency         = 120 * time.Millisecond
+	defaultPeerIdleTimeout = 5 * time.Second
+	ackInterval            = 10 * time.Millisecond
+	keepAliveInterval      = time.Second               // when nothing else was sent
+	srtVersion             = packets.Version(0x010500) // 1.5.0
 )
 
-type Options struct{}
+// LevelTrace is the log level below debug at which each datagram is
+// logged with a hex dump.
+const LevelTrace = slog.LevelDebug - 4
+
+type Options struct {
+	Latency         time.Duration   // receiver TSBPD delay, 120ms if zero
+	SendLatency     time.Duration   // sender TSBPD delay of what Conn.Write sends back, the caller's receiver delay if greater
+	Output          io.Writer       // delivered payloads are written here, discarded if nil
+	PacketFilter    string          // packet filter configuration, such as "xorfec,cols:10,rows:5"
+	PeerIdleTimeout time.Duration   // connections silent this long are closed, 5s if zero
+	MetricsAddr     string          // TCP address of the HTTP endpoint exporting metrics at /metrics, none if empty
+	Logger          *slog.Logger    // slog.Default() if nil
+	DumpSample      int             // log a hex dump of one datagram in this many at debug level, none if zero
+	Record          io.Writer       // every datagram received is recorded here in the format of package record, if set
+	MaxConnections  int             // callers beyond this many connections are rejected with REJ_BACKLOG, no limit if zero
+	MinPeerVersion  packets.Version // callers of an older SRT version are rejected with REJ_VERSION, none if zero
+	MTU             int             // largest IP packet accepted from and sent to callers, 1500 if zero
+	ReceiveBuffer   int             // packets each connection or group holds until delivery, the flow window of callers, 8192 if zero
+
+	// OnStateChange, if set, is called on each state change of each
+	// connection, from the goroutine that made it. It must not block.
+	OnStateChange func(c *Conn, ch state.Change)
+}
 
 type Receiver struct {
-	conn        *net.UDPConn
-	connections map[string]*connection // key: remote addr string
-	mu          sync.Mutex
-	startTime   time.Time
+	mux          *mux.Mux
+	opts         Options
+	output       io.Writer
+	connections  map[uint32]*connection // key: our socket ID
+	peers        map[string]*connection // key: peerKey of the caller
+	groups       map[uint32]*group      // key: caller's group ID
+	mu           sync.Mutex
+	startTime    time.Time
+	cookieSecret [16]byte
+	metrics      *metrics
+	log          *slog.Logger
+	datagrams    atomic.Uint64 // received, for dump sampling
+	recorder     *record.Writer
 }
 
 type connection struct {
@@ -25,80 +76,267 @@ type connection struct {
 	addr       *net.UDPAddr
 	cookie     uint32
 	startTime  time.Time
+	mux        *mux.Mux
+	log        *slog.Logger
+	metrics    *metrics // the receiver's
+	streamID   string
+	state      *state.Machine
+
+	conclusionResponse []byte // handshake CIF, resent if the caller repeats its conclusion
+	legacy             bool   // HSv4 caller, sending its SRT extensions once connected
+
+	// TSBPD
+	latency   time.Duration    // negotiated receiver delay
+	tsbpdBase time.Time        // local time of peer timestamp 0
+	timeline  seqno.Timeline   // of the caller's timestamps
+	buf       *live.RecvBuffer // own buffer, or the group's when grouped
+	group     *group
+	assembler *messageAssembler // only for message-synchronized groups
+	filter    filter.Filter     // negotiated packet filter, if any
 
 	// Sequence tracking for ACKs
 	mu              sync.Mutex
-	lastAckedSeq    uint32 // last sequence number we ACKed
-	highestSeq      uint32 // highest contiguous sequence number received
-	seqInitialized  bool   // whether we've seen the first data packet
-	ackNumber       uint32 // sequential ACK number (starts at 1)
-	packetsReceived uint64 // total packets received
-	bytesReceived   uint64 // total bytes received
+	isn             uint32          // initial sequence number from the handshake
+	seqs            live.SeqTracker // received sequence numbers and losses
+	seqInitialized  bool            // whether we've seen the first data packet
+	acks            live.ACKs       // full ACKs sent
+	periodicNAK     bool            // agreed in the handshake: losses are reported again every NAK interval
+	rtt             time.Duration
+	rttVar          time.Duration
+	window          stats.Window   // arrivals, for the receiving rate and link capacity
+	counters        stats.Counters // totals since the connection started
+	interval        stats.Interval
+	mtu             int // negotiated
 	firstPacketTime time.Time
 	lastPacketTime  time.Time
-	connected       bool // true after handshake complete
-	stopACK         chan struct{}
+	lastSendTime    time.Time
+	idleTimeout     time.Duration
+	stopACK         chan struct{} // closed when the connection ends
+	release         func()        // frees the connection's state in the receiver
+
+	// Sending back to the caller, with c.mu held
+	peerReceives bool          // whether the caller announced it receives data
+	sendLatency  time.Duration // negotiated sender delay
+	nextSeq      uint32
+	nextMsg      uint32
+	sendQueue    *live.SendQueue
 }
 
-func Start(port int, ipAddr string, opts Options) {
+// Start listens on ipAddr:port and serves SRT callers until the socket
+// fails, returning the error that stopped it.
+func Start(port int, ipAddr string, opts Options) error {
 	addr := net.UDPAddr{
 		Port: port,
 		IP:   net.ParseIP(ipAddr),
 	}
-	conn, err := net.ListenUDP("udp", &addr)
+	m, err := mux.Listen(&addr, opts.Logger)
 	if err != nil {
-		log.Fatalf("error listening on UDP port: %v", err)
+		return fmt.Errorf("error listening on UDP port: %w", err)
 	}
-	defer conn.Close()
+	defer m.Close()
 
-	// r := &Receiver{
-	// 	conn:        conn,
-	// 	connections: make(map[string]*connection),
-	// 	startTime:   time.Now(),
-	// }
+	return Serve(m, opts)
+}
 
-	log.Printf("SRT listener started on %s:%d\n", ipAddr, port)
-	log.Printf("waiting for SRT connections...")
+// Serve accepts SRT callers on a multiplexed UDP socket, which may be
+// shared with outgoing connections, until it is closed. The multiplexer
+// may run over any transport, see mux.New.
+func Serve(m *mux.Mux, opts Options) error {
+	if opts.Latency == 0 {
+		opts.Latency = defaultLatency
+	}
+	if opts.PeerIdleTimeout == 0 {
+		opts.PeerIdleTimeout = defaultPeerIdleTimeout
+	}
+	if opts.MTU == 0 {
+		opts.MTU = defaultMTU
+	}
+	if opts.ReceiveBuffer == 0 {
+		opts.ReceiveBuffer = defaultReceiveBuffer
+	}
+	output := opts.Output
+	if output == nil {
+		output = io.Discard
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
 
-	buf := make([]byte, 2048)
-	for {
-		n, remoteAddr, err := conn.ReadFromUDP(buf)
-		if err != nil {
-			log.Printf("error reading UDP: %v", err)
-			continue
+	r := &Receiver{
+		mux:         m,
+		opts:        opts,
+		output:      &lockedWriter{w: output},
+		connections: make(map[uint32]*connection),
+		peers:       make(map[string]*connection),
+		groups:      make(map[uint32]*group),
+		startTime:   time.Now(),
+		metrics:     newMetrics(),
+		log:         opts.Logger,
+	}
+	if opts.Record != nil {
+		r.recorder = record.NewWriter(opts.Record)
+		m.Tap(r.record)
+	}
+	if _, err := rand.Read(r.cookieSecret[:]); err != nil {
+		return fmt.Errorf("error generating cookie secret: %w", err)
+	}
+	if opts.MetricsAddr != "" {
+		if err := r.serveMetrics(opts.MetricsAddr, m.Done()); err != nil {
+			return err
 		}
+	}
+	if err := m.Listen(func(data []byte, addr *net.UDPAddr) { r.handlePacket(nil, data, addr) }); err != nil {
+		return err
+	}
 
-		// copy packet to use with shared buffer
-		pktData := make([]byte, n)
-		copy(pktData, buf[:n])
+	r.log.Info("SRT listener started, waiting for connections", "addr", m.LocalAddr())
+	<-m.Done()
+	return nil
+}
 
-		dumpPacket("SRT packet from "+remoteAddr.String(), pktData)
+// handlePacket handles a datagram sent to connection c, or to the
+// listener if c is nil.
+func (r *Receiver) handlePacket(c *connection, data []byte, addr *net.UDPAddr) {
+	pkt, err := packets.ParsePacket(data)
+	if err != nil {
+		// junk traffic must not cost a hex dump unless it is logged
+		if ctx := context.Background(); r.log.Enabled(ctx, slog.LevelDebug) {
+			r.log.DebugContext(ctx, "error parsing packet", "peer", addr, "err", err, "dump", hexDump(nil, data))
+		}
+		return
+	}
+	r.logPacket(pkt, data, addr)
 
-		// pkt, err := packets.ParsePacket(pktData)
-		// if err != nil {
-		// 	log.Printf("[%s] error parsing packet: %v", remoteAddr.String(), err)
-		// 	continue
-		// }
+	switch p := pkt.(type) {
+	case *packets.Data:
+		if c != nil {
+			c.handleData(p)
+		}
+	case *packets.Control:
+		switch {
+		case p.ControlType == packets.HANDSHAKE:
+			r.handleHandshake(p, addr)
+		case c != nil && c.legacy && p.ControlType == packets.UserDefinedType:
+			r.handleLegacyExtension(c, p)
+		case c != nil:
+			c.handleControl(p)
+		default:
+			r.log.Debug("control packet for unknown connection", "peer", addr, "control_type", p.ControlType)
+		}
+	}
+}
 
-		// switch p := pkt.(type) {
-		// case *packets.Data:
-		// 	r.handleDataPacket(p, remoteAddr)
-		// case *packets.Control:
-		// 	go r.handleControlPacket(p, remoteAddr)
-		// }
+// record writes a datagram the multiplexer read to the capture, whether
+// or not it is for one of our sockets.
+func (r *Receiver) record(data []byte, addr *net.UDPAddr) {
+	if err := r.recorder.Write(time.Now(), addr, data); err != nil {
+		r.log.Error("error recording datagram", "err", err)
 	}
 }
 
-func dumpPacket(label string, pktData []byte) {
-	if len(pktData) == 0 {
-		log.Printf("%s: empty packet", label)
+// release forgets a closed connection, and its group once it has no
+// members left.
+func (r *Receiver) release(c *connection) {
+	r.mux.Unregister(c.socketID)
+
+	r.mu.Lock()
+	delete(r.connections, c.socketID)
+	delete(r.peers, peerKey(c.addr, c.peerSocket))
+	r.mu.Unlock()
+
+	if c.group == nil {
+		c.buf.Close()
 		return
 	}
+	// under r.mu, so that no member joins a group being closed
+	r.mu.Lock()
+	empty := c.group.leave(c)
+	if empty {
+		delete(r.groups, c.group.id)
+	}
+	r.mu.Unlock()
+	if empty {
+		c.group.buf.Close()
+		c.group.log.Info("group closed")
+	}
+}
+
+// newRecvBuffer returns a buffer delivering to the output of the
+// receiver, keyed by message number if messages is set.
+func (r *Receiver) newRecvBuffer(messages bool, log *slog.Logger) *live.RecvBuffer {
+	return live.NewRecvBuffer(r.output, r.opts.ReceiveBuffer, messages, &r.metrics.tsbpdDropped, func(err error) {
+		log.Error("error writing output", "err", err)
+	})
+}
+
+// stateCallback returns the state change callback of c, which reports
+// to Options.OnStateChange.
+func (r *Receiver) stateCallback(c *connection) func(state.Change) {
+	h := &Conn{c: c}
+	return func(ch state.Change) {
+		c.log.Info("state changed", "from", ch.From, "to", ch.To, "reason", ch.Reason)
+		if r.opts.OnStateChange != nil {
+			r.opts.OnStateChange(h, ch)
+		}
+	}
+}
+
+// peerKey identifies a caller socket, as several may share an address.
+func peerKey(addr *net.UDPAddr, socketID uint32) string {
+	return fmt.Sprintf("%s/%08x", addr, socketID)
+}
+
+// lockedWriter serializes writes from the delivery goroutines of all
+// connections and groups.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
 
+// logPacket logs a datagram with a hex dump at trace level, or at debug
+// level for one in Options.DumpSample.
+func (r *Receiver) logPacket(pkt interface{}, data []byte, addr *net.UDPAddr) {
+	level := LevelTrace
+	if n := r.datagrams.Add(1); r.opts.DumpSample > 0 && n%uint64(r.opts.DumpSample) == 0 {
+		level = slog.LevelDebug
+	}
+	ctx := context.Background()
+	if !r.log.Enabled(ctx, level) {
+		return
+	}
+
+	attrs := []slog.Attr{slog.Any("peer", addr)}
+	switch p := pkt.(type) {
+	case *packets.Data:
+		attrs = append(attrs,
+			slog.String("socket", fmt.Sprintf("%08x", p.DestinationSocketID)),
+			slog.String("type", "data"),
+			slog.Uint64("seq", uint64(p.PacketSequenceNumber)),
+			slog.Uint64("msg", uint64(p.MessageNumber)),
+			slog.Int("size", len(p.Data)))
+	case *packets.Control:
+		attrs = append(attrs,
+			slog.String("socket", fmt.Sprintf("%08x", p.DestinationSocketID)),
+			slog.String("type", "control"),
+			slog.Any("control_type", p.ControlType))
+	}
+	attrs = append(attrs, slog.String("dump", hexDump(pkt, data)))
+	r.log.LogAttrs(ctx, level, "datagram", attrs...)
+}
+
+// hexDump formats the bytes of a datagram, after its decoded fields
+// unless pkt is nil.
+func hexDump(pkt interface{}, pktData []byte) string {
 	var b strings.Builder
-	b.WriteString(fmt.Sprintf("%s (%d bytes):\n", label, len(pktData)))
-	b.WriteString(packetGroups(pktData))
-	b.WriteString("\n")
+	if pkt != nil {
+		b.WriteString(packets.Format(pkt))
+	}
 
 	for i := 0; i < len(pktData); i += 16 {
 		end := i + 16
@@ -112,9 +350,8 @@ func dumpPacket(label string, pktData []byte) {
 		for _, v := range chunk {
 			b.WriteString(fmt.Sprintf("%02x ", v))
 		}
-		for len(chunk) < 16 {
+		for j := len(chunk); j < 16; j++ {
 			b.WriteString("   ")
-			chunk = nil
 		}
 		b.WriteString("  ")
 
@@ -127,46 +364,5 @@ func dumpPacket(label string, pktData []byte) {
 		}
 		b.WriteString("\n")
 	}
-
-	log.Print(b.String())
-}
-
-func packetGroups(pktData []byte) string {
-	if len(pktData) < 16 {
-		return "packet too short for SRT header\n"
-	}
-
-	var b strings.Builder
-	b.WriteString("header groups:\n")
-
-	first := pktData[0]
-	if first&0x80 != 0 {
-		ctlFlag := (first >> 7) & 0x01
-		ctlType := uint16(first&0x7F)<<8 | uint16(pktData[1])
-		subType := uint16(pktData[2])<<8 | uint16(pktData[3])
-		typeSpecific := binary.BigEndian.Uint32(pktData[4:8])
-		timestamp := binary.BigEndian.Uint32(pktData[8:12])
-		destSocket := binary.BigEndian.Uint32(pktData[12:16])
-
-		b.WriteString(fmt.Sprintf("  control flag: %d\n", ctlFlag))
-		b.WriteString(fmt.Sprintf("  control type: %015b (%04x)\n", ctlType, ctlType))
-		b.WriteString(fmt.Sprintf("  subtype: %016b (%04x)\n", subType, subType))
-		b.WriteString(fmt.Sprintf("  type-specific info: %032b (%08x)\n", typeSpecific, typeSpecific))
-		b.WriteString(fmt.Sprintf("  timestamp: %032b (%08x)\n", timestamp, timestamp))
-		b.WriteString(fmt.Sprintf("  destination socket id: %032b (%08x)\n", destSocket, destSocket))
-	} else {
-		seqNum := binary.BigEndian.Uint32([]byte{pktData[0] & 0x7F, pktData[1], pktData[2], pktData[3]})
-		msgFlags := pktData[4]
-		msgNum := uint32(pktData[4]&0x3F)<<18 | uint32(pktData[5])<<10 | uint32(pktData[6])<<2 | uint32(pktData[7]>>6)
-		timestamp := binary.BigEndian.Uint32(pktData[8:12])
-		destSocket := binary.BigEndian.Uint32(pktData[12:16])
-
-		b.WriteString(fmt.Sprintf("  packet seq num: %031b (%08x)\n", seqNum, seqNum))
-		b.WriteString(fmt.Sprintf("  flags: %08b\n", msgFlags))
-		b.WriteString(fmt.Sprintf("  message num: %026b (%08x)\n", msgNum, msgNum))
-		b.WriteString(fmt.Sprintf("  timestamp: %032b (%08x)\n", timestamp, timestamp))
-		b.WriteString(fmt.Sprintf("  destination socket id: %032b (%08x)\n", destSocket, destSocket))
-	}
-
 	return b.String()
 }
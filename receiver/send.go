@@ -0,0 +1,140 @@
+package receiver
+
+import (
+	"errors"
+	"time"
+
+	"coresrt/internal/live"
+	"coresrt/packets"
+	"coresrt/seqno"
+	"coresrt/state"
+)
+
+const (
+	sendPayloadSize = 1316        // seven MPEG-TS packets, if the MTU allows
+	probeWait       = ackInterval // longest a probing packet waits for the next one
+)
+
+var (
+	// ErrClosed is returned when writing to a connection that ended.
+	ErrClosed = errors.New("connection closed")
+
+	// ErrNotReceiving is returned when writing to a caller that did not
+	// announce it receives data, as HSv4 callers do not.
+	ErrNotReceiving = errors.New("peer does not receive data")
+)
+
+// Write sends p to the caller as one message, split over as many packets
+// as needed, such as a return feed over the connection the caller streams
+// on. It delivers p after the send latency agreed with the caller, and
+// blocks while the flow window of the caller holds back as many packets as
+// the send queue takes.
+func (h *Conn) Write(p []byte) (int, error) {
+	c := h.c
+	if !c.peerReceives {
+		return 0, ErrNotReceiving
+	}
+
+	c.mu.Lock()
+	for c.state.State() == state.Connected && c.sendQueue.Full() {
+		room := c.sendQueue.Room()
+		c.mu.Unlock()
+		select {
+		case <-room:
+		case <-c.stopACK:
+		}
+		c.mu.Lock()
+	}
+	if c.state.State() != state.Connected {
+		c.mu.Unlock()
+		return 0, ErrClosed
+	}
+	msg := c.nextMsg
+	c.nextMsg = seqno.NextMessage(c.nextMsg)
+	now := time.Now()
+	var out []*packets.Data
+	for _, pkt := range live.Packetize(p, min(sendPayloadSize, packets.MaxPayloadSize(c.mtu)), msg, c.timestamp()) {
+		pkt.PacketSequenceNumber = c.nextSeq
+		c.nextSeq = seqno.Next(c.nextSeq)
+		out = append(out, c.sendQueue.Push(pkt, now)...)
+	}
+	c.mu.Unlock()
+
+	c.sendData(out)
+	return len(p), nil
+}
+
+// sendData sends the data packets the send queue let go.
+func (c *connection) sendData(pkts []*packets.Data) {
+	for _, p := range pkts {
+		c.send(p.Marshal())
+	}
+}
+
+// flushProbe sends the first packet of a probing pair on its own once it
+// waited at least wait for the second.
+func (c *connection) flushProbe(now time.Time, wait time.Duration) {
+	c.mu.Lock()
+	out := c.sendQueue.FlushProbe(now, wait)
+	c.mu.Unlock()
+
+	c.sendData(out)
+}
+
+// handleACK frees what the caller acknowledged of the data we sent.
+func (c *connection) handleACK(ack *packets.AcknowledgementControlPacket) {
+	if ack.IsFull() {
+		ackack := packets.ACKACKControlPacket{
+			AcknowledgementNumber: ack.AcknowledgementNumber,
+			Timestamp:             c.timestamp(),
+			DestinationSocketID:   c.peerSocket,
+		}
+		c.send(ackack.Marshal())
+	}
+
+	c.mu.Lock()
+	c.sendQueue.Ack(ack.LastAcknowledgedPacketSequenceNumber)
+	if ack.IsFull() {
+		c.sendQueue.SetFlowWindow(int(ack.AvailableBufferSize))
+	}
+	out := c.sendQueue.Ready(time.Now())
+	c.mu.Unlock()
+
+	c.sendData(out)
+}
+
+// handleNAK retransmits the packets the caller reported lost that are
+// still buffered.
+func (c *connection) handleNAK(nak *packets.NegativeAcknowledgmentControlPacket) {
+	ranges, err := nak.LossRanges()
+	if err != nil {
+		c.log.Debug("malformed control packet", "err", err)
+		return
+	}
+
+	c.mu.Lock()
+	resend := c.sendQueue.Lost(ranges, time.Now())
+	c.mu.Unlock()
+
+	c.sendData(resend)
+}
+
+// retransmitUnacknowledged resends the first packet the caller has not
+// acknowledged for too long, unless it sends periodic NAKs.
+func (c *connection) retransmitUnacknowledged(now time.Time) {
+	c.mu.Lock()
+	p := c.sendQueue.Unacknowledged(now, c.rtt, c.rttVar, ackInterval)
+	c.mu.Unlock()
+
+	if p != nil {
+		c.send(p.Marshal())
+	}
+}
+
+// dropTooLate forgets the packets sent or held back that can no longer be
+// delivered in time.
+func (c *connection) dropTooLate(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sendQueue.DropTooLate(now, c.sendLatency)
+}
@@ -0,0 +1,171 @@
+// Package record writes the datagrams received by an SRT socket to a
+// compact capture file, and replays such captures.
+//
+// A capture starts with an 8-byte magic and the arrival time of its first
+// datagram, in nanoseconds since the Unix epoch. Each datagram follows as
+//
+//	uvarint  nanoseconds since the previous datagram
+//	uvarint  index of the peer address, in order of first appearance
+//	         a new peer is followed by its IP length (4 or 16), IP and port
+//	uvarint  length
+//	         payload
+package record
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+var magic = [8]byte{'S', 'R', 'T', 'R', 'E', 'C', 0, 1}
+
+const maxDatagramSize = 65535
+
+// Record is a recorded datagram.
+type Record struct {
+	Time time.Time
+	Addr *net.UDPAddr
+	Data []byte
+}
+
+// Writer records datagrams. It is safe for concurrent use.
+type Writer struct {
+	mu    sync.Mutex
+	w     io.Writer
+	last  time.Time // arrival of the previous datagram, zero before the first
+	peers map[netip.AddrPort]uint64
+	buf   []byte
+}
+
+// NewWriter returns a Writer recording to w. Each datagram is written to w
+// in a single call, so that an unbuffered file always holds whole records.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w, peers: make(map[netip.AddrPort]uint64)}
+}
+
+// Write records a datagram received from addr at t.
+func (rw *Writer) Write(t time.Time, addr *net.UDPAddr, data []byte) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	b := rw.buf[:0]
+	if rw.last.IsZero() {
+		b = append(b, magic[:]...)
+		b = binary.BigEndian.AppendUint64(b, uint64(t.UnixNano()))
+		rw.last = t
+	}
+	// a clock stepping back is recorded as simultaneous arrivals
+	b = binary.AppendUvarint(b, uint64(max(t.Sub(rw.last), 0)))
+	if t.After(rw.last) {
+		rw.last = t
+	}
+
+	ap := addr.AddrPort()
+	ap = netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+	index, ok := rw.peers[ap]
+	if !ok {
+		index = uint64(len(rw.peers))
+		rw.peers[ap] = index
+	}
+	b = binary.AppendUvarint(b, index)
+	if !ok {
+		ip := ap.Addr().AsSlice()
+		b = append(b, byte(len(ip)))
+		b = append(b, ip...)
+		b = binary.BigEndian.AppendUint16(b, ap.Port())
+	}
+
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	b = append(b, data...)
+	rw.buf = b
+
+	_, err := rw.w.Write(b)
+	return err
+}
+
+// Reader reads the datagrams of a capture.
+type Reader struct {
+	r     *bufio.Reader
+	last  time.Time
+	peers []*net.UDPAddr
+}
+
+// NewReader reads the header of a capture.
+func NewReader(r io.Reader) (*Reader, error) {
+	rr := &Reader{r: bufio.NewReader(r)}
+	var hdr [16]byte
+	if _, err := io.ReadFull(rr.r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("reading capture header: %w", err)
+	}
+	if [8]byte(hdr[:8]) != magic {
+		return nil, errors.New("not an SRT datagram capture")
+	}
+	rr.last = time.Unix(0, int64(binary.BigEndian.Uint64(hdr[8:])))
+	return rr, nil
+}
+
+// Next returns the next datagram, or io.EOF at the end of the capture.
+func (rr *Reader) Next() (Record, error) {
+	delta, err := binary.ReadUvarint(rr.r)
+	if err != nil {
+		// a capture ends between records
+		return Record{}, err
+	}
+	rr.last = rr.last.Add(time.Duration(delta))
+
+	index, err := binary.ReadUvarint(rr.r)
+	if err != nil {
+		return Record{}, truncated(err)
+	}
+	switch {
+	case index == uint64(len(rr.peers)):
+		addr, err := rr.readAddr()
+		if err != nil {
+			return Record{}, err
+		}
+		rr.peers = append(rr.peers, addr)
+	case index > uint64(len(rr.peers)):
+		return Record{}, fmt.Errorf("invalid peer index %d", index)
+	}
+
+	n, err := binary.ReadUvarint(rr.r)
+	if err != nil {
+		return Record{}, truncated(err)
+	}
+	if n > maxDatagramSize {
+		return Record{}, fmt.Errorf("datagram of %d bytes", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(rr.r, data); err != nil {
+		return Record{}, truncated(err)
+	}
+	return Record{Time: rr.last, Addr: rr.peers[index], Data: data}, nil
+}
+
+func (rr *Reader) readAddr() (*net.UDPAddr, error) {
+	n, err := rr.r.ReadByte()
+	if err != nil {
+		return nil, truncated(err)
+	}
+	if n != 4 && n != 16 {
+		return nil, fmt.Errorf("invalid peer address length %d", n)
+	}
+	b := make([]byte, int(n)+2)
+	if _, err := io.ReadFull(rr.r, b); err != nil {
+		return nil, truncated(err)
+	}
+	return &net.UDPAddr{IP: net.IP(b[:n]), Port: int(binary.BigEndian.Uint16(b[n:]))}, nil
+}
+
+func truncated(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("truncated capture: %w", err)
+}
@@ -0,0 +1,205 @@
+package record_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"coresrt/mux"
+	"coresrt/packets"
+	"coresrt/receiver"
+	"coresrt/record"
+	"coresrt/sender"
+	"coresrt/state"
+	"coresrt/transport"
+)
+
+func TestWriterReader(t *testing.T) {
+	start := time.Unix(1700000000, 123)
+	v4 := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 9000}
+	v6 := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 9001}
+	want := []record.Record{
+		{Time: start, Addr: v4, Data: []byte{1, 2, 3}},
+		{Time: start.Add(time.Millisecond), Addr: v6, Data: []byte{4}},
+		{Time: start.Add(time.Millisecond), Addr: v4, Data: nil},
+		{Time: start.Add(time.Second), Addr: v6, Data: bytes.Repeat([]byte{5}, 1500)},
+	}
+
+	var capture bytes.Buffer
+	w := record.NewWriter(&capture)
+	for _, rec := range want {
+		if err := w.Write(rec.Time, rec.Addr, rec.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rr, err := record.NewReader(bytes.NewReader(capture.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, w := range want {
+		got, err := rr.Next()
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if !got.Time.Equal(w.Time) || got.Addr.String() != w.Addr.String() || !bytes.Equal(got.Data, w.Data) {
+			t.Errorf("record %d: %v from %s at %s, want %v from %s at %s", i, got.Data, got.Addr, got.Time, w.Data, w.Addr, w.Time)
+		}
+	}
+	if _, err := rr.Next(); err != io.EOF {
+		t.Errorf("after the last record: %v, want io.EOF", err)
+	}
+
+	// a capture cut within a record
+	rr, err = record.NewReader(bytes.NewReader(capture.Bytes()[:capture.Len()-1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range len(want) - 1 {
+		if _, err := rr.Next(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := rr.Next(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncated record: %v, want io.ErrUnexpectedEOF", err)
+	}
+
+	if _, err := record.NewReader(bytes.NewReader([]byte("not a capture file"))); err == nil {
+		t.Error("reading a file that is not a capture")
+	}
+}
+
+// syncBuffer is an Output written by the delivery loop and read by the
+// test.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Write(p)
+}
+
+func (s *syncBuffer) Bytes() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return bytes.Clone(s.b.Bytes())
+}
+
+// serve runs a receiver over one end of a pipe, and returns the other.
+func serve(t *testing.T, opts receiver.Options) (*mux.Mux, net.PacketConn, <-chan struct{}) {
+	t.Helper()
+	a, b := transport.Pipe()
+	listener := mux.New(a, discard)
+	t.Cleanup(func() { listener.Close() })
+
+	closed := make(chan struct{}, 1)
+	opts.Logger = discard
+	opts.OnStateChange = func(_ *receiver.Conn, ch state.Change) {
+		if ch.To == state.Closed {
+			closed <- struct{}{}
+		}
+	}
+	go receiver.Serve(listener, opts)
+	ready(t, b, listener.LocalAddr())
+	return listener, b, closed
+}
+
+// ready waits for the listener at addr to answer inductions sent from
+// conn, so that no datagram of the test goes to a listener not serving
+// yet.
+func ready(t *testing.T, conn net.PacketConn, addr net.Addr) {
+	t.Helper()
+	hs := packets.HandshakeControl{
+		Version:        4,
+		ExtensionField: 2,
+		HandshakeType:  packets.Induction,
+		SRTSocketID:    1,
+	}
+	req := packets.Control{ControlType: packets.HANDSHAKE, ControlInformationField: hs.Marshal()}
+	b := make([]byte, 1500)
+	for range 100 {
+		if _, err := conn.WriteTo(req.Marshal(), addr); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		if _, _, err := conn.ReadFrom(b); err == nil {
+			conn.SetReadDeadline(time.Time{})
+			return
+		}
+	}
+	t.Fatal("listener not answering")
+}
+
+var discard = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// TestReplay records a session and replays it to another receiver, which
+// must deliver the same stream.
+func TestReplay(t *testing.T) {
+	var capture bytes.Buffer
+	recorded := &syncBuffer{}
+	listener, end, closed := serve(t, receiver.Options{Output: recorded, Record: &capture})
+
+	conn, err := sender.Dial(listener.LocalAddr().String(), sender.Options{Mux: mux.New(end, discard), Logger: discard})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	var sent bytes.Buffer
+	for i := range 100 {
+		p := bytes.Repeat([]byte{byte(i)}, 100+i)
+		sent.Write(p)
+		if _, err := conn.Write(p); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	waitFor(t, recorded, sent.Bytes())
+	conn.Close()
+	<-closed
+	// the recorder is done with the capture once the listener is
+	listener.Close()
+
+	rr, err := record.NewReader(bytes.NewReader(capture.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed := &syncBuffer{}
+	listener, end, closed = serve(t, receiver.Options{Output: replayed})
+	opened := false
+	err = record.Replay(rr, listener.LocalAddr(), func() (transport.PacketConn, error) {
+		if opened {
+			return nil, errors.New("more than one peer recorded")
+		}
+		opened = true
+		return end, nil
+	})
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	waitFor(t, replayed, sent.Bytes())
+	// the recorded SHUTDOWN reached the connection under its new socket ID
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("replayed connection not closed")
+	}
+}
+
+// waitFor waits for out to hold want.
+func waitFor(t *testing.T, out *syncBuffer, want []byte) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !bytes.Equal(out.Bytes(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d bytes delivered", len(out.Bytes()), len(want))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
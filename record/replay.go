@@ -0,0 +1,200 @@
+package record
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"coresrt/packets"
+	"coresrt/transport"
+)
+
+// handshakeWait bounds how long a replayed peer waits for the response to
+// a handshake before going on with its next datagram.
+const handshakeWait = time.Second
+
+// Replay sends the datagrams of a capture to the SRT listener at addr,
+// each recorded peer from a conn of its own opened by newConn, with the
+// timing they were recorded with. The conns are closed when Replay
+// returns.
+//
+// The listener hands out new SYN cookies and socket IDs, so each peer
+// waits for the responses to its handshakes, and the recorded cookie and
+// destination socket IDs are replaced by those of the responses.
+//
+// Replaying over a transport.Pipe to a mux.Mux served by a receiver
+// reproduces a recorded session within a test.
+func Replay(rr *Reader, addr net.Addr, newConn func() (transport.PacketConn, error)) error {
+	peers := make(map[string]*replayPeer)
+	defer func() {
+		for _, p := range peers {
+			p.conn.Close()
+		}
+	}()
+
+	var start, first time.Time
+	for {
+		rec, err := rr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if first.IsZero() {
+			start, first = time.Now(), rec.Time
+		}
+
+		p, ok := peers[rec.Addr.String()]
+		if !ok {
+			conn, err := newConn()
+			if err != nil {
+				return err
+			}
+			p = &replayPeer{
+				conn:      conn,
+				addr:      addr,
+				ids:       make(map[uint32]uint32),
+				responses: make(chan struct{}, 1),
+			}
+			peers[rec.Addr.String()] = p
+			go p.readLoop()
+		}
+
+		due := start.Add(rec.Time.Sub(first))
+		time.Sleep(time.Until(due))
+		if p.awaiting {
+			select {
+			case <-p.responses:
+			case <-time.After(handshakeWait):
+			}
+			p.awaiting = false
+			// what follows keeps its timing relative to the response
+			if late := time.Since(due); late > 0 {
+				start = start.Add(late)
+			}
+		}
+
+		data, handshake := p.rewrite(rec.Data)
+		if handshake {
+			// drop a response to an earlier handshake
+			select {
+			case <-p.responses:
+			default:
+			}
+			p.awaiting = true
+		}
+		if _, err := p.conn.WriteTo(data, p.addr); err != nil {
+			return err
+		}
+	}
+}
+
+// replayPeer is a recorded peer, replayed from its own socket.
+type replayPeer struct {
+	conn      transport.PacketConn
+	addr      net.Addr      // of the listener
+	awaiting  bool          // whether a handshake was sent that was not answered yet
+	responses chan struct{} // signalled on each handshake response
+
+	mu      sync.Mutex
+	cookie  uint32            // of the latest induction response
+	pending []uint32          // socket IDs of the listener not mapped to recorded ones yet
+	ids     map[uint32]uint32 // key: recorded destination socket ID
+}
+
+// rewrite returns a recorded datagram with the cookie and destination
+// socket ID of the live connection, and whether it is a handshake.
+func (p *replayPeer) rewrite(data []byte) ([]byte, bool) {
+	if len(data) < packets.MinPacketSize {
+		return data, false
+	}
+	data = append([]byte(nil), data...)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if dst := binary.BigEndian.Uint32(data[12:16]); dst != 0 {
+		live, ok := p.ids[dst]
+		if !ok && len(p.pending) > 0 {
+			live, p.pending = p.pending[0], p.pending[1:]
+			p.ids[dst] = live
+			ok = true
+		}
+		if ok {
+			binary.BigEndian.PutUint32(data[12:16], live)
+		}
+	}
+
+	c, err := packets.ParseControlPacket(data)
+	if err != nil || c.ControlType != packets.HANDSHAKE {
+		return data, false
+	}
+	hs, err := packets.ParseHandshakeControl(c.ControlInformationField)
+	if err != nil {
+		return data, false
+	}
+	if hs.HandshakeType == packets.Conclusion && hs.SYNCookie != 0 {
+		// the cookie field follows the socket ID in the handshake CIF
+		binary.BigEndian.PutUint32(data[packets.MinPacketSize+28:], p.cookie)
+	}
+	return data, true
+}
+
+// readLoop learns the cookie and socket IDs handed out by the listener.
+func (p *replayPeer) readLoop() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, _, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// such as an ICMP error reported on the socket
+			continue
+		}
+		c, err := packets.ParseControlPacket(buf[:n])
+		if err != nil || c.ControlType != packets.HANDSHAKE {
+			continue
+		}
+		hs, err := packets.ParseHandshakeControl(c.ControlInformationField)
+		if err != nil {
+			continue
+		}
+
+		p.mu.Lock()
+		switch hs.HandshakeType {
+		case packets.Induction:
+			p.cookie = hs.SYNCookie
+		case packets.Conclusion:
+			if !p.known(hs.SRTSocketID) {
+				p.pending = append(p.pending, hs.SRTSocketID)
+			}
+		}
+		p.mu.Unlock()
+
+		select {
+		case p.responses <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// known reports whether a socket ID of the listener was already learned,
+// as it repeats its conclusion response to a repeated conclusion.
+func (p *replayPeer) known(id uint32) bool {
+	for _, live := range p.ids {
+		if live == id {
+			return true
+		}
+	}
+	for _, live := range p.pending {
+		if live == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+
+	"coresrt/record"
+	"coresrt/transport"
+)
+
+// runReplay implements the replay command, which sends the datagrams
+// recorded by a receiver to an SRT listener again.
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: coresrt replay [-to addr] capture.srtrec")
+		fs.PrintDefaults()
+	}
+	to := fs.String("to", "127.0.0.1:9999", "UDP address of the SRT listener to replay to")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", *to)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	rr, err := record.NewReader(f)
+	if err == nil {
+		err = record.Replay(rr, addr, func() (transport.PacketConn, error) {
+			return net.ListenUDP("udp", nil)
+		})
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", fs.Arg(0), err)
+		os.Exit(1)
+	}
+}
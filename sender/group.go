@@ -0,0 +1,547 @@
+package sender
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"coresrt/internal/live"
+	"coresrt/mux"
+	"coresrt/packets"
+	"coresrt/seqno"
+	"coresrt/state"
+)
+
+const (
+	defaultStabilityTimeout = 60 * time.Millisecond
+
+	// assumed for balancing until the receiver reports a link capacity
+	defaultLinkCapacity = 10000 // packets per second
+
+	// a closed link is redialed after this long, then twice as long
+	// after each failure, up to maxRedialInterval
+	redialInterval    = 500 * time.Millisecond
+	maxRedialInterval = 30 * time.Second
+)
+
+// ErrNoLink is returned when writing to a group none of whose links is
+// connected. The group keeps redialing them, so later writes may succeed.
+var ErrNoLink = errors.New("no group link connected")
+
+// Link is one member connection of a group.
+type Link struct {
+	Addr   string
+	Weight uint16   // main/backup groups: link priority, higher is preferred
+	Mux    *mux.Mux // UDP socket of the link, Options.Mux if nil
+}
+
+type member struct {
+	link   Link
+	conn   *Conn
+	active bool
+	share  float64 // balancing: relative amount of packets to send
+	credit float64 // balancing: smooth weighted round robin state
+
+	redialing bool          // a redial of the closed link is under way
+	redialAt  time.Time     // when the closed link is redialed next
+	backoff   time.Duration // wait after the next failed redial
+}
+
+// Group sends one stream over several member connections that share
+// sequence numbers, so the receiver can merge them back together.
+//
+// A broadcast group sends every packet over all links. A main/backup group
+// sends over the highest weight link and activates the next best one as
+// soon as the active link stops responding within the stability timeout,
+// resending everything not yet acknowledged; once the main link is stable
+// again the backups are silenced. A balancing group sends each packet over
+// one of its stable links, spreading them in proportion to link capacity
+// and inversely to RTT, and retransmits lost packets over the link that
+// reported them.
+//
+// Links closed on a peer idle timeout or a SHUTDOWN are redialed with the
+// same group ID, with backoff, and take their part of the stream again
+// once connected.
+type Group struct {
+	id        uint32
+	gtype     packets.SrtGtype
+	opts      Options
+	startTime time.Time
+	payload   int // largest payload fitting in the MTU of every link
+	log       *slog.Logger
+
+	mu      sync.Mutex
+	members []*member // by descending weight
+	nextSeq uint32
+	nextMsg uint32
+	unacked map[uint32]*packets.Data // not yet acknowledged over any link
+	closed  bool
+	done    chan struct{}
+}
+
+// DialGroup connects every link and bonds them into a group of the given
+// type. It fails only if no link could be connected.
+func DialGroup(gtype packets.SrtGtype, links []Link, opts Options) (*Group, error) {
+	switch gtype {
+	case packets.GTYPE_BROADCAST, packets.GTYPE_MAIN_BACKUP, packets.GTYPE_BALANCING:
+	default:
+		return nil, fmt.Errorf("unsupported group type %d", gtype)
+	}
+	if len(links) == 0 {
+		return nil, errors.New("group needs at least one link")
+	}
+	if gtype == packets.GTYPE_BALANCING && opts.PacketFilter != "" {
+		// each link only carries part of the stream
+		return nil, errors.New("packet filters cannot be used in a balancing group")
+	}
+	opts.setDefaults()
+	// each link would write its own copy of what the listener sends back
+	opts.Output = io.Discard
+
+	g := &Group{
+		id:        mux.NewGroupID(),
+		gtype:     gtype,
+		opts:      opts,
+		startTime: time.Now(),
+		nextSeq:   newSequenceNumber(),
+		nextMsg:   1,
+		unacked:   make(map[uint32]*packets.Data),
+		done:      make(chan struct{}),
+	}
+	g.log = opts.Logger.With("group", fmt.Sprintf("%08x", g.id))
+	g.opts.Logger = g.log
+
+	type result struct {
+		m   *member
+		err error
+	}
+	results := make(chan result, len(links))
+	for _, l := range links {
+		go func(l Link) {
+			c, err := g.dial(l, g.nextSeq)
+			results <- result{m: &member{link: l, conn: c}, err: err}
+		}(l)
+	}
+
+	var errs []error
+	for range links {
+		res := <-results
+		if res.err != nil {
+			g.log.Warn("link failed", "link", res.m.link.Addr, "err", res.err)
+			errs = append(errs, res.err)
+			continue
+		}
+		g.attach(res.m, res.m.conn)
+		g.members = append(g.members, res.m)
+	}
+	if len(g.members) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	sort.SliceStable(g.members, func(i, j int) bool { return g.members[i].link.Weight > g.members[j].link.Weight })
+
+	g.updateActive(time.Now())
+	go g.tickLoop()
+	return g, nil
+}
+
+// dial connects link l as a member of the group, from sequence number isn.
+func (g *Group) dial(l Link, isn uint32) (*Conn, error) {
+	opts := g.opts
+	if l.Mux != nil {
+		opts.Mux = l.Mux
+	}
+	ext := &packets.GroupMembershipExtension{GroupID: g.id, Type: g.gtype, Weight: l.Weight}
+	return dial(l.Addr, opts, g.startTime, isn, ext)
+}
+
+// attach makes c the connection of m and starts it. It must be called
+// with g.mu held once the group is running.
+func (g *Group) attach(m *member, c *Conn) {
+	c.onACK = g.acknowledged
+	if g.gtype == packets.GTYPE_BALANCING {
+		// a link only holds the packets sent over it, while the
+		// receiver reports the losses of all links over one of them
+		c.onNAK = g.retransmit
+	}
+	c.start()
+	m.conn = c
+	if g.payload == 0 || c.payloadSize < g.payload {
+		g.payload = c.payloadSize
+	}
+}
+
+// Write sends p as one message over the active links.
+func (g *Group) Write(p []byte) (int, error) {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return 0, ErrClosed
+	}
+	if !g.connected() {
+		g.mu.Unlock()
+		return 0, ErrNoLink
+	}
+	msg := g.nextMsg
+	g.nextMsg = seqno.NextMessage(g.nextMsg)
+	pkts := live.Packetize(p, g.payload, msg, uint32(time.Since(g.startTime).Microseconds()))
+	for _, pkt := range pkts {
+		pkt.PacketSequenceNumber = g.nextSeq
+		g.nextSeq = seqno.Next(g.nextSeq)
+		g.unacked[pkt.PacketSequenceNumber] = pkt
+	}
+
+	// queued before g.mu is released, so that concurrent writes queue in
+	// order on every link
+	out := make(map[*Conn][]*packets.Data)
+	if g.gtype == packets.GTYPE_BALANCING {
+		for _, pkt := range pkts {
+			if c := g.nextBalanced(); c != nil {
+				out[c] = append(out[c], c.queue(pkt)...)
+			}
+		}
+	} else {
+		for _, c := range g.activeConns() {
+			for _, pkt := range pkts {
+				out[c] = append(out[c], c.queue(pkt)...)
+			}
+		}
+	}
+	g.mu.Unlock()
+
+	for c, data := range out {
+		c.sendData(data)
+	}
+	return len(p), nil
+}
+
+// nextBalanced picks the active link for the next packet by smooth
+// weighted round robin over the link shares. It must be called with g.mu
+// held.
+func (g *Group) nextBalanced() *Conn {
+	var best *member
+	total := 0.0
+	for _, m := range g.members {
+		if !m.active {
+			continue
+		}
+		m.credit += m.share
+		total += m.share
+		if best == nil || m.credit > best.credit {
+			best = m
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	best.credit -= total
+	return best.conn
+}
+
+// retransmit resends the packets of a balancing group reported lost over c.
+func (g *Group) retransmit(c *Conn, lost []packets.LossRange) {
+	var resend []*packets.Data
+	g.mu.Lock()
+	for _, r := range lost {
+		if r.Len() <= len(g.unacked) {
+			for s := range r.All() {
+				if pkt, ok := g.unacked[s]; ok {
+					resend = append(resend, pkt)
+				}
+			}
+			continue
+		}
+		// a range longer than what is held is not walked, so that a
+		// NAK cannot stall the group
+		start := len(resend)
+		for s, pkt := range g.unacked {
+			if r.Contains(s) {
+				resend = append(resend, pkt)
+			}
+		}
+		part := resend[start:]
+		sort.Slice(part, func(i, j int) bool {
+			return seqno.Less(part[i].PacketSequenceNumber, part[j].PacketSequenceNumber)
+		})
+	}
+	g.mu.Unlock()
+
+	for _, pkt := range resend {
+		c.retransmit(pkt)
+	}
+}
+
+// connected reports whether any link is open. A closed active link with
+// an open backup is not enough to fail a write: what is written meanwhile
+// is resent once the backup is activated. It must be called with g.mu
+// held.
+func (g *Group) connected() bool {
+	for _, m := range g.members {
+		if !m.conn.isClosed() {
+			return true
+		}
+	}
+	return false
+}
+
+// activeConns must be called with g.mu held.
+func (g *Group) activeConns() []*Conn {
+	var conns []*Conn
+	for _, m := range g.members {
+		if m.active {
+			conns = append(conns, m.conn)
+		}
+	}
+	return conns
+}
+
+// acknowledged is called by members when the receiver acknowledged
+// everything before seq.
+func (g *Group) acknowledged(seq uint32) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for s := range g.unacked {
+		if seqno.Less(s, seq) {
+			delete(g.unacked, s)
+		}
+	}
+}
+
+func (g *Group) tickLoop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-g.done:
+			return
+		case now := <-ticker.C:
+			g.dropTooLate(now)
+			g.redial(now)
+			g.updateActive(now)
+		}
+	}
+}
+
+func (g *Group) dropTooLate(now time.Time) {
+	threshold := live.DropThreshold(g.opts.Latency)
+	ts := uint32(now.Sub(g.startTime).Microseconds())
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for s, pkt := range g.unacked {
+		// packets written since now was taken are ahead of ts
+		if seqno.TimestampDiff(ts, pkt.Timestamp) > threshold {
+			delete(g.unacked, s)
+		}
+	}
+}
+
+// redial starts redialing the closed links that are due, from the oldest
+// packet not yet acknowledged so that it may be resent over them.
+func (g *Group) redial(now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	isn := g.nextSeq
+	for s := range g.unacked {
+		if seqno.Less(s, isn) {
+			isn = s
+		}
+	}
+	for _, m := range g.members {
+		if m.redialing || !m.conn.isClosed() {
+			continue
+		}
+		if m.redialAt.IsZero() {
+			m.backoff = redialInterval
+			m.redialAt = now.Add(m.backoff)
+			g.log.Warn("link closed, redialing", "link", m.link.Addr, "after", m.backoff)
+			continue
+		}
+		if now.Before(m.redialAt) {
+			continue
+		}
+		m.redialing = true
+		go g.redialMember(m, isn)
+	}
+}
+
+// redialMember connects m again, or schedules the next attempt.
+func (g *Group) redialMember(m *member, isn uint32) {
+	c, err := g.dial(m.link, isn)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	m.redialing = false
+	if err != nil {
+		m.backoff = min(2*m.backoff, maxRedialInterval)
+		m.redialAt = time.Now().Add(m.backoff)
+		g.log.Warn("link redial failed", "link", m.link.Addr, "err", err, "retry_after", m.backoff)
+		return
+	}
+	if g.closed {
+		c.Close()
+		return
+	}
+	g.attach(m, c)
+	m.redialAt = time.Time{}
+	g.log.Info("link reconnected", "link", m.link.Addr, "weight", m.link.Weight)
+}
+
+// updateActive decides which links carry the stream. Broadcast groups use
+// every link. Main/backup groups walk the links by descending weight and
+// activate them until one is stable, so a stable main link is used alone
+// and an unstable one is backed up until it responds again.
+func (g *Group) updateActive(now time.Time) {
+	if g.gtype == packets.GTYPE_BALANCING {
+		g.updateBalanced(now)
+		return
+	}
+
+	g.mu.Lock()
+	var activated []*member
+	stableFound := false
+	for _, m := range g.members {
+		want := false
+		switch {
+		case m.conn.isClosed():
+		case g.gtype == packets.GTYPE_BROADCAST:
+			want = true
+		case !stableFound:
+			want = true
+			stableFound = !m.conn.unstable(now)
+		}
+
+		if want && !m.active {
+			activated = append(activated, m)
+		}
+		if !want && m.active {
+			g.log.Info("link deactivated", "link", m.link.Addr, "weight", m.link.Weight)
+		}
+		m.active = want
+	}
+
+	if len(activated) == 0 {
+		g.mu.Unlock()
+		return
+	}
+	resend := make([]*packets.Data, 0, len(g.unacked))
+	for _, pkt := range g.unacked {
+		resend = append(resend, pkt)
+	}
+	g.mu.Unlock()
+
+	sort.Slice(resend, func(i, j int) bool {
+		return seqno.Less(resend[i].PacketSequenceNumber, resend[j].PacketSequenceNumber)
+	})
+	for _, m := range activated {
+		g.log.Info("link activated", "link", m.link.Addr, "weight", m.link.Weight, "resent", len(resend))
+		for _, pkt := range resend {
+			m.conn.sendPacket(pkt)
+		}
+	}
+}
+
+// updateBalanced spreads a balancing group over its stable links, or over
+// all of them if none is stable. The share of a link is its capacity scaled
+// down by how much slower its RTT is than the fastest link's. Packets in
+// flight on a link that became unstable are resent over the others.
+func (g *Group) updateBalanced(now time.Time) {
+	type linkState struct {
+		rtt      time.Duration
+		capacity uint32
+		usable   bool
+		stable   bool
+	}
+
+	g.mu.Lock()
+	states := make([]linkState, len(g.members))
+	anyStable := false
+	var minRTT time.Duration
+	for i, m := range g.members {
+		st := &states[i]
+		st.rtt, st.capacity = m.conn.linkStats()
+		st.usable = !m.conn.isClosed()
+		st.stable = st.usable && !m.conn.unstable(now)
+		anyStable = anyStable || st.stable
+		if st.usable && (minRTT == 0 || st.rtt < minRTT) {
+			minRTT = st.rtt
+		}
+	}
+
+	var dropped []*Conn
+	for i, m := range g.members {
+		st := states[i]
+		want := st.stable || (!anyStable && st.usable)
+		if want && !m.active {
+			g.log.Info("link activated", "link", m.link.Addr)
+		}
+		if !want && m.active {
+			g.log.Info("link deactivated", "link", m.link.Addr)
+			dropped = append(dropped, m.conn)
+		}
+		m.active = want
+		m.share = 0
+		if want {
+			capacity := float64(defaultLinkCapacity)
+			if st.capacity != 0 {
+				capacity = float64(st.capacity)
+			}
+			m.share = capacity * float64(minRTT) / float64(max(st.rtt, 1))
+		}
+	}
+	g.mu.Unlock()
+
+	for _, d := range dropped {
+		for _, pkt := range d.inFlight() {
+			g.mu.Lock()
+			_, ok := g.unacked[pkt.PacketSequenceNumber]
+			c := g.nextBalanced()
+			g.mu.Unlock()
+			if ok && c != nil && c != d {
+				c.retransmit(pkt)
+			}
+		}
+	}
+}
+
+// State returns Closed once the group is closed, Connected while any of
+// its links is connected, and Broken while none is and they are redialed.
+func (g *Group) State() state.State {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return state.Closed
+	}
+	for _, m := range g.members {
+		if m.conn.State() == state.Connected {
+			return state.Connected
+		}
+	}
+	return state.Broken
+}
+
+// Close closes the group and all its member connections.
+func (g *Group) Close() error {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return nil
+	}
+	g.closed = true
+	close(g.done)
+	conns := make([]*Conn, 0, len(g.members))
+	for _, m := range g.members {
+		conns = append(conns, m.conn)
+	}
+	g.mu.Unlock()
+
+	var errs []error
+	for _, c := range conns {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,213 @@
+package sender
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"coresrt/filter"
+	"coresrt/internal/live"
+	"coresrt/mux"
+	"coresrt/packets"
+	"coresrt/seqno"
+)
+
+const (
+	handshakeRetry = 250 * time.Millisecond
+	udtDgram       = 2 // Extension Field of the INDUCTION request
+)
+
+var errHandshakeTimeout = errors.New("handshake timed out")
+
+func newSequenceNumber() uint32 {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return binary.BigEndian.Uint32(b[:]) & seqno.Max
+}
+
+// handshake performs the caller side of the caller-listener handshake:
+// INDUCTION to obtain the cookie, then CONCLUSION with our extensions.
+func (c *Conn) handshake(group *packets.GroupMembershipExtension) error {
+	induction := packets.HandshakeControl{
+		Version:                     4,
+		ExtensionField:              udtDgram,
+		InitialPacketSequenceNumber: c.nextSeq,
+		MaximumTransmissionUnitSize: uint32(c.opts.MTU),
+		MaximumFlowWindowSize:       uint32(c.opts.ReceiveBuffer),
+		HandshakeType:               packets.Induction,
+		SRTSocketID:                 c.socketID,
+		PeerIPAddress:               packets.NewPeerIPAddress(c.addr.IP),
+	}
+
+	resp, err := c.exchange(induction.Marshal(), packets.Induction, 0)
+	if err != nil {
+		return fmt.Errorf("induction: %w", err)
+	}
+	if resp.Version != 5 || resp.ExtensionField != packets.SRTMagicCode {
+		return fmt.Errorf("induction: peer is not an HSv5 SRT listener (version %d, extension %04x)", resp.Version, resp.ExtensionField)
+	}
+
+	conclusion := induction
+	conclusion.Version = 5
+	conclusion.ExtensionField = packets.HSREQFlag
+	conclusion.HandshakeType = packets.Conclusion
+	conclusion.SYNCookie = resp.SYNCookie
+	hsreq := packets.HandshakeExtensionMessage{
+		SRTVersion:         srtVersion,
+		SRTFlags:           packets.TSBPDSND | packets.TSBPDRCV | packets.CRYPT | packets.TLPKTDROP | packets.PERIODICNAK | packets.REXMITFLG | packets.PACKETFILTER,
+		ReceiverTSBPDDelay: uint16(c.opts.ReceiveLatency / time.Millisecond),
+		SenderTSBPDDelay:   uint16(c.opts.Latency / time.Millisecond),
+	}
+	conclusion.AddExtension(packets.HSREQ, hsreq.Marshal())
+	if c.opts.StreamID != "" || c.opts.PacketFilter != "" || group != nil {
+		conclusion.ExtensionField |= packets.CONFIGFlag
+	}
+	if c.opts.StreamID != "" {
+		sid := packets.StreamIdExtensionMessage{StreamID: c.opts.StreamID}
+		conclusion.AddExtension(packets.SID, sid.Marshal())
+	}
+	if c.opts.PacketFilter != "" {
+		ext := packets.FilterExtensionMessage{Config: c.opts.PacketFilter}
+		conclusion.AddExtension(packets.Filter, ext.Marshal())
+	}
+	if group != nil {
+		conclusion.AddExtension(packets.Group, group.Marshal())
+	}
+
+	resp, err = c.exchange(conclusion.Marshal(), packets.Conclusion, conclusion.SYNCookie)
+	if err != nil {
+		return fmt.Errorf("conclusion: %w", err)
+	}
+
+	c.peerSocket = resp.SRTSocketID
+	if resp.MaximumFlowWindowSize == 0 {
+		c.shutdown()
+		return fmt.Errorf("conclusion: flow window of 0 packets: %w", packets.RejectRogue)
+	}
+	c.sendQueue = live.NewSendQueue(resp.SRTSocketID, int(resp.MaximumFlowWindowSize), &c.counters)
+	c.mtu = min(int(resp.MaximumTransmissionUnitSize), c.opts.MTU)
+	c.latency = c.opts.Latency
+	c.recvLatency = c.opts.ReceiveLatency
+	var peerVersion packets.Version // zero without HSRSP
+	if hsrspData, ok := resp.Extension(packets.HSRSP); ok {
+		hsrsp, err := packets.ParseHandshakeExtensionMessage(hsrspData)
+		if err != nil {
+			return fmt.Errorf("conclusion: %w", err)
+		}
+		peerVersion = hsrsp.SRTVersion
+		c.sendQueue.PeriodicNAK = hsrsp.SRTFlags&packets.PERIODICNAK != 0
+		// each direction has a delay of its own, the greater of both proposals
+		if peer := time.Duration(hsrsp.ReceiverTSBPDDelay) * time.Millisecond; peer > c.latency {
+			c.latency = peer
+		}
+		if peer := time.Duration(hsrsp.SenderTSBPDDelay) * time.Millisecond; peer > c.recvLatency {
+			c.recvLatency = peer
+		}
+	}
+	// the listener already took us as connected, so refusing it takes a
+	// SHUTDOWN
+	if peerVersion < c.opts.MinPeerVersion {
+		c.shutdown()
+		return fmt.Errorf("conclusion: SRT version %s is older than %s: %w", peerVersion, c.opts.MinPeerVersion, packets.RejectVersion)
+	}
+	if group != nil {
+		if _, ok := resp.Extension(packets.Group); !ok || peerVersion < packets.MinVersionGroup {
+			c.shutdown()
+			return fmt.Errorf("conclusion: SRT version %s does not support groups: %w", peerVersion, packets.RejectGroup)
+		}
+	}
+
+	// the listener responds with the configuration both sides agreed on
+	peerFilter := ""
+	if filterData, ok := resp.Extension(packets.Filter); ok {
+		ext, err := packets.ParseFilterExtensionMessage(filterData)
+		if err != nil {
+			c.shutdown()
+			return fmt.Errorf("conclusion: %w: %w", err, packets.RejectRogue)
+		}
+		peerFilter = ext.Config
+	} else if c.opts.PacketFilter != "" {
+		c.shutdown()
+		return fmt.Errorf("conclusion: peer did not accept the packet filter: %w", packets.RejectFilter)
+	}
+	filterConfig, err := filter.Negotiate(c.opts.PacketFilter, peerFilter)
+	if err != nil {
+		c.shutdown()
+		return fmt.Errorf("conclusion: %w: %w", err, packets.RejectFilter)
+	}
+	if filterConfig != "" {
+		if c.sendQueue.Filter, err = filter.New(filterConfig, c.nextSeq); err != nil {
+			c.shutdown()
+			return fmt.Errorf("conclusion: %w: %w", err, packets.RejectFilter)
+		}
+	}
+
+	// filter packets carry a header on top of the largest payload
+	c.payloadSize = min(c.opts.PayloadSize, packets.MaxPayloadSize(c.mtu)-filter.Overhead(c.sendQueue.Filter))
+	if c.payloadSize <= 0 {
+		c.shutdown()
+		return fmt.Errorf("conclusion: MTU %d leaves no room for payloads", c.mtu)
+	}
+	if c.payloadSize < c.opts.PayloadSize {
+		c.log.Info("payload size lowered for the MTU", "payload_size", c.payloadSize, "mtu", c.mtu)
+	}
+	return nil
+}
+
+// exchange sends a handshake until a response of type want arrives. A
+// rejection of the request carrying cookie is returned as its
+// packets.RejectReason. Other responses are late answers to earlier
+// requests, such as a repeated induction, and are skipped.
+func (c *Conn) exchange(cif []byte, want packets.HandshakeType, cookie uint32) (*packets.HandshakeControl, error) {
+	req := packets.Control{
+		ControlType:             packets.HANDSHAKE,
+		ControlInformationField: cif,
+	}
+
+	deadline := time.Now().Add(c.opts.ConnectTimeout)
+	for time.Now().Before(deadline) {
+		req.Timestamp = c.timestamp()
+		if err := c.mux.WriteTo(req.Marshal(), c.addr); err != nil {
+			return nil, err
+		}
+
+		retry := time.After(handshakeRetry)
+	wait:
+		for {
+			select {
+			case <-retry:
+				break wait
+			case <-c.mux.Done():
+				return nil, mux.ErrClosed
+			case data := <-c.incoming:
+				p, err := packets.ParseControlPacket(data)
+				if err != nil || p.ControlType != packets.HANDSHAKE {
+					continue
+				}
+				hs, err := packets.ParseHandshakeControl(p.ControlInformationField)
+				if err != nil {
+					return nil, err
+				}
+				if reason, ok := hs.HandshakeType.RejectReason(); ok {
+					// rejections echo the request they answer
+					if hs.SYNCookie != cookie {
+						continue
+					}
+					return nil, reason
+				}
+				if hs.HandshakeType != want {
+					continue
+				}
+				// the timestamps of what the listener sends back count
+				// from the response to the conclusion
+				c.peerBase = time.Now().Add(-time.Duration(p.Timestamp) * time.Microsecond)
+				return hs, nil
+			}
+		}
+	}
+	return nil, errHandshakeTimeout
+}
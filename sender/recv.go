@@ -0,0 +1,141 @@
+package sender
+
+import (
+	"time"
+
+	"coresrt/packets"
+)
+
+// handleData takes a data packet the listener sent back.
+func (c *Conn) handleData(p *packets.Data) {
+	now := time.Now()
+
+	c.mu.Lock()
+	c.lastResponse = now
+	c.counters.PacketsReceived++
+	c.counters.BytesReceived += uint64(len(p.Data))
+	if p.RetransmittedPacketFlag != 0 {
+		c.counters.PacketsRetransmitted++
+		c.counters.BytesRetransmitted += uint64(len(p.Data))
+	}
+	c.window.Arrival(p.PacketSequenceNumber, len(p.Data), p.RetransmittedPacketFlag != 0, now)
+	c.mu.Unlock()
+
+	if c.buf.Free() == 0 {
+		// not taken as received, so that it is requested again once
+		// there is room
+		return
+	}
+
+	c.mu.Lock()
+	deliverAt := c.deliveryTime(p.Timestamp)
+	if deliverAt.Before(now) {
+		c.counters.PacketsBelated++
+		c.counters.BytesBelated += uint64(len(p.Data))
+	}
+	gap, isNew := c.seqs.Receive(p.PacketSequenceNumber)
+	if gap != nil {
+		c.seqs.AddLoss(*gap, now)
+		c.seqs.Losses.Report(*gap, now)
+		c.countLoss(&c.counters.PacketsLost, &c.counters.BytesLost, uint64(gap.Len()))
+	}
+	if isNew {
+		c.received = true
+	}
+	c.mu.Unlock()
+
+	if gap != nil {
+		c.sendNAK([]packets.LossRange{*gap})
+	}
+	if isNew {
+		c.buf.Push(p.PacketSequenceNumber, p.Data, deliverAt)
+	}
+}
+
+// deliveryTime converts a timestamp of the listener into the local TSBPD
+// delivery time. It must be called with c.mu held.
+func (c *Conn) deliveryTime(ts uint32) time.Time {
+	return c.peerBase.Add(c.timeline.Elapsed(ts) + c.recvLatency)
+}
+
+// countLoss adds n packets that never arrived to a pair of counters,
+// estimating their size from the average payload received. It must be
+// called with c.mu held.
+func (c *Conn) countLoss(pkts, bytes *uint64, n uint64) {
+	*pkts += n
+	if c.counters.PacketsReceived > 0 {
+		*bytes += n * c.counters.BytesReceived / c.counters.PacketsReceived
+	}
+}
+
+// sendACK acknowledges the data received, when there is news, and gives up
+// on the losses that can no longer be delivered in time.
+func (c *Conn) sendACK(now time.Time) {
+	c.mu.Lock()
+	if dropped := c.seqs.Expire(now.Add(-c.recvLatency)); dropped > 0 {
+		c.countLoss(&c.counters.PacketsDropped, &c.counters.BytesDropped, uint64(dropped))
+	}
+	seq := c.seqs.ACKSeq()
+	free := c.buf.Free()
+	if !c.received {
+		c.mu.Unlock()
+		return
+	}
+	number, ok := c.acks.Next(seq, free, now)
+	if !ok {
+		c.mu.Unlock()
+		return
+	}
+	pktRate, byteRate := c.window.ReceivingRate()
+	ack := packets.AcknowledgementControlPacket{
+		AcknowledgementNumber:                number,
+		Timestamp:                            c.timestamp(),
+		DestinationSocketID:                  c.peerSocket,
+		LastAcknowledgedPacketSequenceNumber: seq,
+		RTT:                                  uint32(c.rtt.Microseconds()),
+		RTTVariance:                          uint32(c.rttVar.Microseconds()),
+		AvailableBufferSize:                  uint32(free),
+		PacketsReceivingRate:                 pktRate,
+		EstimatedLinkCapacity:                c.window.Capacity(),
+		ReceivingRate:                        byteRate,
+	}
+	c.mu.Unlock()
+
+	c.send(ack.Marshal())
+}
+
+// sendPeriodicNAK reports again the losses that a NAK reported at least a
+// NAK interval ago, in case the NAK or the retransmission was lost, if
+// the listener agreed on periodic NAKs: as the HSREQ offers them, that is
+// when it sends them too.
+func (c *Conn) sendPeriodicNAK(now time.Time) {
+	c.mu.Lock()
+	if !c.sendQueue.PeriodicNAK {
+		c.mu.Unlock()
+		return
+	}
+	lost := c.seqs.Losses.Due(now, c.rtt, c.rttVar, c.mtu)
+	c.mu.Unlock()
+
+	if len(lost) > 0 {
+		c.sendNAK(lost)
+	}
+}
+
+func (c *Conn) sendNAK(lost []packets.LossRange) {
+	nak := packets.NegativeAcknowledgmentControlPacket{
+		Timestamp:               c.timestamp(),
+		DestinationSocketID:     c.peerSocket,
+		ControlInformationField: packets.EncodeLossList(lost),
+	}
+	c.send(nak.Marshal())
+}
+
+// handleACKACK measures the RTT from one of our ACKs.
+func (c *Conn) handleACKACK(ackack *packets.ACKACKControlPacket) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if rtt, ok := c.acks.Answered(ackack.AcknowledgementNumber, time.Now()); ok {
+		c.updateRTT(rtt)
+	}
+}
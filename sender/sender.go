@@ -0,0 +1,661 @@
+package sender
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"coresrt/internal/live"
+	"coresrt/mux"
+	"coresrt/packets"
+	"coresrt/seqno"
+	"coresrt/state"
+	"coresrt/stats"
+)
+
+const (
+	defaultLatency         = 120 * time.Millisecond
+	defaultConnectTimeout  = 3 * time.Second
+	defaultPeerIdleTimeout = 5 * time.Second
+	keepAliveInterval      = time.Second // when nothing else was sent
+	defaultPayloadSize     = 1316        // seven MPEG-TS packets
+	defaultMTU             = 1500
+	defaultReceiveBuffer   = 8192 // packets
+	tickInterval           = 10 * time.Millisecond
+	probeWait              = tickInterval              // longest a probing packet waits for the next one
+	srtVersion             = packets.Version(0x010500) // 1.5.0
+	incomingQueueSize      = 256                       // datagrams waiting for the read loop
+)
+
+// ErrClosed is returned when writing to a closed connection or group.
+var ErrClosed = errors.New("connection closed")
+
+type Options struct {
+	Latency          time.Duration   // TSBPD latency proposed to the receiver, 120ms if zero
+	StreamID         string          // sent in the SRT_CMD_SID handshake extension
+	PayloadSize      int             // maximum payload per data packet, 1316 if zero, lowered to what the MTU allows
+	MTU              int             // largest IP packet sent to and accepted from the listener, 1500 if zero
+	ConnectTimeout   time.Duration   // 3s if zero
+	StabilityTimeout time.Duration   // main/backup groups: response time after which a link is unstable, 60ms if zero
+	PacketFilter     string          // packet filter configuration, such as "xorfec,cols:10,rows:5"
+	Mux              *mux.Mux        // UDP socket shared with other connections, a new one if nil
+	PeerIdleTimeout  time.Duration   // the connection is closed when the peer is silent this long, 5s if zero
+	MinPeerVersion   packets.Version // listeners of an older SRT version are refused with REJ_VERSION, none if zero
+	ReceiveLatency   time.Duration   // TSBPD latency proposed for what the listener sends back, Latency if zero
+	Output           io.Writer       // payloads the listener sends back, such as a talkback feed, are written here, discarded if nil
+	ReceiveBuffer    int             // packets held until delivery to Output, the flow window of the listener, 8192 if zero
+	Logger           *slog.Logger    // slog.Default() if nil
+
+	// OnStateChange, if set, is called on each state change of the
+	// connection, from the goroutine that made it. It must not block.
+	OnStateChange func(c *Conn, ch state.Change)
+}
+
+func (o *Options) setDefaults() {
+	if o.Latency == 0 {
+		o.Latency = defaultLatency
+	}
+	if o.PayloadSize == 0 {
+		o.PayloadSize = defaultPayloadSize
+	}
+	if o.MTU == 0 {
+		o.MTU = defaultMTU
+	}
+	if o.ConnectTimeout == 0 {
+		o.ConnectTimeout = defaultConnectTimeout
+	}
+	if o.StabilityTimeout == 0 {
+		o.StabilityTimeout = defaultStabilityTimeout
+	}
+	if o.PeerIdleTimeout == 0 {
+		o.PeerIdleTimeout = defaultPeerIdleTimeout
+	}
+	if o.ReceiveLatency == 0 {
+		o.ReceiveLatency = o.Latency
+	}
+	if o.Output == nil {
+		o.Output = io.Discard
+	}
+	if o.ReceiveBuffer == 0 {
+		o.ReceiveBuffer = defaultReceiveBuffer
+	}
+	if o.Logger == nil {
+		o.Logger = slog.Default()
+	}
+}
+
+// Conn is the caller side of an SRT connection, sending live data.
+type Conn struct {
+	mux         *mux.Mux
+	ownMux      bool // opened for this connection alone
+	incoming    chan []byte
+	addr        *net.UDPAddr
+	opts        Options
+	socketID    uint32
+	peerSocket  uint32
+	startTime   time.Time
+	latency     time.Duration // negotiated
+	mtu         int           // negotiated
+	payloadSize int           // largest payload fitting in the MTU
+	state       *state.Machine
+	log         *slog.Logger
+
+	mu           sync.Mutex
+	nextSeq      uint32
+	nextMsg      uint32
+	sendQueue    *live.SendQueue // set up by the handshake
+	lastResponse time.Time       // last control packet from the peer
+	lastSend     time.Time       // last packet sent to the peer
+	rtt          time.Duration
+	rttVar       time.Duration
+	capacity     uint32         // packets per second, as estimated by the peer
+	lostHigh     uint32         // highest sequence number counted lost
+	counters     stats.Counters // totals since the connection started
+	interval     stats.Interval
+	onACK        func(seq uint32)                        // set by a group to learn about progress
+	onNAK        func(c *Conn, lost []packets.LossRange) // set by a group that retransmits itself
+	closed       bool                                    // state freed
+	done         chan struct{}                           // closed with closed
+
+	// Receiving what the listener sends back, with mu held
+	recvLatency time.Duration    // negotiated receiver delay
+	peerBase    time.Time        // local time of the listener's timestamp 0
+	timeline    seqno.Timeline   // of the listener's timestamps
+	seqs        live.SeqTracker  // received sequence numbers and losses
+	buf         *live.RecvBuffer // delivering to Options.Output, locking itself
+	received    bool             // whether any data was received
+	acks        live.ACKs        // full ACKs sent
+	window      stats.Window     // arrivals, for the receiving rate and link capacity
+}
+
+// Dial connects to an SRT listener.
+func Dial(addr string, opts Options) (*Conn, error) {
+	opts.setDefaults()
+	c, err := dial(addr, opts, time.Now(), newSequenceNumber(), nil)
+	if err != nil {
+		return nil, err
+	}
+	c.start()
+	return c, nil
+}
+
+func dial(addr string, opts Options, startTime time.Time, isn uint32, group *packets.GroupMembershipExtension) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	m := opts.Mux
+	if m == nil {
+		if m, err = mux.Listen(nil, opts.Logger); err != nil {
+			return nil, err
+		}
+	}
+
+	c := &Conn{
+		mux:       m,
+		ownMux:    opts.Mux == nil,
+		incoming:  make(chan []byte, incomingQueueSize),
+		addr:      raddr,
+		opts:      opts,
+		startTime: startTime,
+		nextSeq:   isn,
+		nextMsg:   1,
+		seqs:      live.NewSeqTracker(isn),
+		lostHigh:  seqno.Prev(isn),
+		rtt:       100 * time.Millisecond,
+		rttVar:    50 * time.Millisecond,
+		done:      make(chan struct{}),
+		interval:  stats.NewInterval(time.Now()),
+		log:       opts.Logger.With("peer", raddr),
+	}
+	c.buf = live.NewRecvBuffer(opts.Output, opts.ReceiveBuffer, false, nil, func(err error) {
+		c.log.Error("error writing output", "err", err)
+	})
+	c.state = state.NewMachine(func(ch state.Change) {
+		c.log.Info("state changed", "from", ch.From, "to", ch.To, "reason", ch.Reason)
+		if opts.OnStateChange != nil {
+			opts.OnStateChange(c, ch)
+		}
+	})
+	if c.socketID, err = m.Register(c.deliver); err != nil {
+		c.release()
+		return nil, err
+	}
+	c.log = c.log.With("socket", fmt.Sprintf("%08x", c.socketID))
+	c.state.Set(state.Connecting, nil)
+	if err := c.handshake(group); err != nil {
+		err = fmt.Errorf("[%s] %w", addr, err)
+		c.end(state.Broken, err)
+		return nil, err
+	}
+	c.lastResponse = time.Now()
+	c.state.Set(state.Connected, nil)
+
+	c.log.Info("connected", "peer_socket", fmt.Sprintf("%08x", c.peerSocket),
+		"latency", c.latency, "receive_latency", c.recvLatency, "mtu", c.mtu)
+	return c, nil
+}
+
+// start runs the loops of a connected connection.
+func (c *Conn) start() {
+	go c.readLoop()
+	go c.tickLoop()
+}
+
+// Write sends p as one message, split over as many packets as needed. It
+// blocks while the flow window of the listener holds back as many packets
+// as the send queue takes, until ACKs make room or they are too late.
+func (c *Conn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	for !c.closed && c.state.State() == state.Connected && c.sendQueue.Full() {
+		room := c.sendQueue.Room()
+		c.mu.Unlock()
+		select {
+		case <-room:
+		case <-c.done:
+		}
+		c.mu.Lock()
+	}
+	if c.closed || c.state.State() != state.Connected {
+		c.mu.Unlock()
+		return 0, ErrClosed
+	}
+	msg := c.nextMsg
+	c.nextMsg = seqno.NextMessage(c.nextMsg)
+	// queued along with their sequence numbers, so that concurrent
+	// writes queue in order
+	now := time.Now()
+	var out []*packets.Data
+	for _, pkt := range live.Packetize(p, c.payloadSize, msg, c.timestamp()) {
+		pkt.PacketSequenceNumber = c.nextSeq
+		c.nextSeq = seqno.Next(c.nextSeq)
+		out = append(out, c.sendQueue.Push(pkt, now)...)
+	}
+	c.mu.Unlock()
+
+	c.sendData(out)
+	return len(p), nil
+}
+
+// sendPacket queues a packet, which may be shared with the other links of
+// a group, and sends what the send queue lets go.
+func (c *Conn) sendPacket(pkt *packets.Data) {
+	c.sendData(c.queue(pkt))
+}
+
+// queue puts a packet in the send queue and returns what the queue lets
+// go, for the caller to send.
+func (c *Conn) queue(pkt *packets.Data) []*packets.Data {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	return c.sendQueue.Push(pkt, time.Now())
+}
+
+// sendData sends the data packets the send queue let go.
+func (c *Conn) sendData(pkts []*packets.Data) {
+	for _, p := range pkts {
+		c.send(p.Marshal())
+	}
+}
+
+// flushProbe sends the first packet of a probing pair on its own once it
+// waited at least wait for the second.
+func (c *Conn) flushProbe(now time.Time, wait time.Duration) {
+	c.mu.Lock()
+	out := c.sendQueue.FlushProbe(now, wait)
+	c.mu.Unlock()
+
+	c.sendData(out)
+}
+
+// deliver is the multiplexer handler of the connection.
+func (c *Conn) deliver(data []byte, from *net.UDPAddr) {
+	if !from.IP.Equal(c.addr.IP) || from.Port != c.addr.Port {
+		return
+	}
+	select {
+	case c.incoming <- data:
+	default:
+		// the read loop is behind, drop as the network would
+	}
+}
+
+func (c *Conn) readLoop() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.mux.Done():
+			c.log.Info("UDP socket closed")
+			c.end(state.Closing, mux.ErrClosed)
+			return
+		case data := <-c.incoming:
+			if len(data) > c.mtu-packets.MTUOverhead {
+				continue
+			}
+			pkt, err := packets.ParsePacket(data)
+			if err != nil {
+				continue
+			}
+			switch p := pkt.(type) {
+			case *packets.Data:
+				c.handleData(p)
+			case *packets.Control:
+				c.handleControl(p)
+			}
+		}
+	}
+}
+
+func (c *Conn) handleControl(p *packets.Control) {
+	c.mu.Lock()
+	c.lastResponse = time.Now()
+	c.mu.Unlock()
+
+	switch p.ControlType {
+	case packets.ACK:
+		ack, err := packets.ParseAcknowledgementControlPacket(p)
+		if err != nil {
+			c.log.Debug("malformed control packet", "err", err)
+			return
+		}
+		c.handleACK(ack)
+	case packets.NAK:
+		nak, err := packets.ParseNegativeAcknowledgmentControlPacket(p)
+		if err != nil {
+			c.log.Debug("malformed control packet", "err", err)
+			return
+		}
+		c.handleNAK(nak)
+	case packets.ACKACK:
+		ackack, err := packets.ParseACKACKControlPacket(p)
+		if err != nil {
+			c.log.Debug("malformed control packet", "err", err)
+			return
+		}
+		c.handleACKACK(ackack)
+	case packets.KEEPALIVE, packets.HANDSHAKE:
+		// a repeated conclusion response or keep-alive only shows liveness
+	case packets.SHUTDOWN:
+		if _, err := packets.ParseShutdownControlPacket(p); err != nil {
+			c.log.Debug("malformed control packet", "err", err)
+			return
+		}
+		if !c.state.Set(state.Closing, state.ErrPeerShutdown) {
+			return
+		}
+		c.log.Info("peer shut down the connection")
+		// let the packets already received reach their delivery time, as
+		// the listener does
+		c.mu.Lock()
+		latency := c.recvLatency
+		c.mu.Unlock()
+		time.AfterFunc(latency+tickInterval, func() {
+			c.release()
+			c.state.Set(state.Closed, state.ErrPeerShutdown)
+		})
+	case packets.PEERERROR:
+		pe, err := packets.ParsePeerErrorControlPacket(p)
+		if err != nil {
+			c.log.Debug("malformed control packet", "err", err)
+			return
+		}
+		reason := state.PeerError{Code: pe.ErrorCode}
+		c.log.Warn("peer error, closing connection", "code", pe.ErrorCode)
+		c.end(state.Broken, reason)
+	default:
+		c.log.Debug("unhandled control packet", "control_type", p.ControlType)
+	}
+}
+
+func (c *Conn) handleACK(ack *packets.AcknowledgementControlPacket) {
+	if ack.IsFull() {
+		ackack := packets.ACKACKControlPacket{
+			AcknowledgementNumber: ack.AcknowledgementNumber,
+			Timestamp:             c.timestamp(),
+			DestinationSocketID:   c.peerSocket,
+		}
+		c.send(ackack.Marshal())
+	}
+
+	seq := ack.LastAcknowledgedPacketSequenceNumber
+	c.mu.Lock()
+	c.sendQueue.Ack(seq)
+	if ack.IsFull() && ack.RTT != 0 {
+		c.updateRTT(time.Duration(ack.RTT) * time.Microsecond)
+	}
+	if ack.IsFull() && ack.EstimatedLinkCapacity != 0 {
+		c.capacity = ack.EstimatedLinkCapacity
+	}
+	if ack.IsFull() {
+		c.sendQueue.SetFlowWindow(int(ack.AvailableBufferSize))
+	}
+	var out []*packets.Data
+	if !c.closed {
+		out = c.sendQueue.Ready(time.Now())
+	}
+	onACK := c.onACK
+	c.mu.Unlock()
+
+	c.sendData(out)
+
+	if onACK != nil {
+		onACK(seq)
+	}
+}
+
+// updateRTT smooths an RTT sample in. It must be called with c.mu held.
+func (c *Conn) updateRTT(rtt time.Duration) {
+	diff := c.rtt - rtt
+	if diff < 0 {
+		diff = -diff
+	}
+	c.rttVar = (3*c.rttVar + diff) / 4
+	c.rtt = (7*c.rtt + rtt) / 8
+}
+
+func (c *Conn) handleNAK(nak *packets.NegativeAcknowledgmentControlPacket) {
+	ranges, err := nak.LossRanges()
+	if err != nil {
+		c.log.Debug("malformed NAK", "err", err)
+		return
+	}
+
+	c.mu.Lock()
+	for _, r := range ranges {
+		// periodic NAKs report the same losses again
+		if !seqno.Less(c.lostHigh, r.From) {
+			r.From = seqno.Next(c.lostHigh)
+		}
+		if seqno.Less(r.To, r.From) {
+			continue
+		}
+		c.lostHigh = r.To
+		n := uint64(r.Len())
+		c.counters.PacketsLost += n
+		if c.counters.PacketsSent > 0 {
+			c.counters.BytesLost += n * c.counters.BytesSent / c.counters.PacketsSent
+		}
+	}
+	onNAK := c.onNAK
+	if onNAK != nil {
+		c.mu.Unlock()
+		onNAK(c, ranges)
+		return
+	}
+	resend := c.sendQueue.Lost(ranges, time.Now())
+	c.mu.Unlock()
+
+	c.sendData(resend)
+}
+
+// retransmit sends pkt again, such as a packet of the group lost over
+// another link.
+func (c *Conn) retransmit(pkt *packets.Data) {
+	c.mu.Lock()
+	p := c.sendQueue.Retransmit(pkt, time.Now())
+	c.mu.Unlock()
+
+	c.send(p.Marshal())
+}
+
+// retransmitUnacknowledged resends the first packet the listener has not
+// acknowledged for too long, unless it sends periodic NAKs.
+func (c *Conn) retransmitUnacknowledged(now time.Time) {
+	c.mu.Lock()
+	p := c.sendQueue.Unacknowledged(now, c.rtt, c.rttVar, tickInterval)
+	c.mu.Unlock()
+
+	if p != nil {
+		c.send(p.Marshal())
+	}
+}
+
+// inFlight returns the packets sent but not yet acknowledged, in order.
+func (c *Conn) inFlight() []*packets.Data {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sendQueue.InFlight()
+}
+
+// linkStats returns the smoothed RTT and the capacity reported by the
+// peer, which is zero until the peer estimated it.
+func (c *Conn) linkStats() (time.Duration, uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rtt, c.capacity
+}
+
+func (c *Conn) tickLoop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			if c.idle(now) {
+				c.log.Warn("no response from peer, closing connection", "timeout", c.opts.PeerIdleTimeout)
+				c.end(state.Broken, state.ErrPeerIdle)
+				return
+			}
+			c.flushProbe(now, probeWait)
+			c.sendACK(now)
+			c.sendPeriodicNAK(now)
+			c.retransmitUnacknowledged(now)
+			c.dropTooLate(now)
+			c.sendKeepAlive(now)
+		}
+	}
+}
+
+func (c *Conn) idle(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return now.Sub(c.lastResponse) > c.opts.PeerIdleTimeout
+}
+
+// sendKeepAlive tells the peer we are still there when nothing else was
+// sent for a while.
+func (c *Conn) sendKeepAlive(now time.Time) {
+	c.mu.Lock()
+	quiet := now.Sub(c.lastSend) >= keepAliveInterval
+	c.mu.Unlock()
+	if !quiet {
+		return
+	}
+
+	ka := packets.KeepAliveControl{
+		Timestamp:           c.timestamp(),
+		DestinationSocketID: c.peerSocket,
+	}
+	c.send(ka.Marshal())
+}
+
+// dropTooLate forgets packets sent or held back that can no longer be
+// delivered in time.
+func (c *Conn) dropTooLate(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sendQueue.DropTooLate(now, c.latency)
+}
+
+// unstable reports whether data has been in flight for longer than the
+// stability timeout without any response from the peer.
+func (c *Conn) unstable(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	busySince := c.sendQueue.BusySince()
+	if busySince.IsZero() {
+		return false
+	}
+	timeout := c.opts.StabilityTimeout + c.rtt
+	return now.Sub(busySince) > timeout && now.Sub(c.lastResponse) > timeout
+}
+
+func (c *Conn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// State returns the current state of the connection.
+func (c *Conn) State() state.State {
+	return c.state.State()
+}
+
+// Stats returns the statistics of the connection. If clear is set, a new
+// interval starts.
+func (c *Conn) Stats(clear bool) stats.Stats {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := stats.Stats{
+		Elapsed:        now.Sub(c.startTime),
+		RTT:            c.rtt,
+		RTTVar:         c.rttVar,
+		Bandwidth:      stats.Bandwidth(c.capacity, c.payloadSize),
+		FlowWindow:     c.sendQueue.FlowWindow(),
+		SendLatency:    c.latency,
+		ReceiveLatency: c.recvLatency,
+		SendBuffer:     c.sendQueue.Occupancy(),
+		ReceiveBuffer:  c.buf.Occupancy(),
+	}
+	c.interval.Snapshot(&s, c.counters, now, clear)
+	return s
+}
+
+// Close sends SHUTDOWN to the peer and closes the connection.
+func (c *Conn) Close() error {
+	if !c.state.Set(state.Closing, nil) {
+		return nil
+	}
+	c.flushProbe(time.Now(), 0)
+	c.shutdown()
+	err := c.release()
+	c.state.Set(state.Closed, nil)
+	return err
+}
+
+func (c *Conn) shutdown() {
+	p := packets.ShutdownControlPacket{
+		Timestamp:           c.timestamp(),
+		DestinationSocketID: c.peerSocket,
+	}
+	c.send(p.Marshal())
+}
+
+// end moves the connection to the closing or broken state for reason,
+// and frees it, unless it already ended.
+func (c *Conn) end(to state.State, reason error) {
+	if !c.state.Set(to, reason) {
+		return
+	}
+	c.release()
+	c.state.Set(state.Closed, reason)
+}
+
+// release frees the socket ID, and the UDP socket if it is our own.
+func (c *Conn) release() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	c.mu.Unlock()
+	c.buf.Close()
+
+	if c.socketID != 0 {
+		c.mux.Unregister(c.socketID)
+	}
+	if c.ownMux {
+		return c.mux.Close()
+	}
+	return nil
+}
+
+func (c *Conn) send(b []byte) {
+	c.mu.Lock()
+	c.lastSend = time.Now()
+	c.mu.Unlock()
+
+	if err := c.mux.WriteTo(b, c.addr); err != nil {
+		c.log.Error("error sending", "err", err)
+	}
+}
+
+func (c *Conn) timestamp() uint32 {
+	return uint32(time.Since(c.startTime).Microseconds())
+}
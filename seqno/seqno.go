@@ -0,0 +1,161 @@
+// Package seqno implements the wrapping arithmetic of the numbers SRT
+// packets carry: 31-bit packet sequence numbers, 26-bit message numbers
+// and 32-bit microsecond timestamps.
+//
+// Wrapping numbers are compared over half of their space: a is before b
+// if b is less than half the space ahead of it, so that the number right
+// after the wrap comes after the one right before it.
+package seqno
+
+import (
+	"fmt"
+	"iter"
+	"time"
+)
+
+const (
+	Max        = 0x7FFFFFFF // largest packet sequence number, 31 bits
+	MaxMessage = 0x03FFFFFF // largest message number, 26 bits
+)
+
+// Next returns the sequence number following s.
+func Next(s uint32) uint32 { return (s + 1) & Max }
+
+// Prev returns the sequence number preceding s.
+func Prev(s uint32) uint32 { return (s - 1) & Max }
+
+// Add returns s moved by n, which may be negative.
+func Add(s uint32, n int32) uint32 { return (s + uint32(n)) & Max }
+
+// Diff returns a - b, taking the wrap into account.
+func Diff(a, b uint32) int32 {
+	return int32((a-b)<<1) >> 1
+}
+
+// Less reports whether a comes before b.
+func Less(a, b uint32) bool { return Diff(a, b) < 0 }
+
+// Range is an inclusive range of packet sequence numbers, such as the
+// packets reported lost by a NAK.
+type Range struct {
+	From uint32
+	To   uint32
+}
+
+// Len returns how many sequence numbers r holds.
+func (r Range) Len() int { return int(Diff(r.To, r.From)) + 1 }
+
+// Contains reports whether s is in r.
+func (r Range) Contains(s uint32) bool {
+	return !Less(s, r.From) && !Less(r.To, s)
+}
+
+// All iterates over the sequence numbers of r in order.
+func (r Range) All() iter.Seq[uint32] {
+	return func(yield func(uint32) bool) {
+		for s := r.From; ; s = Next(s) {
+			if !yield(s) || s == r.To {
+				return
+			}
+		}
+	}
+}
+
+// Ranges groups sequence numbers sorted in order into ranges of
+// consecutive ones.
+func Ranges(seqs []uint32) []Range {
+	var ranges []Range
+	for _, s := range seqs {
+		if n := len(ranges); n > 0 && Next(ranges[n-1].To) == s {
+			ranges[n-1].To = s
+			continue
+		}
+		ranges = append(ranges, Range{From: s, To: s})
+	}
+	return ranges
+}
+
+// EncodeLossList encodes ranges as the loss list of Appendix A of the
+// specification: a single number for a range of one, or the first number
+// with the high bit set followed by the last one.
+func EncodeLossList(ranges []Range) []uint32 {
+	var words []uint32
+	for _, r := range ranges {
+		if r.From == r.To {
+			words = append(words, r.From&Max)
+			continue
+		}
+		words = append(words, 0x80000000|r.From&Max, r.To&Max)
+	}
+	return words
+}
+
+// DecodeLossList decodes a loss list into ranges.
+func DecodeLossList(words []uint32) ([]Range, error) {
+	var ranges []Range
+	for i := 0; i < len(words); i++ {
+		if words[i]&0x80000000 == 0 {
+			ranges = append(ranges, Range{From: words[i], To: words[i]})
+			continue
+		}
+		if i+1 >= len(words) {
+			return nil, fmt.Errorf("loss range starting at %d has no end", words[i]&Max)
+		}
+		ranges = append(ranges, Range{From: words[i] & Max, To: words[i+1] & Max})
+		i++
+	}
+	return ranges, nil
+}
+
+// NextMessage returns the message number following m. Message numbers
+// start at 1 and skip 0 when wrapping, as 0 is left to packet filters.
+func NextMessage(m uint32) uint32 {
+	m = (m + 1) & MaxMessage
+	if m == 0 {
+		m = 1
+	}
+	return m
+}
+
+// MessageDiff returns a - b for message numbers, taking the wrap into
+// account.
+func MessageDiff(a, b uint32) int32 {
+	return int32((a-b)<<6) >> 6
+}
+
+// TimestampPeriod is the time after which timestamps wrap.
+const TimestampPeriod = (1 << 32) * time.Microsecond
+
+// TimestampDiff returns the time from timestamp b to timestamp a, taking
+// the wrap into account.
+func TimestampDiff(a, b uint32) time.Duration {
+	return time.Duration(int32(a-b)) * time.Microsecond
+}
+
+// Timeline turns the timestamps of a peer into the time elapsed since its
+// timestamp 0, counting the periods it wrapped. The zero value starts
+// before the first wrap.
+type Timeline struct {
+	last uint32        // latest timestamp
+	wrap time.Duration // periods wrapped before last
+}
+
+// Elapsed returns the time since timestamp 0 of ts. A timestamp from
+// before the last wrap, such as that of a retransmitted packet, counts
+// from the period before.
+func (t *Timeline) Elapsed(ts uint32) time.Duration {
+	wrap := t.wrap
+	switch {
+	case ts < t.last && t.last-ts > 1<<31:
+		// the timestamp wrapped around
+		t.wrap += TimestampPeriod
+		wrap = t.wrap
+		t.last = ts
+	case ts > t.last && ts-t.last > 1<<31:
+		// a late packet from before the wrap
+		wrap -= TimestampPeriod
+	case ts > t.last:
+		t.last = ts
+	}
+	return wrap + time.Duration(ts)*time.Microsecond
+}
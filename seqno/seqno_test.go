@@ -0,0 +1,227 @@
+package seqno_test
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"coresrt/seqno"
+)
+
+func TestArithmetic(t *testing.T) {
+	tests := []struct {
+		name string
+		got  uint32
+		want uint32
+	}{
+		{"Next(0)", seqno.Next(0), 1},
+		{"Next(Max)", seqno.Next(seqno.Max), 0},
+		{"Prev(0)", seqno.Prev(0), seqno.Max},
+		{"Prev(Max)", seqno.Prev(seqno.Max), seqno.Max - 1},
+		{"Add(Max, 1)", seqno.Add(seqno.Max, 1), 0},
+		{"Add(Max, 10)", seqno.Add(seqno.Max, 10), 9},
+		{"Add(0, -1)", seqno.Add(0, -1), seqno.Max},
+		{"Add(5, -10)", seqno.Add(5, -10), seqno.Max - 4},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %#x, want %#x", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestDiffLess(t *testing.T) {
+	tests := []struct {
+		a, b uint32
+		diff int32
+	}{
+		{0, 0, 0},
+		{0, seqno.Max, 1},
+		{seqno.Max, 0, -1},
+		{5, seqno.Max - 4, 10},
+		{seqno.Max, seqno.Max - 1, 1},
+		{0x3FFFFFFF, 0, 0x3FFFFFFF},
+		{0x40000000, 0, -0x40000000}, // half the space ahead is behind
+	}
+	for _, tt := range tests {
+		if got := seqno.Diff(tt.a, tt.b); got != tt.diff {
+			t.Errorf("Diff(%#x, %#x) = %d, want %d", tt.a, tt.b, got, tt.diff)
+		}
+		if got := seqno.Less(tt.a, tt.b); got != (tt.diff < 0) {
+			t.Errorf("Less(%#x, %#x) = %t", tt.a, tt.b, got)
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	tests := []struct {
+		name string
+		r    seqno.Range
+		all  []uint32
+		out  []uint32 // not contained
+	}{
+		{"single", seqno.Range{From: 7, To: 7}, []uint32{7}, []uint32{6, 8}},
+		{"at 0", seqno.Range{From: 0, To: 2}, []uint32{0, 1, 2}, []uint32{seqno.Max, 3}},
+		{"at Max", seqno.Range{From: seqno.Max - 1, To: seqno.Max}, []uint32{seqno.Max - 1, seqno.Max}, []uint32{seqno.Max - 2, 0}},
+		{"across the wrap", seqno.Range{From: seqno.Max - 1, To: 1}, []uint32{seqno.Max - 1, seqno.Max, 0, 1}, []uint32{seqno.Max - 2, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.r.Len(); got != len(tt.all) {
+				t.Errorf("Len() = %d, want %d", got, len(tt.all))
+			}
+			if got := slices.Collect(tt.r.All()); !slices.Equal(got, tt.all) {
+				t.Errorf("All() = %#x, want %#x", got, tt.all)
+			}
+			for _, s := range tt.all {
+				if !tt.r.Contains(s) {
+					t.Errorf("Contains(%#x) = false", s)
+				}
+			}
+			for _, s := range tt.out {
+				if tt.r.Contains(s) {
+					t.Errorf("Contains(%#x) = true", s)
+				}
+			}
+		})
+	}
+
+	// stopping early
+	r := seqno.Range{From: seqno.Max, To: 5}
+	var got []uint32
+	for s := range r.All() {
+		if got = append(got, s); len(got) == 2 {
+			break
+		}
+	}
+	if want := []uint32{seqno.Max, 0}; !slices.Equal(got, want) {
+		t.Errorf("All() stopped at 2 = %#x, want %#x", got, want)
+	}
+}
+
+func TestRanges(t *testing.T) {
+	tests := []struct {
+		name string
+		seqs []uint32
+		want []seqno.Range
+	}{
+		{"none", nil, nil},
+		{"single", []uint32{3}, []seqno.Range{{3, 3}}},
+		{"gaps", []uint32{1, 2, 3, 5, 7, 8}, []seqno.Range{{1, 3}, {5, 5}, {7, 8}}},
+		{"across the wrap", []uint32{seqno.Max - 1, seqno.Max, 0, 1, 4}, []seqno.Range{{seqno.Max - 1, 1}, {4, 4}}},
+	}
+	for _, tt := range tests {
+		if got := seqno.Ranges(tt.seqs); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: Ranges(%#x) = %#x, want %#x", tt.name, tt.seqs, got, tt.want)
+		}
+	}
+}
+
+func TestLossList(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges []seqno.Range
+		words  []uint32
+	}{
+		{"none", nil, nil},
+		{"single", []seqno.Range{{5, 5}}, []uint32{5}},
+		{"range", []seqno.Range{{5, 9}}, []uint32{0x80000005, 9}},
+		{"mixed", []seqno.Range{{1, 1}, {3, 4}, {seqno.Max, seqno.Max}}, []uint32{1, 0x80000003, 4, seqno.Max}},
+		{"across the wrap", []seqno.Range{{seqno.Max - 1, 2}}, []uint32{0xFFFFFFFE, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			words := seqno.EncodeLossList(tt.ranges)
+			if !slices.Equal(words, tt.words) {
+				t.Fatalf("EncodeLossList() = %#x, want %#x", words, tt.words)
+			}
+			ranges, err := seqno.DecodeLossList(words)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(ranges, tt.ranges) {
+				t.Errorf("DecodeLossList() = %#x, want %#x", ranges, tt.ranges)
+			}
+
+			// a range whose end is missing
+			malformed := append(words, 0x80000010)
+			if ranges, err := seqno.DecodeLossList(malformed); err == nil {
+				t.Errorf("DecodeLossList(%#x) = %#x, want an error", malformed, ranges)
+			}
+		})
+	}
+}
+
+func TestMessage(t *testing.T) {
+	next := []struct{ m, want uint32 }{
+		{1, 2},
+		{seqno.MaxMessage - 1, seqno.MaxMessage},
+		{seqno.MaxMessage, 1}, // 0 is skipped
+	}
+	for _, tt := range next {
+		if got := seqno.NextMessage(tt.m); got != tt.want {
+			t.Errorf("NextMessage(%#x) = %#x, want %#x", tt.m, got, tt.want)
+		}
+	}
+
+	diff := []struct {
+		a, b uint32
+		want int32
+	}{
+		{5, 3, 2},
+		{0, seqno.MaxMessage, 1},
+		{1, seqno.MaxMessage, 2},
+		{seqno.MaxMessage, 1, -2},
+		{seqno.MaxMessage, seqno.MaxMessage - 1, 1},
+	}
+	for _, tt := range diff {
+		if got := seqno.MessageDiff(tt.a, tt.b); got != tt.want {
+			t.Errorf("MessageDiff(%#x, %#x) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestTimestampDiff(t *testing.T) {
+	tests := []struct {
+		a, b uint32
+		want time.Duration
+	}{
+		{1000, 400, 600 * time.Microsecond},
+		{400, 1000, -600 * time.Microsecond},
+		{5, 0xFFFFFFFB, 10 * time.Microsecond},
+		{0xFFFFFFFB, 5, -10 * time.Microsecond},
+	}
+	for _, tt := range tests {
+		if got := seqno.TimestampDiff(tt.a, tt.b); got != tt.want {
+			t.Errorf("TimestampDiff(%#x, %#x) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	us := func(n uint64) time.Duration { return time.Duration(n) * time.Microsecond }
+
+	// taken in turn by the same timeline
+	steps := []struct {
+		name string
+		ts   uint32
+		want time.Duration
+	}{
+		{"start", 0, 0},
+		{"halfway", 0x7FFFFFFF, us(0x7FFFFFFF)},
+		{"before the wrap", 0xFFFFFF00, us(0xFFFFFF00)},
+		{"older", 0xFFFFFE00, us(0xFFFFFE00)},
+		{"after the wrap", 0x10, seqno.TimestampPeriod + us(0x10)},
+		{"late, from before the wrap", 0xFFFFFFF0, us(0xFFFFFFF0)},
+		{"after the wrap again", 0x20, seqno.TimestampPeriod + us(0x20)},
+		{"halfway again", 0x80000000, seqno.TimestampPeriod + us(0x80000000)},
+		{"before the second wrap", 0xFFFFFF00, seqno.TimestampPeriod + us(0xFFFFFF00)},
+		{"after the second wrap", 0x30, 2*seqno.TimestampPeriod + us(0x30)},
+	}
+	var tl seqno.Timeline
+	for _, tt := range steps {
+		if got := tl.Elapsed(tt.ts); got != tt.want {
+			t.Errorf("%s: Elapsed(%#x) = %v, want %v", tt.name, tt.ts, got, tt.want)
+		}
+	}
+}
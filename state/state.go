@@ -0,0 +1,109 @@
+// Package state defines the life cycle shared by the connections of the
+// sender and receiver packages, so a supervisor can tell a clean end of
+// stream from a network failure.
+//
+//	init -> connecting -> connected -> closing -> closed
+//	             |             |
+//	             +---------> broken ---> closed
+//
+// A connection is closing when either side closed it: locally, or by the
+// peer sending SHUTDOWN. It is broken when the handshake failed, the peer
+// went silent or reported an error. Either way it ends closed once its
+// state has been freed.
+package state
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+type State int
+
+const (
+	Init       State = iota // created, no handshake yet
+	Connecting              // handshake in progress
+	Connected               // data may flow
+	Closing                 // closed by either side, finishing up
+	Broken                  // handshake failed, peer silent or in error
+	Closed                  // all state freed
+)
+
+var names = [...]string{"init", "connecting", "connected", "closing", "broken", "closed"}
+
+func (s State) String() string {
+	if s < 0 || int(s) >= len(names) {
+		return fmt.Sprintf("state(%d)", int(s))
+	}
+	return names[s]
+}
+
+var (
+	ErrPeerShutdown = errors.New("peer shut down the connection")
+	ErrPeerIdle     = errors.New("peer idle timeout")
+)
+
+// PeerError is the reason for a connection broken by a PEERERROR packet.
+type PeerError struct {
+	Code uint32
+}
+
+func (e PeerError) Error() string {
+	return fmt.Sprintf("peer error %d", e.Code)
+}
+
+// Change is a transition, reported to state change callbacks.
+type Change struct {
+	From   State
+	To     State
+	Reason error // nil when closed locally
+}
+
+// transitions lists the states each state may change to.
+var transitions = map[State][]State{
+	Init:       {Connecting},
+	Connecting: {Connected, Broken},
+	Connected:  {Closing, Broken},
+	Closing:    {Closed},
+	Broken:     {Closed},
+}
+
+// Machine holds the state of a connection and reports its changes.
+type Machine struct {
+	mu       sync.Mutex
+	state    State
+	onChange func(Change)
+}
+
+// NewMachine returns a machine in the init state. onChange, which may be
+// nil, is called after each change from the goroutine that made it.
+func NewMachine(onChange func(Change)) *Machine {
+	return &Machine{onChange: onChange}
+}
+
+func (m *Machine) State() State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// Set changes the state to to and reports whether the transition was
+// allowed from the current state. As a connection goes through each
+// state once, only one of several goroutines racing to close it wins.
+func (m *Machine) Set(to State, reason error) bool {
+	m.mu.Lock()
+	from := m.state
+	allowed := false
+	for _, s := range transitions[from] {
+		allowed = allowed || s == to
+	}
+	if allowed {
+		m.state = to
+	}
+	m.mu.Unlock()
+
+	if allowed && m.onChange != nil {
+		m.onChange(Change{From: from, To: to, Reason: reason})
+	}
+	return allowed
+}
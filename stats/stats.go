@@ -0,0 +1,103 @@
+// Package stats defines the statistics of a connection, as returned by
+// the Stats methods of the receiver and sender packages. They follow the
+// SRT_TRACEBSTATS structure of the reference implementation: counters
+// since the connection started and since the last cleared interval, and
+// instant measurements of the link.
+package stats
+
+import "time"
+
+// Counters counts the data packets of a connection. Control packets are
+// not counted.
+type Counters struct {
+	PacketsSent          uint64 // retransmissions included
+	BytesSent            uint64
+	PacketsReceived      uint64 // retransmissions included
+	BytesReceived        uint64
+	PacketsLost          uint64 // detected missing by the receiver, or reported lost to the sender
+	BytesLost            uint64 // estimated from the average payload size
+	PacketsRetransmitted uint64 // sent again, or received with the retransmitted flag
+	BytesRetransmitted   uint64
+	PacketsDropped       uint64 // given up on as too late to be delivered
+	BytesDropped         uint64 // estimated from the average payload size on the receiver
+	PacketsUndecrypted   uint64 // always zero, as encryption is not supported
+	BytesUndecrypted     uint64
+	PacketsBelated       uint64 // received after their delivery time
+	BytesBelated         uint64
+}
+
+// Sub returns the counts of c that were not yet counted in o, which is an
+// earlier snapshot of the same counters.
+func (c Counters) Sub(o Counters) Counters {
+	return Counters{
+		PacketsSent:          c.PacketsSent - o.PacketsSent,
+		BytesSent:            c.BytesSent - o.BytesSent,
+		PacketsReceived:      c.PacketsReceived - o.PacketsReceived,
+		BytesReceived:        c.BytesReceived - o.BytesReceived,
+		PacketsLost:          c.PacketsLost - o.PacketsLost,
+		BytesLost:            c.BytesLost - o.BytesLost,
+		PacketsRetransmitted: c.PacketsRetransmitted - o.PacketsRetransmitted,
+		BytesRetransmitted:   c.BytesRetransmitted - o.BytesRetransmitted,
+		PacketsDropped:       c.PacketsDropped - o.PacketsDropped,
+		BytesDropped:         c.BytesDropped - o.BytesDropped,
+		PacketsUndecrypted:   c.PacketsUndecrypted - o.PacketsUndecrypted,
+		BytesUndecrypted:     c.BytesUndecrypted - o.BytesUndecrypted,
+		PacketsBelated:       c.PacketsBelated - o.PacketsBelated,
+		BytesBelated:         c.BytesBelated - o.BytesBelated,
+	}
+}
+
+// Buffer is the occupancy of a send or receive buffer.
+type Buffer struct {
+	Packets int
+	Bytes   int
+	Span    time.Duration // between the oldest and newest packet
+}
+
+// Stats is a snapshot of the statistics of a connection.
+type Stats struct {
+	Elapsed time.Duration // since the connection started
+
+	Total            Counters
+	Interval         Counters      // since the interval started
+	IntervalDuration time.Duration // since the interval started
+
+	RTT            time.Duration // smoothed round trip time
+	RTTVar         time.Duration
+	Bandwidth      float64       // estimated link capacity in Mbps, 0 until estimated
+	FlowWindow     int           // packets the receiver is ready to take
+	SendLatency    time.Duration // TSBPD delay of the data sent, as negotiated
+	ReceiveLatency time.Duration // TSBPD delay of the data received
+
+	SendBuffer    Buffer
+	ReceiveBuffer Buffer
+}
+
+// Interval keeps the start of the current interval of a set of counters.
+type Interval struct {
+	start time.Time
+	base  Counters
+}
+
+// NewInterval starts an interval at t.
+func NewInterval(t time.Time) Interval {
+	return Interval{start: t}
+}
+
+// Snapshot fills the counters of s from the totals at now, and starts a
+// new interval if clear is set.
+func (i *Interval) Snapshot(s *Stats, total Counters, now time.Time, clear bool) {
+	s.Total = total
+	s.Interval = total.Sub(i.base)
+	s.IntervalDuration = now.Sub(i.start)
+	if clear {
+		i.start, i.base = now, total
+	}
+}
+
+// Bandwidth converts a link capacity in packets per second into Mbps,
+// for packets of the given payload size.
+func Bandwidth(capacity uint32, payloadSize int) float64 {
+	const headers = 16 + 8 + 20 // SRT, UDP and IPv4
+	return float64(capacity) * float64(payloadSize+headers) * 8 / 1e6
+}
@@ -0,0 +1,84 @@
+package stats_test
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"coresrt/stats"
+)
+
+// counters returns counters whose fields hold from, from+step, and so on,
+// so that a field left out of a computation shows.
+func counters(from, step uint64) stats.Counters {
+	var c stats.Counters
+	v := reflect.ValueOf(&c).Elem()
+	for i := range v.NumField() {
+		v.Field(i).SetUint(from + uint64(i)*step)
+	}
+	return c
+}
+
+func TestCountersSub(t *testing.T) {
+	got := counters(100, 7).Sub(counters(10, 3))
+	v := reflect.ValueOf(got)
+	for i := range v.NumField() {
+		if want := uint64(90 + 4*i); v.Field(i).Uint() != want {
+			t.Errorf("%s = %d, want %d", v.Type().Field(i).Name, v.Field(i).Uint(), want)
+		}
+	}
+}
+
+func TestIntervalSnapshot(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	at := func(s int) time.Time { return start.Add(time.Duration(s) * time.Second) }
+	i := stats.NewInterval(start)
+
+	steps := []struct {
+		name     string
+		total    stats.Counters
+		now      time.Time
+		clear    bool
+		interval stats.Counters
+		duration time.Duration
+	}{
+		{"first", stats.Counters{PacketsSent: 10, PacketsLost: 1}, at(1), false,
+			stats.Counters{PacketsSent: 10, PacketsLost: 1}, time.Second},
+		{"cleared", stats.Counters{PacketsSent: 30, PacketsLost: 2, PacketsRetransmitted: 2}, at(2), true,
+			stats.Counters{PacketsSent: 30, PacketsLost: 2, PacketsRetransmitted: 2}, 2 * time.Second},
+		{"after the reset", stats.Counters{PacketsSent: 30, PacketsLost: 2, PacketsRetransmitted: 2}, at(3), false,
+			stats.Counters{}, time.Second},
+		{"losses and retransmissions since the reset", stats.Counters{PacketsSent: 50, PacketsLost: 5, PacketsRetransmitted: 6}, at(5), true,
+			stats.Counters{PacketsSent: 20, PacketsLost: 3, PacketsRetransmitted: 4}, 3 * time.Second},
+		{"immediately after", stats.Counters{PacketsSent: 50, PacketsLost: 5, PacketsRetransmitted: 6}, at(5), false,
+			stats.Counters{}, 0},
+	}
+	for _, st := range steps {
+		var s stats.Stats
+		i.Snapshot(&s, st.total, st.now, st.clear)
+		if s.Total != st.total {
+			t.Errorf("%s: Total %+v, want %+v", st.name, s.Total, st.total)
+		}
+		if s.Interval != st.interval || s.IntervalDuration != st.duration {
+			t.Errorf("%s: Interval %+v over %s, want %+v over %s", st.name, s.Interval, s.IntervalDuration, st.interval, st.duration)
+		}
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	tests := []struct {
+		capacity    uint32
+		payloadSize int
+		want        float64
+	}{
+		{0, 1316, 0},
+		{1000, 1316, 1000 * (1316 + 44) * 8 / 1e6},
+		{10000, 0, 10000 * 44 * 8 / 1e6},
+	}
+	for _, tt := range tests {
+		if got := stats.Bandwidth(tt.capacity, tt.payloadSize); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("Bandwidth(%d, %d) = %g, want %g", tt.capacity, tt.payloadSize, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package stats
+
+import (
+	"sort"
+	"time"
+
+	"coresrt/seqno"
+)
+
+const (
+	// ProbeInterval is the spacing of probing packet pairs: a data packet
+	// whose sequence number is a multiple of it is sent back to back with
+	// the next one.
+	ProbeInterval = 16
+
+	arrivalWindow = 16 // intervals between packet arrivals kept
+	probeWindow   = 64 // intervals between probing pairs kept
+)
+
+// IsProbe reports whether seq is the first packet of a probing pair.
+func IsProbe(seq uint32) bool {
+	return seq%ProbeInterval == 0
+}
+
+// Window estimates the receiving rate and the link capacity reported in
+// full ACKs, from the arrival times of the data packets (section 5.2.1.3
+// of the SRT draft). The receiving rate comes from the intervals between
+// consecutive arrivals, the capacity from the intervals within probing
+// pairs, which the sender sends back to back so that the link alone
+// spaces them. Both are median filtered. The zero value is ready to use.
+type Window struct {
+	arrivals [arrivalWindow]time.Duration
+	sizes    [arrivalWindow]int
+	nArr     int // arrivals recorded, the next slot is nArr % arrivalWindow
+
+	probes [probeWindow]time.Duration
+	nProbe int
+
+	last     time.Time // arrival of the previous data packet
+	lastSeq  uint32
+	probeSeq bool // the previous packet started a probing pair
+}
+
+// Arrival records a data packet of size bytes, not counting filter
+// packets. A retransmitted packet counts towards the receiving rate but
+// neither starts nor ends a probing pair, as it was not sent back to back.
+func (w *Window) Arrival(seq uint32, size int, retransmitted bool, now time.Time) {
+	if !w.last.IsZero() {
+		gap := now.Sub(w.last)
+		w.arrivals[w.nArr%arrivalWindow] = gap
+		w.sizes[w.nArr%arrivalWindow] = size
+		w.nArr++
+
+		if w.probeSeq && !retransmitted && seq == seqno.Next(w.lastSeq) {
+			w.probes[w.nProbe%probeWindow] = gap
+			w.nProbe++
+		}
+	}
+	w.last = now
+	w.lastSeq = seq
+	w.probeSeq = !retransmitted && IsProbe(seq)
+}
+
+// ReceivingRate returns the rate packets arrive at, in packets and bytes
+// per second, or zeros while too few intervals agree on it.
+func (w *Window) ReceivingRate() (pkts, bytes uint32) {
+	n := min(w.nArr, arrivalWindow)
+	lo, hi, ok := filterBounds(w.arrivals[:n])
+	if !ok {
+		return 0, 0
+	}
+	var sum time.Duration
+	count, size := 0, 0
+	for i, d := range w.arrivals[:n] {
+		if d > lo && d < hi {
+			sum += d
+			size += w.sizes[i]
+			count++
+		}
+	}
+	// the median only holds if most intervals are close to it
+	if count <= arrivalWindow/2 || sum == 0 {
+		return 0, 0
+	}
+	return uint32(int64(count) * int64(time.Second) / int64(sum)),
+		uint32(int64(size) * int64(time.Second) / int64(sum))
+}
+
+// Capacity returns the link capacity in packets per second, or 0 until a
+// probing pair arrived.
+func (w *Window) Capacity() uint32 {
+	n := min(w.nProbe, probeWindow)
+	lo, hi, ok := filterBounds(w.probes[:n])
+	if !ok {
+		return 0
+	}
+	var sum time.Duration
+	count := 0
+	for _, d := range w.probes[:n] {
+		if d > lo && d < hi {
+			sum += d
+			count++
+		}
+	}
+	if sum == 0 {
+		return 0
+	}
+	return uint32(int64(count) * int64(time.Second) / int64(sum))
+}
+
+// filterBounds returns the range around the median of intervals that
+// intervals must fall within to be taken into account: from an eighth of
+// the median to eight times it, bounds excluded.
+func filterBounds(intervals []time.Duration) (lo, hi time.Duration, ok bool) {
+	if len(intervals) == 0 {
+		return 0, 0, false
+	}
+	sorted := make([]time.Duration, len(intervals))
+	copy(sorted, intervals)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	median := sorted[len(sorted)/2]
+	if median == 0 {
+		return 0, 0, false
+	}
+	return median / 8, median * 8, true
+}
@@ -0,0 +1,126 @@
+package stats_test
+
+import (
+	"testing"
+	"time"
+
+	"coresrt/seqno"
+	"coresrt/stats"
+)
+
+func TestIsProbe(t *testing.T) {
+	tests := []struct {
+		seq  uint32
+		want bool
+	}{
+		{0, true},
+		{1, false},
+		{15, false},
+		{16, true},
+		{17, false},
+		{seqno.Max - 15, true},
+		{seqno.Max, false},
+	}
+	for _, tt := range tests {
+		if got := stats.IsProbe(tt.seq); got != tt.want {
+			t.Errorf("IsProbe(%d) = %v, want %v", tt.seq, got, tt.want)
+		}
+	}
+}
+
+// arrival is a data packet arriving gap after the previous one.
+type arrival struct {
+	seq           uint32
+	gap           time.Duration
+	retransmitted bool
+}
+
+func feed(w *stats.Window, arrivals []arrival) {
+	now := time.Unix(1700000000, 0)
+	for _, a := range arrivals {
+		now = now.Add(a.gap)
+		w.Arrival(a.seq, 1000, a.retransmitted, now)
+	}
+}
+
+// pairs returns the packets from seq 0 to n-1, each probing pair spaced
+// by the next of pairGaps and the other packets by 10ms.
+func pairs(n int, pairGaps ...time.Duration) []arrival {
+	var arrivals []arrival
+	for seq := range uint32(n) {
+		gap := 10 * time.Millisecond
+		if seq > 0 && stats.IsProbe(seq-1) {
+			gap, pairGaps = pairGaps[0], pairGaps[1:]
+		}
+		arrivals = append(arrivals, arrival{seq: seq, gap: gap})
+	}
+	return arrivals
+}
+
+func TestCapacity(t *testing.T) {
+	tests := []struct {
+		name     string
+		arrivals []arrival
+		want     uint32
+	}{
+		{"no packet", nil, 0},
+		{"before the second packet of a pair", pairs(1), 0},
+		{"one pair", pairs(2, time.Millisecond), 1000},
+		{"mean of the pairs", pairs(50, time.Millisecond, time.Millisecond, 2*time.Millisecond, 500*time.Microsecond), 888},
+		// around a median of 1ms, 100µs is below an eighth and 9ms above
+		// eight times it, so that 1ms, 1ms and 2ms are averaged
+		{"outside /8..x8 rejected", pairs(66, 100*time.Microsecond, time.Millisecond, 9*time.Millisecond, time.Millisecond, 2*time.Millisecond), 750},
+		{"on the bounds rejected", pairs(50, 125*time.Microsecond, time.Millisecond, 8*time.Millisecond, time.Millisecond), 1000},
+		{"second packet lost", []arrival{{seq: 16}, {seq: 18, gap: time.Millisecond}}, 0},
+		{"second packet retransmitted", []arrival{{seq: 16}, {seq: 17, gap: time.Millisecond, retransmitted: true}}, 0},
+		{"first packet retransmitted", []arrival{{seq: 16, retransmitted: true}, {seq: 17, gap: time.Millisecond}}, 0},
+		{"not a probe", []arrival{{seq: 15}, {seq: 16, gap: time.Millisecond}}, 0},
+		{"pair across the wrap", []arrival{{seq: seqno.Max - 15}, {seq: seqno.Max - 14, gap: time.Millisecond}}, 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w stats.Window
+			feed(&w, tt.arrivals)
+			if got := w.Capacity(); got != tt.want {
+				t.Errorf("Capacity() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReceivingRate(t *testing.T) {
+	steady := make([]arrival, 17)
+	for i := range steady {
+		steady[i] = arrival{seq: uint32(i) + 1, gap: 10 * time.Millisecond}
+	}
+	withOutliers := append([]arrival(nil), steady...)
+	for i, gap := range []time.Duration{time.Millisecond, time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond} {
+		withOutliers[3+4*i].gap = gap
+	}
+	scattered := append([]arrival(nil), steady...)
+	for i := 1; i < len(scattered); i += 2 {
+		scattered[i].gap = 100 * time.Millisecond
+	}
+
+	tests := []struct {
+		name        string
+		arrivals    []arrival
+		pkts, bytes uint32
+	}{
+		{"no packet", nil, 0, 0},
+		{"steady", steady, 100, 100000},
+		// 12 of the 16 intervals are kept, which is enough
+		{"outliers rejected", withOutliers, 100, 100000},
+		// half the intervals far from the others are too few to agree
+		{"no agreement", scattered, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w stats.Window
+			feed(&w, tt.arrivals)
+			if pkts, bytes := w.ReceivingRate(); pkts != tt.pkts || bytes != tt.bytes {
+				t.Errorf("ReceivingRate() = %d, %d, want %d, %d", pkts, bytes, tt.pkts, tt.bytes)
+			}
+		})
+	}
+}
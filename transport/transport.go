@@ -0,0 +1,163 @@
+// Package transport defines what SRT sockets send their datagrams over,
+// so that the protocol does not depend on UDP sockets: a net.UDPConn, an
+// impairing netsim.Conn, an in-memory Pipe, or anything else moving
+// datagrams, such as a DTLS wrapper or a socket batching its system calls.
+package transport
+
+import (
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PacketConn is a datagram conduit. Any net.PacketConn is one.
+//
+// ReadFrom must return an error wrapping net.ErrClosed once the conduit is
+// closed. Addresses are expected to be *net.UDPAddr, or to resolve to one
+// from their String.
+type PacketConn interface {
+	ReadFrom(p []byte) (n int, addr net.Addr, err error)
+	WriteTo(p []byte, addr net.Addr) (n int, err error)
+	LocalAddr() net.Addr
+	Close() error
+}
+
+// UDPAddr returns addr as a UDP address.
+func UDPAddr(addr net.Addr) (*net.UDPAddr, error) {
+	if a, ok := addr.(*net.UDPAddr); ok {
+		return a, nil
+	}
+	return net.ResolveUDPAddr("udp", addr.String())
+}
+
+// pipeQueueSize is the number of datagrams a pipe end holds before
+// dropping more, as a full socket buffer would.
+const pipeQueueSize = 4096
+
+// pipePorts hands out the ports of the pipe addresses.
+var pipePorts atomic.Uint32
+
+// Pipe returns the two ends of an in-memory datagram link: whatever is
+// written to one end is read from the other, whatever its destination.
+// Each end has a loopback address of its own, not used by any socket.
+//
+// The ends are net.PacketConns, so they can be impaired with netsim.
+func Pipe() (net.PacketConn, net.PacketConn) {
+	a := newPipeEnd()
+	b := newPipeEnd()
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+type pipeEnd struct {
+	addr     *net.UDPAddr
+	peer     *pipeEnd
+	incoming chan datagram
+	done     chan struct{}
+	once     sync.Once
+
+	mu       sync.Mutex
+	deadline time.Time // of reads
+	changed  chan struct{}
+}
+
+type datagram struct {
+	data []byte
+	from net.Addr
+}
+
+func newPipeEnd() *pipeEnd {
+	return &pipeEnd{
+		addr:     &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(pipePorts.Add(1))},
+		incoming: make(chan datagram, pipeQueueSize),
+		done:     make(chan struct{}),
+		changed:  make(chan struct{}),
+	}
+}
+
+func (p *pipeEnd) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		p.mu.Lock()
+		deadline, changed := p.deadline, p.changed
+		p.mu.Unlock()
+
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, p.opError("read", os.ErrDeadlineExceeded)
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		select {
+		case dg := <-p.incoming:
+			stop(timer)
+			return copy(b, dg.data), dg.from, nil
+		case <-p.done:
+			stop(timer)
+			return 0, nil, p.opError("read", net.ErrClosed)
+		case <-timeout:
+			return 0, nil, p.opError("read", os.ErrDeadlineExceeded)
+		case <-changed:
+			// the deadline was moved
+			stop(timer)
+		}
+	}
+}
+
+func stop(t *time.Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
+
+func (p *pipeEnd) WriteTo(b []byte, _ net.Addr) (int, error) {
+	select {
+	case <-p.done:
+		return 0, p.opError("write", net.ErrClosed)
+	default:
+	}
+	dg := datagram{data: append([]byte(nil), b...), from: p.addr}
+	select {
+	case p.peer.incoming <- dg:
+	default:
+		// the peer is not reading: drop, like a full socket buffer
+	}
+	return len(b), nil
+}
+
+func (p *pipeEnd) LocalAddr() net.Addr {
+	return p.addr
+}
+
+func (p *pipeEnd) Close() error {
+	p.once.Do(func() { close(p.done) })
+	return nil
+}
+
+func (p *pipeEnd) SetDeadline(t time.Time) error {
+	return p.SetReadDeadline(t)
+}
+
+func (p *pipeEnd) SetReadDeadline(t time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.deadline = t
+	close(p.changed)
+	p.changed = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline does nothing, as writes never block.
+func (p *pipeEnd) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func (p *pipeEnd) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "pipe", Addr: p.addr, Err: err}
+}
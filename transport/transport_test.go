@@ -0,0 +1,170 @@
+package transport_test
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"coresrt/transport"
+)
+
+type readResult struct {
+	data string
+	from net.Addr
+	err  error
+}
+
+// read starts a ReadFrom on conn.
+func read(conn net.PacketConn) <-chan readResult {
+	ch := make(chan readResult, 1)
+	go func() {
+		b := make([]byte, 64)
+		n, from, err := conn.ReadFrom(b)
+		ch <- readResult{string(b[:n]), from, err}
+	}()
+	return ch
+}
+
+func TestPipeSourceAddress(t *testing.T) {
+	a, b := transport.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if a.LocalAddr().String() == b.LocalAddr().String() {
+		t.Fatalf("both ends have address %s", a.LocalAddr())
+	}
+
+	// whatever the destination, the datagram goes to the other end
+	if _, err := a.WriteTo([]byte("ping"), &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 9}); err != nil {
+		t.Fatal(err)
+	}
+	got := <-read(b)
+	if got.err != nil || got.data != "ping" {
+		t.Fatalf("read %q, %v", got.data, got.err)
+	}
+	if got.from.String() != a.LocalAddr().String() {
+		t.Errorf("datagram from %s, want %s", got.from, a.LocalAddr())
+	}
+	if _, err := transport.UDPAddr(got.from); err != nil {
+		t.Errorf("source address is not a UDP address: %v", err)
+	}
+}
+
+func TestPipeDeadline(t *testing.T) {
+	tests := []struct {
+		name  string
+		first time.Duration // deadline set before reading, none if zero
+		moved time.Duration // deadline set while blocked, none if zero
+		write bool          // whether a datagram is written after moving it
+		want  error
+	}{
+		{"expired", -time.Second, 0, false, os.ErrDeadlineExceeded},
+		{"brought forward", time.Hour, 20 * time.Millisecond, false, os.ErrDeadlineExceeded},
+		{"set while blocked", 0, 20 * time.Millisecond, false, os.ErrDeadlineExceeded},
+		{"cleared", 50 * time.Millisecond, 0, true, nil},
+		{"extended", 50 * time.Millisecond, time.Hour, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := transport.Pipe()
+			defer a.Close()
+			defer b.Close()
+			deadlines := b.(interface{ SetReadDeadline(time.Time) error })
+
+			if tt.first != 0 {
+				deadlines.SetReadDeadline(time.Now().Add(tt.first))
+			}
+			ch := read(b)
+			time.Sleep(10 * time.Millisecond) // let ReadFrom block
+			var deadline time.Time
+			if tt.moved != 0 {
+				deadline = time.Now().Add(tt.moved)
+			}
+			deadlines.SetReadDeadline(deadline)
+			if tt.write {
+				// after the first deadline would have passed
+				time.Sleep(100 * time.Millisecond)
+				a.WriteTo([]byte("late"), b.LocalAddr())
+			}
+
+			select {
+			case got := <-ch:
+				if !errors.Is(got.err, tt.want) {
+					t.Fatalf("ReadFrom: %v, want %v", got.err, tt.want)
+				}
+				var opErr *net.OpError
+				if tt.want != nil && !errors.As(got.err, &opErr) {
+					t.Errorf("ReadFrom: %T, want a *net.OpError", got.err)
+				}
+				if ne, ok := got.err.(net.Error); tt.want != nil && (!ok || !ne.Timeout()) {
+					t.Errorf("ReadFrom: %v is not a timeout", got.err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("ReadFrom still blocked")
+			}
+		})
+	}
+}
+
+func TestPipeClose(t *testing.T) {
+	a, b := transport.Pipe()
+	defer a.Close()
+
+	ch := read(b)
+	time.Sleep(10 * time.Millisecond)
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-ch:
+		var opErr *net.OpError
+		if !errors.Is(got.err, net.ErrClosed) || !errors.As(got.err, &opErr) {
+			t.Errorf("blocked ReadFrom: %v, want a *net.OpError wrapping net.ErrClosed", got.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ReadFrom still blocked after Close")
+	}
+
+	if _, err := b.WriteTo([]byte("x"), a.LocalAddr()); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("WriteTo after Close: %v, want net.ErrClosed", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+	// writing to a closed end is lost, like a datagram to a closed port
+	if _, err := a.WriteTo([]byte("x"), b.LocalAddr()); err != nil {
+		t.Errorf("WriteTo a closed peer: %v", err)
+	}
+}
+
+func TestPipeQueueFull(t *testing.T) {
+	a, b := transport.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	// the queue holds 4096 datagrams, as a socket buffer would
+	const queued = 4096
+	for i := range queued + 100 {
+		if n, err := a.WriteTo([]byte{byte(i)}, b.LocalAddr()); n != 1 || err != nil {
+			t.Fatalf("WriteTo: %d, %v", n, err)
+		}
+	}
+
+	deadlines := b.(interface{ SetReadDeadline(time.Time) error })
+	buf := make([]byte, 1)
+	count := 0
+	for {
+		deadlines.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if _, _, err := b.ReadFrom(buf); err != nil {
+			break
+		}
+		if buf[0] != byte(count) {
+			t.Fatalf("datagram %d out of order", count)
+		}
+		count++
+	}
+	if count != queued {
+		t.Errorf("%d datagrams read, want %d", count, queued)
+	}
+}